@@ -2,6 +2,7 @@ package cache
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -259,40 +260,19 @@ func processRawContentBlock(pc *PromptCache, estimator *utils.TokenEstimator, bl
 			tokens = 1
 		}
 
-	case "image":
-		// 图片使用 source hash
-		data, err := json.Marshal(blockMap)
-		if err != nil {
-			return
-		}
-		hash = computeHashBytes(data)
-		// 尝试从 source 获取 base64 数据计算精确 token
-		if source, ok := blockMap["source"].(map[string]any); ok {
-			if imgData, ok := source["data"].(string); ok && imgData != "" {
-				tokens = utils.EstimateImageTokensFromBase64(imgData)
-			} else {
-				tokens = 1500 // 无法获取数据时使用默认值
+	case "image", "document":
+		// 图片与文档按内容哈希，内联数据与 file_id 引用同一内容时命中同一条目
+		source, _ := blockMap["source"].(map[string]any)
+		var ok bool
+		if hash, ok = sourceHash(blockType, utils.ParseImageSource(source)); !ok {
+			data, err := json.Marshal(blockMap)
+			if err != nil {
+				return
 			}
-		} else {
-			tokens = 1500
-		}
-
-	case "document":
-		data, err := json.Marshal(blockMap)
-		if err != nil {
-			return
-		}
-		hash = computeHashBytes(data)
-		// 尝试从 source 获取 base64 数据估算 token
-		if source, ok := blockMap["source"].(map[string]any); ok {
-			if docData, ok := source["data"].(string); ok && docData != "" {
-				tokens = utils.EstimateDocumentTokensFromBase64(docData)
-			} else {
-				tokens = 500 // 无法获取数据时使用默认值
-			}
-		} else {
-			tokens = 500
+			hash = computeHashBytes(data)
 		}
+		// token 估算与 count_tokens 一致
+		tokens = estimator.EstimateContentBlockTokens(blockMap)
 
 	default:
 		data, err := json.Marshal(blockMap)
@@ -341,17 +321,15 @@ func processTypedContentBlock(pc *PromptCache, estimator *utils.TokenEstimator,
 		tokens = estimator.EstimateToolUseTokens(toolName, toolInput)
 
 	case "image":
-		data, err := json.Marshal(block)
-		if err != nil {
-			return
-		}
-		hash = computeHashBytes(data)
-		// 尝试从 Source 获取 base64 数据计算精确 token
-		if block.Source != nil && block.Source.Data != "" {
-			tokens = utils.EstimateImageTokensFromBase64(block.Source.Data)
-		} else {
-			tokens = 1500 // 无法获取数据时使用默认值
+		var ok bool
+		if hash, ok = sourceHash(block.Type, block.Source); !ok {
+			data, err := json.Marshal(block)
+			if err != nil {
+				return
+			}
+			hash = computeHashBytes(data)
 		}
+		tokens = estimator.EstimateContentBlockTokens(block)
 
 	default:
 		data, err := json.Marshal(block)
@@ -368,6 +346,34 @@ func processTypedContentBlock(pc *PromptCache, estimator *utils.TokenEstimator,
 	processContentBlock(pc, hash, tokens, block.CacheControl, minTokens, result)
 }
 
+// sourceHash 按数据源内容计算图片/文档的哈希
+// 文件来源使用上传时记录的 sha256，内联来源哈希解码后的数据，两者内容相同时哈希相同
+func sourceHash(blockType string, source *types.ImageSource) (string, bool) {
+	if source == nil {
+		return "", false
+	}
+	var digest string
+	switch source.Type {
+	case "file":
+		meta, ok := utils.Files().Lookup(source.FileID)
+		if !ok {
+			return "", false
+		}
+		digest = meta.SHA256
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(source.Data)
+		if err != nil {
+			return "", false
+		}
+		digest = computeHashBytes(data)
+	case "text":
+		digest = computeHash(source.Data)
+	default:
+		return "", false
+	}
+	return computeHash(blockType + ":" + digest), true
+}
+
 // computeHash 计算字符串内容的 SHA-256 哈希
 func computeHash(content string) string {
 	h := sha256.Sum256([]byte(content))
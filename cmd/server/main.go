@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"kiro/converter"
 	"kiro/server"
+	"kiro/utils"
 
 	"github.com/joho/godotenv"
 )
@@ -12,6 +14,23 @@ import (
 func main() {
 	godotenv.Load()
 
+	// .env 加载后重建出站客户端，使代理与证书配置生效
+	if err := utils.InitHTTPClients(); err != nil {
+		fmt.Fprintf(os.Stderr, "出站网络配置无效: %v\n", err)
+		os.Exit(1)
+	}
+	// 图片预处理与历史 thinking 配置同样在 .env 加载后生效
+	utils.InitImagePipeline()
+	converter.InitHistoryThinking()
+	if err := utils.InitURLFetcher(); err != nil {
+		fmt.Fprintf(os.Stderr, "URL 抓取配置无效: %v\n", err)
+		os.Exit(1)
+	}
+	// 文件存储目录不可用时关闭 Files API，不影响其他端点
+	if err := utils.InitFileStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARNING] Files API 已关闭: %v\n", err)
+	}
+
 	server.StartTokenRefresher()
 
 	port := os.Getenv("PORT")
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"strconv"
+	"time"
 )
 
 // ModelMap 模型映射表（映射到 CodeWhisperer 实际支持的模型 ID）
@@ -69,6 +71,13 @@ var ModelMap = map[string]string{
 	"claude-sonnet-3-5-thinking":          "claude-sonnet-4.5",
 }
 
+// ExclusiveSamplingModels 不允许同时指定 temperature 与 top_p 的上游模型
+var ExclusiveSamplingModels = map[string]bool{
+	"claude-opus-4.5":   true,
+	"claude-sonnet-4.5": true,
+	"claude-haiku-4.5":  true,
+}
+
 // RefreshTokenURL Kiro 刷新token的URL
 const RefreshTokenURL = "https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken"
 
@@ -93,6 +102,10 @@ const KiroVersion = "0.1.25"
 // 可通过环境变量 MAX_TOOL_DESCRIPTION_LENGTH 配置，默认 10000
 var MaxToolDescriptionLength = getEnvIntWithDefault("MAX_TOOL_DESCRIPTION_LENGTH", 10000)
 
+// MaxToolSchemaBytes 单个工具 input_schema 规范化后的最大字节数（0 表示不限制）
+// 可通过环境变量 MAX_TOOL_SCHEMA_BYTES 配置，默认 32768
+var MaxToolSchemaBytes = getEnvIntWithDefault("MAX_TOOL_SCHEMA_BYTES", 32768)
+
 // getEnvIntWithDefault 获取整数类型环境变量（带默认值）
 func getEnvIntWithDefault(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
@@ -102,3 +115,32 @@ func getEnvIntWithDefault(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvDurationWithDefault 获取时长类型环境变量（带默认值），支持 "30s"、"2m" 等格式
+func getEnvDurationWithDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvBoolWithDefault 获取布尔类型环境变量（带默认值）
+func getEnvBoolWithDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// loadJSONFile 读取 JSON 配置文件到目标结构
+func loadJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 上下文窗口管理策略
+const (
+	// ContextStrategyElideToolResults 将较早的 tool_result 内容替换为占位说明
+	ContextStrategyElideToolResults = "elide_tool_results"
+	// ContextStrategySummarize 额外调用一次上游，将较早的对话压缩为摘要
+	ContextStrategySummarize = "summarize"
+	// ContextStrategyTruncate 丢弃最早的对话轮次（tool_use/tool_result 成对保留或丢弃）
+	ContextStrategyTruncate = "truncate"
+)
+
+// ContextWindowConfig 上下文窗口管理配置
+type ContextWindowConfig struct {
+	// Strategies 按顺序尝试的策略，估算 token 数回到预算内即停止（为空表示关闭）
+	Strategies []string
+	// DefaultBudget 未单独配置的模型使用的输入 token 预算
+	DefaultBudget int
+	// ModelBudgets 按模型覆盖的预算（key: 请求模型名或上游模型ID）
+	ModelBudgets map[string]int
+	// KeepRecentTurns 始终原样保留的最近对话轮次数
+	KeepRecentTurns int
+	// ElideMinChars tool_result 内容超过该字符数才会被省略
+	ElideMinChars int
+	// SummaryMaxTokens 摘要请求的 max_tokens
+	SummaryMaxTokens int
+}
+
+// LoadContextWindowConfig 从环境变量读取上下文窗口管理配置
+// - CONTEXT_STRATEGY: 逗号分隔的策略列表，如 elide_tool_results,truncate；未设置或 off 表示关闭
+// - CONTEXT_BUDGET_FILE: 按模型预算的 JSON 文件，格式 {"模型": token数}
+func LoadContextWindowConfig() (*ContextWindowConfig, error) {
+	cfg := &ContextWindowConfig{
+		DefaultBudget:    getEnvIntWithDefault("CONTEXT_BUDGET_TOKENS", 160000),
+		ModelBudgets:     map[string]int{},
+		KeepRecentTurns:  getEnvIntWithDefault("CONTEXT_KEEP_RECENT_TURNS", 4),
+		ElideMinChars:    getEnvIntWithDefault("CONTEXT_ELIDE_MIN_CHARS", 500),
+		SummaryMaxTokens: getEnvIntWithDefault("CONTEXT_SUMMARY_MAX_TOKENS", 2048),
+	}
+	if cfg.KeepRecentTurns < 1 {
+		cfg.KeepRecentTurns = 1
+	}
+
+	// 默认关闭：压缩会改写历史，需显式启用
+	for _, s := range strings.Split(os.Getenv("CONTEXT_STRATEGY"), ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch s {
+		case "", "off", "none":
+			continue
+		case ContextStrategyElideToolResults, ContextStrategySummarize, ContextStrategyTruncate:
+			cfg.Strategies = append(cfg.Strategies, s)
+		default:
+			return cfg, fmt.Errorf("未知的上下文策略: %q", s)
+		}
+	}
+
+	if path := strings.TrimSpace(os.Getenv("CONTEXT_BUDGET_FILE")); path != "" {
+		budgets := map[string]int{}
+		if err := loadJSONFile(path, &budgets); err != nil {
+			return cfg, fmt.Errorf("读取 CONTEXT_BUDGET_FILE 失败: %v", err)
+		}
+		for model, budget := range budgets {
+			if budget < 1 {
+				return cfg, fmt.Errorf("模型 %s 的预算必须为正整数", model)
+			}
+		}
+		cfg.ModelBudgets = budgets
+	}
+	return cfg, nil
+}
+
+// BudgetFor 返回模型的输入 token 预算（先匹配请求模型名，再匹配上游模型ID）
+func (c *ContextWindowConfig) BudgetFor(model string) int {
+	if budget, ok := c.ModelBudgets[model]; ok {
+		return budget
+	}
+	if upstream, ok := ModelMap[model]; ok {
+		if budget, ok := c.ModelBudgets[upstream]; ok {
+			return budget
+		}
+	}
+	return c.DefaultBudget
+}
+
+// ToolPruningConfig 大工具集的相关性裁剪配置
+type ToolPruningConfig struct {
+	// TopN 工具数超过该值时只向上游发送最相关的 TopN 个（0 表示关闭）
+	TopN int
+	// ContextMessages 计算相关性时参考的最近消息数
+	ContextMessages int
+}
+
+// LoadToolPruningConfig 从环境变量读取工具裁剪配置
+func LoadToolPruningConfig() *ToolPruningConfig {
+	cfg := &ToolPruningConfig{
+		TopN:            getEnvIntWithDefault("TOOL_PRUNE_TOP_N", 0),
+		ContextMessages: getEnvIntWithDefault("TOOL_PRUNE_CONTEXT_MESSAGES", 6),
+	}
+	if cfg.TopN < 0 {
+		cfg.TopN = 0
+	}
+	if cfg.ContextMessages < 1 {
+		cfg.ContextMessages = 1
+	}
+	return cfg
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// FilesConfig Files API 配置（上传的文件保存在本地磁盘）
+type FilesConfig struct {
+	// Dir 文件存储目录（为空时关闭 Files API）
+	Dir string
+	// MaxFileBytes 单个文件的最大字节数
+	MaxFileBytes int64
+	// QuotaBytes 每个 API Key 可占用的总字节数（0 表示不限制）
+	QuotaBytes int64
+	// MaxFiles 每个 API Key 可保存的文件数（0 表示不限制）
+	MaxFiles int
+	// TotalBytes 所有 API Key 合计可占用的字节数（0 表示不限制）
+	TotalBytes int64
+}
+
+// LoadFilesConfig 从环境变量读取 Files API 配置
+// - FILES_DIR: 存储目录，未设置或设为 off 时关闭 Files API（默认关闭，需显式开启）
+// - FILES_MAX_FILE_BYTES: 单个文件上限，默认 32MB
+// - FILES_QUOTA_BYTES: 每个 API Key 的总容量，默认 1GB
+// - FILES_MAX_COUNT: 每个 API Key 的文件数上限，默认 500
+// - FILES_TOTAL_BYTES: 所有 API Key 合计的存储上限，默认 10GB
+func LoadFilesConfig() *FilesConfig {
+	cfg := &FilesConfig{
+		Dir:          strings.TrimSpace(os.Getenv("FILES_DIR")),
+		MaxFileBytes: int64(getEnvIntWithDefault("FILES_MAX_FILE_BYTES", 32*1024*1024)),
+		QuotaBytes:   int64(getEnvIntWithDefault("FILES_QUOTA_BYTES", 1024*1024*1024)),
+		MaxFiles:     getEnvIntWithDefault("FILES_MAX_COUNT", 500),
+		TotalBytes:   int64(getEnvIntWithDefault("FILES_TOTAL_BYTES", 10*1024*1024*1024)),
+	}
+	switch strings.ToLower(cfg.Dir) {
+	case "off", "false", "none":
+		cfg.Dir = ""
+	}
+	if cfg.MaxFileBytes <= 0 {
+		cfg.MaxFileBytes = 32 * 1024 * 1024
+	}
+	if cfg.QuotaBytes < 0 {
+		cfg.QuotaBytes = 0
+	}
+	if cfg.MaxFiles < 0 {
+		cfg.MaxFiles = 0
+	}
+	if cfg.TotalBytes < 0 {
+		cfg.TotalBytes = 0
+	}
+	return cfg
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// 历史 assistant 消息中 thinking 块的保留方式
+const (
+	HistoryThinkingAll    = "all"    // 保留全部历史 thinking
+	HistoryThinkingLatest = "latest" // 只保留最近一轮（最后一条用户输入之后）的 thinking
+	HistoryThinkingOff    = "off"    // 不保留，与旧版本行为一致
+)
+
+// LoadHistoryThinkingMode 从环境变量读取历史 thinking 的保留方式
+// - HISTORY_THINKING: all（默认）、latest、off，无法识别的值按默认处理
+func LoadHistoryThinkingMode() string {
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("HISTORY_THINKING"))); mode {
+	case HistoryThinkingLatest, HistoryThinkingOff:
+		return mode
+	default:
+		return HistoryThinkingAll
+	}
+}
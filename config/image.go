@@ -0,0 +1,36 @@
+package config
+
+// ImagePipelineConfig 图片预处理配置（发往上游前缩放、转码与限制大小）
+type ImagePipelineConfig struct {
+	// MaxLongEdge 长边超过该像素数时等比缩小（0 表示不限制）
+	MaxLongEdge int
+	// MaxBytes 处理后单张图片的最大字节数，超过时转为 JPEG 并逐步缩小（0 表示不限制）
+	MaxBytes int
+	// JPEGQuality 重新编码为 JPEG 时的质量（1-100）
+	JPEGQuality int
+	// MaxPixels 声明的像素数（宽×高）上限，超过时直接拒绝，避免解码时分配巨量内存（0 表示不限制）
+	MaxPixels int
+}
+
+// LoadImagePipelineConfig 从环境变量读取图片预处理配置
+func LoadImagePipelineConfig() *ImagePipelineConfig {
+	cfg := &ImagePipelineConfig{
+		MaxLongEdge: getEnvIntWithDefault("IMAGE_MAX_LONG_EDGE", 1568),
+		MaxBytes:    getEnvIntWithDefault("IMAGE_MAX_BYTES", 3750000),
+		JPEGQuality: getEnvIntWithDefault("IMAGE_JPEG_QUALITY", 85),
+		MaxPixels:   getEnvIntWithDefault("IMAGE_MAX_PIXELS", 50000000),
+	}
+	if cfg.MaxLongEdge < 0 {
+		cfg.MaxLongEdge = 0
+	}
+	if cfg.MaxBytes < 0 {
+		cfg.MaxBytes = 0
+	}
+	if cfg.MaxPixels < 0 {
+		cfg.MaxPixels = 0
+	}
+	if cfg.JPEGQuality < 1 || cfg.JPEGQuality > 100 {
+		cfg.JPEGQuality = 85
+	}
+	return cfg
+}
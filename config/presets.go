@@ -0,0 +1,84 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ModelPreset 虚拟模型预设：解析为 ModelMap 中的基础模型，并附带一组统一的默认参数
+type ModelPreset struct {
+	// Model 基础模型（ModelMap 中的名称）
+	Model string `json:"model"`
+	// Description 在 /v1/models 中展示的名称（为空时使用预设名）
+	Description string `json:"description,omitempty"`
+	// SystemPrefix 插入到 system 最前面的提示词
+	SystemPrefix string `json:"system_prefix,omitempty"`
+	// Thinking 强制开启或关闭 thinking（为空时沿用请求）
+	Thinking *bool `json:"thinking,omitempty"`
+	// ThinkingBudget 开启 thinking 时的 budget_tokens（为空时沿用请求或默认值）
+	ThinkingBudget int `json:"thinking_budget,omitempty"`
+	// Temperature 请求未指定 temperature 时使用的值
+	Temperature *float64 `json:"temperature,omitempty"`
+	// MaxTokens max_tokens 上限，请求未指定时直接使用
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// AllowTools 只保留这些工具（为空表示不限制）
+	AllowTools []string `json:"allow_tools,omitempty"`
+	// DenyTools 移除这些工具（在 AllowTools 之后应用）
+	DenyTools []string `json:"deny_tools,omitempty"`
+}
+
+// LoadModelPresets 从 MODEL_PRESETS_FILE 读取虚拟模型预设
+// 文件格式 {"预设名": {"model": "claude-sonnet-4-5", ...}}；无效的预设会被跳过并在错误中说明
+func LoadModelPresets() (map[string]*ModelPreset, error) {
+	presets := map[string]*ModelPreset{}
+	path := strings.TrimSpace(os.Getenv("MODEL_PRESETS_FILE"))
+	if path == "" {
+		return presets, nil
+	}
+
+	raw := map[string]*ModelPreset{}
+	if err := loadJSONFile(path, &raw); err != nil {
+		return presets, fmt.Errorf("读取 MODEL_PRESETS_FILE 失败: %v", err)
+	}
+
+	var errs []error
+	for name, preset := range raw {
+		if err := validateModelPreset(name, preset); err != nil {
+			errs = append(errs, fmt.Errorf("预设 %s: %v", name, err))
+			continue
+		}
+		presets[name] = preset
+	}
+	return presets, errors.Join(errs...)
+}
+
+// validateModelPreset 校验预设名与参数，确保应用预设后的请求能通过请求校验
+func validateModelPreset(name string, preset *ModelPreset) error {
+	switch {
+	case preset == nil:
+		return fmt.Errorf("配置为空")
+	case ModelMap[name] != "":
+		return fmt.Errorf("与已有模型同名")
+	case ModelMap[preset.Model] == "":
+		return fmt.Errorf("基础模型 %q 不存在", preset.Model)
+	case preset.MaxTokens < 0:
+		return fmt.Errorf("max_tokens 不能为负数")
+	case preset.Temperature != nil && (*preset.Temperature < 0 || *preset.Temperature > 1):
+		return fmt.Errorf("temperature 必须在 0 到 1 之间")
+	}
+
+	if preset.Thinking != nil && *preset.Thinking {
+		if preset.Temperature != nil && *preset.Temperature != 1 {
+			return fmt.Errorf("开启 thinking 时 temperature 只能为 1")
+		}
+		if preset.ThinkingBudget != 0 && preset.ThinkingBudget < 1024 {
+			return fmt.Errorf("thinking_budget 不能小于 1024")
+		}
+		if preset.MaxTokens > 0 && preset.MaxTokens <= max(preset.ThinkingBudget, 1024) {
+			return fmt.Errorf("max_tokens 必须大于 thinking_budget")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BuiltinChunkedWriteRule 内置规则名：分块写入协议，防止大文件写入超时
+const BuiltinChunkedWriteRule = "chunked_write"
+
+// chunkedWriteTemplate 分块写入协议提示
+const chunkedWriteTemplate = `# CRITICAL: CHUNKED WRITE PROTOCOL (MANDATORY)
+
+- **MAXIMUM 350 LINES** per single write/edit operation
+- AWS Kiro API has a 2-3 minute timeout for large file write operations
+- If you need to write more than 350 lines, split into multiple operations
+- For new files: Create with first chunk, then append remaining chunks
+- For edits: Make multiple targeted edits instead of one large replacement`
+
+// PromptRule 提示注入规则：条件全部满足时将模板追加到 system 提示
+// 每类条件内任一项匹配即可，未设置的条件不参与判断；没有任何条件的规则对所有请求生效
+type PromptRule struct {
+	// Name 规则名，与内置规则同名时覆盖内置规则
+	Name string `json:"name"`
+	// Disabled 关闭该规则（可用于关闭内置规则）
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Headers 请求头条件，值为空或 * 表示只要求存在，否则按通配符匹配
+	Headers map[string]string `json:"headers,omitempty"`
+	// APIKeys 客户端 API Key 标识（AccountID，即 refresh token 的哈希，与 /admin/status 和权重文件一致）
+	APIKeys []string `json:"api_keys,omitempty"`
+	// Models 请求模型名（支持 * 通配符）
+	Models []string `json:"models,omitempty"`
+	// Tools 请求包含其中任一工具（* 表示包含任意工具）
+	Tools []string `json:"tools,omitempty"`
+	// UserAgents 客户端 User-Agent 包含的关键字（不区分大小写）
+	UserAgents []string `json:"user_agents,omitempty"`
+	// MessagePrefix 最后一条用户消息以该标记开头
+	MessagePrefix string `json:"message_prefix,omitempty"`
+	// StripMarker 从用户消息中去掉 MessagePrefix 标记，避免标记进入对话
+	StripMarker bool `json:"strip_marker,omitempty"`
+
+	// Template 注入的提示文本
+	Template string `json:"template,omitempty"`
+	// TemplateFile 从文件读取注入文本（相对路径基于规则文件所在目录）
+	TemplateFile string `json:"template_file,omitempty"`
+}
+
+// BuiltinPromptRules 内置提示注入规则
+// 分块写入协议默认由用户消息开头的 -agent 标记触发，标记不会发给模型
+func BuiltinPromptRules() []*PromptRule {
+	return []*PromptRule{
+		{
+			Name:          BuiltinChunkedWriteRule,
+			MessagePrefix: "-agent",
+			StripMarker:   true,
+			Template:      chunkedWriteTemplate,
+		},
+	}
+}
+
+// LoadPromptRules 读取提示注入规则：内置规则 + PROMPT_RULES_FILE 中的规则
+// 文件格式为规则数组；与内置规则同名的规则替换内置规则，可只修改触发条件而沿用内置模板
+func LoadPromptRules() ([]*PromptRule, error) {
+	rules := BuiltinPromptRules()
+	path := strings.TrimSpace(os.Getenv("PROMPT_RULES_FILE"))
+	if path == "" {
+		return rules, nil
+	}
+
+	var custom []*PromptRule
+	if err := loadJSONFile(path, &custom); err != nil {
+		return rules, fmt.Errorf("读取 PROMPT_RULES_FILE 失败: %v", err)
+	}
+
+	for i, rule := range custom {
+		if rule == nil || strings.TrimSpace(rule.Name) == "" {
+			return rules, fmt.Errorf("第 %d 条规则缺少 name", i+1)
+		}
+		if rule.TemplateFile != "" {
+			templatePath := rule.TemplateFile
+			if !filepath.IsAbs(templatePath) {
+				templatePath = filepath.Join(filepath.Dir(path), templatePath)
+			}
+			data, err := os.ReadFile(templatePath)
+			if err != nil {
+				return rules, fmt.Errorf("规则 %s 读取模板失败: %v", rule.Name, err)
+			}
+			rule.Template = string(data)
+		}
+		if rule.StripMarker && rule.MessagePrefix == "" {
+			return rules, fmt.Errorf("规则 %s 设置了 strip_marker 但没有 message_prefix", rule.Name)
+		}
+
+		if replaced := replacePromptRule(rules, rule); !replaced {
+			if strings.TrimSpace(rule.Template) == "" && !rule.Disabled {
+				return rules, fmt.Errorf("规则 %s 缺少 template 或 template_file", rule.Name)
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// replacePromptRule 用同名规则替换已有规则，未指定模板时沿用原模板
+func replacePromptRule(rules []*PromptRule, rule *PromptRule) bool {
+	for i, existing := range rules {
+		if existing.Name != rule.Name {
+			continue
+		}
+		if strings.TrimSpace(rule.Template) == "" {
+			rule.Template = existing.Template
+		}
+		rules[i] = rule
+		return true
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// CircuitBreakerConfig 上游熔断器配置（按 账号+端点 维度独立统计）
+type CircuitBreakerConfig struct {
+	Enabled bool
+	// WindowSize 滑动窗口内保留的最近调用数
+	WindowSize int
+	// MinRequests 窗口内至少达到该调用数才计算错误率
+	MinRequests int
+	// FailureRateThreshold 错误率阈值（百分比），达到后熔断
+	FailureRateThreshold int
+	// SlowCallThreshold 上游首个字节（非 200 时为响应头）返回耗时超过该值视为失败
+	SlowCallThreshold time.Duration
+	// OpenDuration 熔断后保持打开的时长，之后进入半开状态
+	OpenDuration time.Duration
+	// HalfOpenMaxCalls 半开状态允许的探测请求数，全部成功则恢复
+	HalfOpenMaxCalls int
+}
+
+// LoadCircuitBreakerConfig 从环境变量读取熔断器配置
+func LoadCircuitBreakerConfig() *CircuitBreakerConfig {
+	cfg := &CircuitBreakerConfig{
+		Enabled:              getEnvBoolWithDefault("CIRCUIT_BREAKER_ENABLED", true),
+		WindowSize:           getEnvIntWithDefault("CIRCUIT_BREAKER_WINDOW_SIZE", 20),
+		MinRequests:          getEnvIntWithDefault("CIRCUIT_BREAKER_MIN_REQUESTS", 10),
+		FailureRateThreshold: getEnvIntWithDefault("CIRCUIT_BREAKER_FAILURE_RATE", 50),
+		SlowCallThreshold:    getEnvDurationWithDefault("CIRCUIT_BREAKER_SLOW_CALL", 60*time.Second),
+		OpenDuration:         getEnvDurationWithDefault("CIRCUIT_BREAKER_OPEN_DURATION", 30*time.Second),
+		HalfOpenMaxCalls:     getEnvIntWithDefault("CIRCUIT_BREAKER_HALF_OPEN_CALLS", 1),
+	}
+
+	// 兜底非法值，避免窗口为 0 导致除零
+	if cfg.WindowSize < 1 {
+		cfg.WindowSize = 1
+	}
+	if cfg.MinRequests < 1 {
+		cfg.MinRequests = 1
+	}
+	if cfg.MinRequests > cfg.WindowSize {
+		cfg.MinRequests = cfg.WindowSize
+	}
+	if cfg.HalfOpenMaxCalls < 1 {
+		cfg.HalfOpenMaxCalls = 1
+	}
+	return cfg
+}
+
+// StreamWatchdogConfig 上游响应流看门狗配置（0 表示不限制）
+type StreamWatchdogConfig struct {
+	// FirstEventTimeout 收到上游响应头后等待首个事件的最长时间（响应头返回之前的等待不在看门狗范围内）
+	FirstEventTimeout time.Duration
+	// IdleTimeout 相邻两个事件之间的最大间隔
+	IdleTimeout time.Duration
+	// MaxDuration 单个响应流的总时长上限
+	MaxDuration time.Duration
+}
+
+// LoadStreamWatchdogConfig 从环境变量读取响应流看门狗配置
+func LoadStreamWatchdogConfig() *StreamWatchdogConfig {
+	return &StreamWatchdogConfig{
+		FirstEventTimeout: getEnvDurationWithDefault("STREAM_FIRST_EVENT_TIMEOUT", 120*time.Second),
+		IdleTimeout:       getEnvDurationWithDefault("STREAM_IDLE_TIMEOUT", 120*time.Second),
+		MaxDuration:       getEnvDurationWithDefault("STREAM_MAX_DURATION", 30*time.Minute),
+	}
+}
+
+// ConcurrencyConfig 按账号的并发限制与排队配置
+type ConcurrencyConfig struct {
+	// MaxPerAccount 单个上游账号的最大并发生成数（0 表示不限制）
+	MaxPerAccount int
+	// QueueSize 单个账号的最大排队请求数，队列满时直接拒绝
+	QueueSize int
+	// QueueTimeout 排队等待的最长时间
+	QueueTimeout time.Duration
+	// ClientWeights 客户端权重（key: API Key 标识或 "Key标识/子标识"，默认权重 1），权重越高分到的并发份额越大
+	// 未列出的子标识归入所属 API Key 标识排队
+	ClientWeights map[string]int
+}
+
+// LoadConcurrencyConfig 从环境变量读取并发限制配置
+// - CONCURRENCY_WEIGHT_FILE: 客户端权重 JSON 文件，格式 {"API Key 标识[/子标识]": 权重}
+func LoadConcurrencyConfig() (*ConcurrencyConfig, error) {
+	cfg := &ConcurrencyConfig{
+		MaxPerAccount: getEnvIntWithDefault("ACCOUNT_MAX_CONCURRENCY", 0),
+		QueueSize:     getEnvIntWithDefault("ACCOUNT_QUEUE_SIZE", 32),
+		QueueTimeout:  getEnvDurationWithDefault("ACCOUNT_QUEUE_TIMEOUT", 60*time.Second),
+		ClientWeights: map[string]int{},
+	}
+	if cfg.QueueSize < 0 {
+		cfg.QueueSize = 0
+	}
+
+	if path := strings.TrimSpace(os.Getenv("CONCURRENCY_WEIGHT_FILE")); path != "" {
+		// 权重文件无效时返回不带权重的配置，由调用方决定是否继续
+		weights := map[string]int{}
+		if err := loadJSONFile(path, &weights); err != nil {
+			return cfg, fmt.Errorf("读取 CONCURRENCY_WEIGHT_FILE 失败: %v", err)
+		}
+		for client, weight := range weights {
+			if weight < 1 {
+				return cfg, fmt.Errorf("客户端 %s 的权重必须为正整数", client)
+			}
+		}
+		cfg.ClientWeights = weights
+	}
+	return cfg, nil
+}
+
+// ContinuationConfig 上游生成中断后的自动续写配置
+type ContinuationConfig struct {
+	// MaxContinuations 单个请求最多发起的续写次数（0 表示关闭）
+	MaxContinuations int
+	// ContinueWithoutCompletion 文本输出后未收到上游生成结束标记就 EOF 时是否续写
+	// 上游并不保证总会发送结束标记，默认关闭，避免对已完成的回答追加付费请求
+	ContinueWithoutCompletion bool
+}
+
+// LoadContinuationConfig 从环境变量读取自动续写配置
+// - AUTO_CONTINUE_MAX: 单个请求最多续写次数（默认 2）
+// - AUTO_CONTINUE_ON_MISSING_COMPLETION: 缺少生成结束标记的 EOF 是否视为中断（默认 false）
+func LoadContinuationConfig() *ContinuationConfig {
+	cfg := &ContinuationConfig{
+		MaxContinuations:          getEnvIntWithDefault("AUTO_CONTINUE_MAX", 2),
+		ContinueWithoutCompletion: getEnvBoolWithDefault("AUTO_CONTINUE_ON_MISSING_COMPLETION", false),
+	}
+	if cfg.MaxContinuations < 0 {
+		cfg.MaxContinuations = 0
+	}
+	return cfg
+}
@@ -11,6 +11,42 @@ const (
 	// 用于所有解析器，防止死循环
 	ParserMaxErrors = 5
 
+	// ========== 工具 schema 配置 ==========
+
+	// ToolSchemaMaxDepth 工具 input_schema 的最大嵌套深度
+	// 超出部分只保留类型与描述
+	ToolSchemaMaxDepth = 12
+
+	// ToolSchemaMaxNodes 规范化单个工具 schema 时最多展开的节点数
+	// 共享 $ref 被多条路径引用时展开结果会成倍增长，超出部分只保留类型与描述
+	ToolSchemaMaxNodes = 2000
+
+	// ========== 采样参数配置 ==========
+
+	// MaxStopSequences 单个请求允许的 stop_sequences 数量上限
+	// stop_sequences 由代理在响应侧匹配，数量过多会拖慢每个文本增量的处理
+	MaxStopSequences = 16
+
+	// ========== 图片预处理配置 ==========
+
+	// ImagePipelineCacheSize 缓存的图片转换结果数量
+	// 历史消息中的图片每轮都会重新发送，缓存避免重复解码与编码
+	ImagePipelineCacheSize = 16
+
+	// ========== URL 抓取配置 ==========
+
+	// URLFetchMaxRedirects URL 来源抓取最多跟随的重定向次数
+	URLFetchMaxRedirects = 3
+
+	// URLFetchCacheFreshness 抓取结果在该时间内直接复用，之后按 ETag 重新验证
+	URLFetchCacheFreshness = 5 * time.Minute
+
+	// ========== 会话标识配置 ==========
+
+	// ConversationSystemPrefixBytes 会话指纹只取 system 的前 N 字节
+	// 客户端常在 system 末尾嵌入日期、git 状态等动态信息，取稳定前缀避免同一对话中途换ID
+	ConversationSystemPrefixBytes = 512
+
 	// ========== Token缓存配置 ==========
 
 	// TokenCacheTTL Token缓存的生存时间
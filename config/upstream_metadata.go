@@ -0,0 +1,7 @@
+package config
+
+// LoadUpstreamMetadataEvents 是否在流式响应中发送 upstream_metadata 事件
+// - UPSTREAM_METADATA_EVENTS: 默认 false（非 Anthropic 标准事件，需显式启用，避免严格校验事件类型的客户端报错）
+func LoadUpstreamMetadataEvents() bool {
+	return getEnvBoolWithDefault("UPSTREAM_METADATA_EVENTS", false)
+}
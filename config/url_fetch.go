@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// URLFetchConfig URL 图片/文档来源的抓取配置
+type URLFetchConfig struct {
+	// Enabled 是否允许 URL 来源（关闭时 URL 来源直接报错）
+	Enabled bool
+	// Timeout 单个 URL 的抓取超时（包含重定向）
+	Timeout time.Duration
+	// MaxBytes 单个 URL 响应体的最大字节数
+	MaxBytes int
+	// AllowHosts 允许访问内网地址的主机名（支持 *.example.com 通配）
+	AllowHosts []string
+	// AllowPrefixes 允许访问的内网网段
+	AllowPrefixes []netip.Prefix
+	// CacheBytes 抓取结果缓存的总字节数上限（0 表示不缓存）
+	CacheBytes int
+	// MaxPerRequest 单个请求中 URL 来源的数量上限
+	MaxPerRequest int
+	// RequestTimeout 单个请求中全部 URL 来源的抓取总时限
+	RequestTimeout time.Duration
+}
+
+// LoadURLFetchConfig 从环境变量读取 URL 抓取配置
+// - URL_FETCH_ENABLED: 是否允许 URL 来源，默认 true
+// - URL_FETCH_TIMEOUT: 抓取超时，默认 15s
+// - URL_FETCH_MAX_BYTES: 响应体大小上限，默认 20MB
+// - URL_FETCH_ALLOWLIST: 逗号分隔的主机名或 CIDR，放行 SSRF 防护拦截的内网地址
+// - URL_FETCH_CACHE_BYTES: 缓存总大小，默认 64MB
+// - URL_FETCH_MAX_PER_REQUEST: 单个请求的 URL 来源数量上限，默认 20
+// - URL_FETCH_REQUEST_TIMEOUT: 单个请求全部 URL 的抓取总时限，默认 60s
+func LoadURLFetchConfig() (*URLFetchConfig, error) {
+	cfg := &URLFetchConfig{
+		Enabled:    getEnvBoolWithDefault("URL_FETCH_ENABLED", true),
+		Timeout:    getEnvDurationWithDefault("URL_FETCH_TIMEOUT", 15*time.Second),
+		MaxBytes:   getEnvIntWithDefault("URL_FETCH_MAX_BYTES", 20*1024*1024),
+		CacheBytes: getEnvIntWithDefault("URL_FETCH_CACHE_BYTES", 64*1024*1024),
+
+		MaxPerRequest:  getEnvIntWithDefault("URL_FETCH_MAX_PER_REQUEST", 20),
+		RequestTimeout: getEnvDurationWithDefault("URL_FETCH_REQUEST_TIMEOUT", 60*time.Second),
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 20 * 1024 * 1024
+	}
+	if cfg.CacheBytes < 0 {
+		cfg.CacheBytes = 0
+	}
+	if cfg.MaxPerRequest <= 0 {
+		cfg.MaxPerRequest = 20
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 60 * time.Second
+	}
+
+	for _, entry := range strings.Split(os.Getenv("URL_FETCH_ALLOWLIST"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return cfg, fmt.Errorf("URL_FETCH_ALLOWLIST 中的网段无效: %q", entry)
+			}
+			cfg.AllowPrefixes = append(cfg.AllowPrefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			cfg.AllowPrefixes = append(cfg.AllowPrefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		cfg.AllowHosts = append(cfg.AllowHosts, strings.ToLower(entry))
+	}
+	return cfg, nil
+}
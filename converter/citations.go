@@ -0,0 +1,298 @@
+package converter
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// 文档引用（citations）处理器
+
+// CitationInstruction 启用 citations 时追加到系统提示的引用说明
+const CitationInstruction = `Some documents in this conversation are split into chunks marked <chunk id="D.C">. ` +
+	`When a sentence of your answer is supported by these documents, wrap that sentence in <cite ids="D.C">...</cite>, ` +
+	`listing the ids of every supporting chunk separated by commas (for example <cite ids="0.2,0.3">). ` +
+	`Only use chunk ids that appear in the documents, do not put <cite> tags inside code blocks, ` +
+	`and do not mention chunk ids or these tags in any other way.`
+
+// 引用位置类型
+const (
+	citationCharLocation         = "char_location"
+	citationPageLocation         = "page_location"
+	citationContentBlockLocation = "content_block_location"
+)
+
+// citationChunk 文档中可被引用的一段
+// start/end 按位置类型分别为字符下标、页码或内容块下标（end 不包含）
+type citationChunk struct {
+	location string
+	document int
+	title    *string
+	text     string
+	start    int
+	end      int
+}
+
+// CitationIndex 本次请求中启用 citations 的文档分块表
+// 设计原则：
+// - document_index 按请求中全部文档的出现顺序编号（与 Anthropic API 一致），未启用 citations 的文档也占位
+// - 文本按句子切分并记录字符区间，PDF 按页切分，自定义内容文档按内容块切分
+// - 分块 id 为 "文档下标.分块下标"，模型在回复中以 <cite ids="..."> 引用
+type CitationIndex struct {
+	chunks map[string]*citationChunk
+}
+
+// PrepareCitations 将启用 citations 的文档替换为带分块标记的文本块
+// 没有启用 citations 的文档时返回原消息与 nil；返回新的消息切片，不修改原请求
+func PrepareCitations(messages []types.AnthropicRequestMessage) ([]types.AnthropicRequestMessage, *CitationIndex, error) {
+	index := &CitationIndex{chunks: make(map[string]*citationChunk)}
+	var out []types.AnthropicRequestMessage
+	document := 0
+
+	for i, msg := range messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		var replaced []any
+		for j, item := range blocks {
+			raw, ok := item.(map[string]any)
+			if !ok || raw["type"] != "document" {
+				continue
+			}
+			docIndex := document
+			document++
+
+			block, err := parseContentBlock(raw)
+			if err != nil || block.Citations == nil || !block.Citations.Enabled {
+				continue
+			}
+			text, err := index.renderCitableDocument(docIndex, block)
+			if err != nil {
+				utils.Log("文档分块失败", utils.LogErr(err), utils.LogInt("document_index", docIndex))
+				return nil, nil, fmt.Errorf("messages.%d.content.%d: failed to read the document for citations", i, j)
+			}
+
+			textBlock := map[string]any{"type": "text", "text": text}
+			if cacheControl, ok := raw["cache_control"]; ok {
+				textBlock["cache_control"] = cacheControl
+			}
+			if replaced == nil {
+				replaced = slices.Clone(blocks)
+			}
+			replaced[j] = textBlock
+		}
+		if replaced == nil {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(messages)
+		}
+		out[i].Content = replaced
+	}
+
+	if out == nil {
+		return messages, nil, nil
+	}
+	return out, index, nil
+}
+
+// renderCitableDocument 切分文档、登记分块并渲染为带 <chunk> 标记的文本
+func (ci *CitationIndex) renderCitableDocument(docIndex int, block types.ContentBlock) (string, error) {
+	if block.Source == nil {
+		return "", fmt.Errorf("文档缺少 source")
+	}
+	source, err := resolveFileSource(block.Source)
+	if err != nil {
+		return "", err
+	}
+	chunks, err := documentChunks(source)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i, chunk := range chunks {
+		chunk.document = docIndex
+		chunk.title = block.Title
+		id := fmt.Sprintf("%d.%d", docIndex, i)
+		ci.chunks[id] = chunk
+
+		if i > 0 && chunk.location != citationCharLocation {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(`<chunk id="` + id + `">` + chunk.text + "</chunk>")
+	}
+	if len(chunks) == 0 && source.MediaType == "application/pdf" {
+		sb.WriteString(emptyPDFText)
+	}
+	return wrapDocument(block, sb.String()), nil
+}
+
+// documentChunks 按数据源类型切分文档
+func documentChunks(source *types.ImageSource) ([]*citationChunk, error) {
+	switch {
+	case source.Type == "base64" && source.MediaType == "application/pdf":
+		data, err := base64.StdEncoding.DecodeString(source.Data)
+		if err != nil {
+			return nil, fmt.Errorf("文档 base64 解码失败: %v", err)
+		}
+		pages, err := utils.ExtractPDFPages(data)
+		if err != nil {
+			return nil, err
+		}
+		var chunks []*citationChunk
+		for i, page := range pages {
+			page = strings.TrimSpace(page)
+			if page == "" {
+				continue
+			}
+			chunks = append(chunks, &citationChunk{location: citationPageLocation, text: page, start: i + 1, end: i + 2})
+		}
+		return chunks, nil
+
+	case source.Type == "content":
+		var chunks []*citationChunk
+		switch v := source.Content.(type) {
+		case string:
+			chunks = append(chunks, &citationChunk{location: citationContentBlockLocation, text: v, start: 0, end: 1})
+		case []any:
+			for i, item := range v {
+				block, ok := item.(map[string]any)
+				if !ok || block["type"] != "text" {
+					continue
+				}
+				if text, ok := block["text"].(string); ok {
+					chunks = append(chunks, &citationChunk{location: citationContentBlockLocation, text: text, start: i, end: i + 1})
+				}
+			}
+		}
+		return chunks, nil
+
+	default:
+		text, err := documentText(source)
+		if err != nil {
+			return nil, err
+		}
+		return sentenceChunks(text), nil
+	}
+}
+
+// sentenceChunks 将文本按句子切分，句末的空白归入该句，各段首尾相接覆盖全文
+// 字符下标按 Unicode 码点计算
+func sentenceChunks(text string) []*citationChunk {
+	var chunks []*citationChunk
+	offset := 0
+	for start := 0; start < len(text); {
+		end := sentenceEnd(text, start)
+		n := utf8.RuneCountInString(text[start:end])
+		chunks = append(chunks, &citationChunk{
+			location: citationCharLocation,
+			text:     text[start:end],
+			start:    offset,
+			end:      offset + n,
+		})
+		offset += n
+		start = end
+	}
+	return chunks
+}
+
+// sentenceEnd 返回从 start 开始的句子结束位置（字节下标，包含句末空白）
+// 句子以 .!? 加空白、中文句末标点或换行结束
+func sentenceEnd(text string, start int) int {
+	i := start
+	for i < len(text) {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		boundary := false
+		switch r {
+		case '。', '！', '？', '\n':
+			boundary = true
+		case '.', '!', '?':
+			next, _ := utf8.DecodeRuneInString(text[i:])
+			boundary = i >= len(text) || unicode.IsSpace(next)
+		}
+		if !boundary {
+			continue
+		}
+		for i < len(text) {
+			next, size := utf8.DecodeRuneInString(text[i:])
+			if !unicode.IsSpace(next) {
+				break
+			}
+			i += size
+		}
+		return i
+	}
+	return len(text)
+}
+
+// Citations 将 <cite ids="..."> 中的分块 id 转为 Anthropic citations 数组
+// 未知的 id 被忽略；同一文档中相邻的分块合并为一条引用
+func (ci *CitationIndex) Citations(ids string) []map[string]any {
+	if ci == nil {
+		return nil
+	}
+	var merged []citationChunk
+	for id := range strings.SplitSeq(ids, ",") {
+		chunk, ok := ci.chunks[strings.TrimSpace(id)]
+		if !ok {
+			continue
+		}
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.document == chunk.document && last.location == chunk.location && last.end == chunk.start {
+				last.text += chunkSeparator(chunk.location) + chunk.text
+				last.end = chunk.end
+				continue
+			}
+		}
+		merged = append(merged, *chunk)
+	}
+
+	citations := make([]map[string]any, 0, len(merged))
+	for _, chunk := range merged {
+		citations = append(citations, chunk.citation())
+	}
+	return citations
+}
+
+// chunkSeparator 合并相邻分块时的文本分隔符：字符区间首尾相接，页与内容块之间空一行
+func chunkSeparator(location string) string {
+	if location == citationCharLocation {
+		return ""
+	}
+	return "\n\n"
+}
+
+// citation 转为 Anthropic 引用对象
+func (chunk citationChunk) citation() map[string]any {
+	citation := map[string]any{
+		"type":           chunk.location,
+		"cited_text":     chunk.text,
+		"document_index": chunk.document,
+		"document_title": nil,
+	}
+	if chunk.title != nil {
+		citation["document_title"] = *chunk.title
+	}
+	switch chunk.location {
+	case citationCharLocation:
+		citation["start_char_index"] = chunk.start
+		citation["end_char_index"] = chunk.end
+	case citationPageLocation:
+		citation["start_page_number"] = chunk.start
+		citation["end_page_number"] = chunk.end
+	case citationContentBlockLocation:
+		citation["start_block_index"] = chunk.start
+		citation["end_block_index"] = chunk.end
+	}
+	return citation
+}
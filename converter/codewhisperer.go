@@ -12,17 +12,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// agenticSystemPrompt 用于防止大文件写入超时的系统提示
-const agenticSystemPrompt = `
-# CRITICAL: CHUNKED WRITE PROTOCOL (MANDATORY)
-
-- **MAXIMUM 350 LINES** per single write/edit operation
-- AWS Kiro API has a 2-3 minute timeout for large file write operations
-- If you need to write more than 350 lines, split into multiple operations
-- For new files: Create with first chunk, then append remaining chunks
-- For edits: Make multiple targeted edits instead of one large replacement
-`
-
 // ValidateAssistantResponseEvent 验证助手响应事件
 // ConvertToAssistantResponseEvent 转换任意数据为标准的AssistantResponseEvent
 // NormalizeAssistantResponseEvent 标准化助手响应事件（填充默认值等）
@@ -30,51 +19,7 @@ const agenticSystemPrompt = `
 // normalizeReferences 标准化引用
 // CodeWhisperer格式转换器
 
-// getLastUserMessageContent 获取最后一条用户消息的文本内容
-func getLastUserMessageContent(messages []types.AnthropicRequestMessage) string {
-	// 从后向前查找最后一条用户消息
-	for i := len(messages) - 1; i >= 0; i-- {
-		if messages[i].Role == "user" {
-			return extractTextFromContent(messages[i].Content)
-		}
-	}
-	return ""
-}
-
-// extractTextFromContent 从消息内容中提取文本（支持 string 和 []ContentBlock）
-func extractTextFromContent(content any) string {
-	switch v := content.(type) {
-	case string:
-		return v
-	case []any:
-		// 处理 []any 格式（JSON 解析后的格式）
-		for _, item := range v {
-			if block, ok := item.(map[string]any); ok {
-				if blockType, exists := block["type"].(string); exists && blockType == "text" {
-					if text, exists := block["text"].(string); exists {
-						return text
-					}
-				}
-			}
-		}
-	case []types.ContentBlock:
-		// 处理 []ContentBlock 格式
-		for _, block := range v {
-			if block.Type == "text" && block.Text != nil {
-				return *block.Text
-			}
-		}
-	}
-	return ""
-}
-
-// isAgenticMode 检查是否应启用 Agentic 模式（最后一条用户消息以 "-agent" 开头）
-func isAgenticMode(messages []types.AnthropicRequestMessage) bool {
-	content := getLastUserMessageContent(messages)
-	return strings.HasPrefix(strings.TrimSpace(content), "-agent")
-}
-
-// buildEnhancedSystemPrompt 构建增强的系统提示（包含 Thinking、Agentic 注入）
+// buildEnhancedSystemPrompt 构建增强的系统提示（包含 Thinking 注入）
 func buildEnhancedSystemPrompt(anthropicReq types.AnthropicRequest) string {
 	var systemPrompt strings.Builder
 
@@ -89,13 +34,7 @@ func buildEnhancedSystemPrompt(anthropicReq types.AnthropicRequest) string {
 		}
 	}
 
-	// 2. 注入 Agentic 模式提示（条件：最后一条用户消息以 "-agent" 开头）
-	if isAgenticMode(anthropicReq.Messages) {
-		systemPrompt.WriteString("\n")
-		systemPrompt.WriteString(agenticSystemPrompt)
-	}
-
-	// 3. 注入 Thinking 模式提示（默认禁用，除非显式启用）
+	// 2. 注入 Thinking 模式提示（默认禁用，除非显式启用）
 	shouldEnableThinking := false
 	budgetTokens := 16000 // 默认值
 
@@ -179,149 +118,141 @@ func validateCodeWhispererRequest(cwReq *types.CodeWhispererRequest) error {
 }
 
 // extractToolResultsFromMessage 从消息内容中提取工具结果
-func extractToolResultsFromMessage(content any) []types.ToolResult {
+// 工具结果中的图片作为同一条用户消息的 Images 转发（上游 toolResult 仅支持 text/json），
+// 原位置以 [Image #N] 标记；imageOffset 为该消息中已收集的图片数
+func extractToolResultsFromMessage(content any, imageOffset int) ([]types.ToolResult, []types.CodeWhispererImage) {
 	var toolResults []types.ToolResult
+	var images []types.CodeWhispererImage
 
-	switch v := content.(type) {
-	case []any:
-		for _, item := range v {
-			if block, ok := item.(map[string]any); ok {
-				if blockType, exists := block["type"]; exists {
-					if typeStr, ok := blockType.(string); ok && typeStr == "tool_result" {
-						toolResult := types.ToolResult{}
-
-						// 提取 tool_use_id
-						if toolUseId, ok := block["tool_use_id"].(string); ok {
-							toolResult.ToolUseId = toolUseId
-						}
-
-						// 提取 content - 转换为数组格式
-						if content, exists := block["content"]; exists {
-							// 将 content 转换为 []map[string]any 格式
-							var contentArray []map[string]any
-
-							// 处理不同的 content 格式
-							switch c := content.(type) {
-							case string:
-								// 如果是字符串，包装成标准格式
-								contentArray = []map[string]any{
-									{"text": c},
-								}
-							case []any:
-								// 如果已经是数组，只保留 text 字段，移除 type 等其他字段
-								for _, item := range c {
-									if m, ok := item.(map[string]any); ok {
-										cleanedItem := make(map[string]any)
-										if text, hasText := m["text"]; hasText {
-											cleanedItem["text"] = text
-										}
-										if len(cleanedItem) > 0 {
-											contentArray = append(contentArray, cleanedItem)
-										}
-									}
-								}
-							case map[string]any:
-								// 如果是单个对象，包装成数组
-								contentArray = []map[string]any{c}
-							default:
-								// 其他格式，尝试转换为字符串
-								contentArray = []map[string]any{
-									{"text": fmt.Sprintf("%v", c)},
-								}
-							}
+	appendResult := func(toolUseId string, resultContent any, hasContent bool, isError bool) {
+		toolResult := types.ToolResult{ToolUseId: toolUseId}
 
-							toolResult.Content = contentArray
-						}
+		if hasContent {
+			contentArray, resultImages := convertToolResultContent(resultContent, imageOffset+len(images))
+			toolResult.Content = contentArray
+			images = append(images, resultImages...)
+		}
 
-						// 确保 Content 不为空（上游 API 要求）
-						if len(toolResult.Content) == 0 {
-							toolResult.Content = []map[string]any{{"text": ""}}
-						}
+		// 确保 Content 不为空（上游 API 要求）
+		if len(toolResult.Content) == 0 {
+			toolResult.Content = []map[string]any{{"text": ""}}
+		}
 
-						// 提取 status (默认为 success)
-						toolResult.Status = "success"
-						if isError, ok := block["is_error"].(bool); ok && isError {
-							toolResult.Status = "error"
-							toolResult.IsError = true
-						}
+		// 提取 status (默认为 success)
+		toolResult.Status = "success"
+		if isError {
+			toolResult.Status = "error"
+			toolResult.IsError = true
+		}
 
-						toolResults = append(toolResults, toolResult)
+		toolResults = append(toolResults, toolResult)
+	}
 
-						// utils.Log("提取到工具结果",
-						// 	utils.LogString("tool_use_id", toolResult.ToolUseId),
-						// 	utils.LogString("status", toolResult.Status),
-						// 	utils.LogInt("content_items", len(toolResult.Content)))
-					}
-				}
+	switch v := content.(type) {
+	case []any:
+		for _, item := range v {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "tool_result" {
+				continue
 			}
+			toolUseId, _ := block["tool_use_id"].(string)
+			resultContent, hasContent := block["content"]
+			isError, _ := block["is_error"].(bool)
+			appendResult(toolUseId, resultContent, hasContent, isError)
 		}
 	case []types.ContentBlock:
 		for _, block := range v {
-			if block.Type == "tool_result" {
-				toolResult := types.ToolResult{}
-
-				if block.ToolUseId != nil {
-					toolResult.ToolUseId = *block.ToolUseId
-				}
-
-				// 处理 content
-				if block.Content != nil {
-					var contentArray []map[string]any
-
-					switch c := block.Content.(type) {
-					case string:
-						contentArray = []map[string]any{
-							{"text": c},
-						}
-					case []any:
-						// 只保留 text 字段，移除 type 等其他字段
-						for _, item := range c {
-							if m, ok := item.(map[string]any); ok {
-								cleanedItem := make(map[string]any)
-								if text, hasText := m["text"]; hasText {
-									cleanedItem["text"] = text
-								}
-								if len(cleanedItem) > 0 {
-									contentArray = append(contentArray, cleanedItem)
-								}
-							}
-						}
-					case map[string]any:
-						// 只保留 text 字段
-						cleanedItem := make(map[string]any)
-						if text, hasText := c["text"]; hasText {
-							cleanedItem["text"] = text
-						}
-						if len(cleanedItem) > 0 {
-							contentArray = []map[string]any{cleanedItem}
-						}
-					default:
-						contentArray = []map[string]any{
-							{"text": fmt.Sprintf("%v", c)},
-						}
-					}
+			if block.Type != "tool_result" {
+				continue
+			}
+			toolUseId := ""
+			if block.ToolUseId != nil {
+				toolUseId = *block.ToolUseId
+			}
+			appendResult(toolUseId, block.Content, block.Content != nil, block.IsError != nil && *block.IsError)
+		}
+	}
 
-					toolResult.Content = contentArray
-				}
+	return toolResults, images
+}
 
-				// 确保 Content 不为空（上游 API 要求）
-				if len(toolResult.Content) == 0 {
-					toolResult.Content = []map[string]any{{"text": ""}}
-				}
+// convertToolResultContent 将 tool_result 的 content 转换为上游的内容块数组
+// - 文本块映射为 {"text": ...}；内容是 JSON 对象或数组时映射为 {"json": ...}，保留结构
+// - 图片块转为 CodeWhisperer 图片，原位置替换为 [Image #N] 文本
+// - 其他结构化块（无 text 字段）映射为 {"json": ...}
+func convertToolResultContent(content any, imageOffset int) ([]map[string]any, []types.CodeWhispererImage) {
+	var contentArray []map[string]any
+	var images []types.CodeWhispererImage
+
+	var convertItem func(item any)
+	convertItem = func(item any) {
+		switch c := item.(type) {
+		case string:
+			contentArray = append(contentArray, textOrJSONContent(c))
+		case map[string]any:
+			blockType, _ := c["type"].(string)
+			switch {
+			case blockType == "image" || blockType == "image_url":
+				contentArray = append(contentArray, map[string]any{"text": convertToolResultImage(c, imageOffset, &images)})
+			case blockType == "text" || (blockType == "" && c["text"] != nil):
+				text, _ := c["text"].(string)
+				contentArray = append(contentArray, textOrJSONContent(text))
+			default:
+				contentArray = append(contentArray, map[string]any{"json": c})
+			}
+		case []any:
+			for _, sub := range c {
+				convertItem(sub)
+			}
+		case nil:
+		default:
+			// 数字、布尔值等标量按 JSON 文本传递
+			if data, err := utils.SafeMarshal(c); err == nil {
+				contentArray = append(contentArray, map[string]any{"text": string(data)})
+			}
+		}
+	}
+	convertItem(content)
 
-				// 设置 status
-				toolResult.Status = "success"
-				if block.IsError != nil && *block.IsError {
-					toolResult.Status = "error"
-					toolResult.IsError = true
-				}
+	return contentArray, images
+}
 
-				toolResults = append(toolResults, toolResult)
-			}
+// textOrJSONContent 文本内容是合法的 JSON 对象或数组时使用 json 形式，否则使用 text 形式
+func textOrJSONContent(text string) map[string]any {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var parsed any
+		if err := utils.SafeUnmarshal([]byte(trimmed), &parsed); err == nil {
+			return map[string]any{"json": parsed}
 		}
 	}
+	return map[string]any{"text": text}
+}
+
+// convertToolResultImage 转换工具结果中的图片块，返回替代它的位置标记文本
+func convertToolResultImage(block map[string]any, imageOffset int, images *[]types.CodeWhispererImage) string {
+	contentBlock, err := parseContentBlock(block)
+	if err != nil || contentBlock.Source == nil {
+		return "[Image omitted: unsupported image source]"
+	}
+	source, err := resolveFileSource(contentBlock.Source)
+	if err != nil {
+		utils.Log("工具结果中的图片文件读取失败，已省略", utils.LogErr(err))
+		return fmt.Sprintf("[Image omitted: %v]", err)
+	}
+	if err := utils.ValidateImageContent(source); err != nil {
+		utils.Log("工具结果中的图片验证失败，已省略", utils.LogErr(err))
+		return fmt.Sprintf("[Image omitted: %v]", err)
+	}
+	cwImage, err := utils.CreateCodeWhispererImage(source)
+	if err != nil {
+		utils.Log("工具结果中的图片处理失败，已省略", utils.LogErr(err))
+		return fmt.Sprintf("[Image omitted: %v]", err)
+	}
 
-	return toolResults
+	marker := fmt.Sprintf(ImageMarkerFormat, imageOffset+len(*images))
+	*images = append(*images, *cwImage)
+	return marker
 }
 
 // BuildCodeWhispererRequest 构建 CodeWhisperer 请求
@@ -333,7 +264,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 	// 使用 UUID 作为 conversationId
 	if ctx != nil {
-		cwReq.ConversationState.ConversationId = utils.GenerateStableConversationID(ctx)
+		cwReq.ConversationState.ConversationId = utils.GenerateStableConversationID(ctx, &anthropicReq)
 	} else {
 		cwReq.ConversationState.ConversationId = utils.GenerateUUID()
 	}
@@ -343,6 +274,15 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		return cwReq, fmt.Errorf("消息列表为空")
 	}
 
+	// assistant prefill：最后一条纯文本 assistant 消息不进入历史，改为要求上游从该文本继续
+	prefill := AssistantPrefill(anthropicReq.Messages)
+	if prefill != "" {
+		anthropicReq.Messages = anthropicReq.Messages[:len(anthropicReq.Messages)-1]
+		if len(anthropicReq.Messages) == 0 {
+			return cwReq, fmt.Errorf("assistant prefill 之前缺少用户消息")
+		}
+	}
+
 	lastMessage := anthropicReq.Messages[len(anthropicReq.Messages)-1]
 
 	// 调试：记录原始消息内容
@@ -350,13 +290,22 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	// 	utils.LogString("role", lastMessage.Role),
 	// 	utils.LogString("content_type", fmt.Sprintf("%T", lastMessage.Content)))
 
-	textContent, images, err := processMessageContent(lastMessage.Content)
+	textContent, images, err := processMessageContent(lastMessage.Content, 0)
 	if err != nil {
 		return cwReq, fmt.Errorf("处理消息内容失败: %v", err)
 	}
 
-	// 构建增强的系统提示（包含 Thinking, Agentic 注入）
+	// 转换工具定义；超长描述的溢出部分进入系统提示中的工具参考章节
+	tools, toolReference := convertTools(anthropicReq.Tools)
+
+	// 构建增强的系统提示（包含 Thinking 注入）
 	enhancedSystemPrompt := buildEnhancedSystemPrompt(anthropicReq)
+	if toolReference != "" {
+		if enhancedSystemPrompt != "" {
+			enhancedSystemPrompt += "\n\n"
+		}
+		enhancedSystemPrompt += toolReference
+	}
 
 	// 只在当前消息带系统提示（用 <system_mode> 标签包裹）
 	var finalContent strings.Builder
@@ -366,6 +315,10 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		finalContent.WriteString("</system_mode>\n\n")
 	}
 	finalContent.WriteString(textContent)
+	if prefill != "" {
+		finalContent.WriteString("\n\n")
+		finalContent.WriteString(prefillInstruction(prefill))
+	}
 
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = finalContent.String()
 	// 确保Images字段始终是数组，即使为空
@@ -377,15 +330,12 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 	// 新增：检查并处理 ToolResults
 	if lastMessage.Role == "user" {
-		toolResults := extractToolResultsFromMessage(lastMessage.Content)
+		toolResults, toolResultImages := extractToolResultsFromMessage(lastMessage.Content, len(cwReq.ConversationState.CurrentMessage.UserInputMessage.Images))
 		if len(toolResults) > 0 {
 			cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.ToolResults = toolResults
-			// 对于包含 tool_result 的请求，保留系统提示
-			if enhancedSystemPrompt != "" {
-				cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = "<system_mode>" + enhancedSystemPrompt + "</system_mode>"
-			} else {
-				cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = ""
-			}
+			cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = append(
+				cwReq.ConversationState.CurrentMessage.UserInputMessage.Images, toolResultImages...)
+			// content 保留按原始顺序转换的文本，工具结果只以 [Tool result: id] 标记占位，正文在 ToolResults 中
 		}
 	}
 
@@ -393,54 +343,13 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	modelId := config.ModelMap[anthropicReq.Model]
 	if modelId == "" {
 		// 返回模型未找到错误
-		return cwReq, types.NewModelNotFoundErrorType(anthropicReq.Model, cwReq.ConversationState.ConversationId)
+		return cwReq, types.NewModelNotFoundErrorType(anthropicReq.Model)
 	}
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId = modelId
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Origin = "AI_EDITOR" // v0.4兼容性：固定使用AI_EDITOR
 
-	// 处理 tools 信息 - 根据req.json实际结构优化工具转换
-	if len(anthropicReq.Tools) > 0 {
-		// utils.Log("开始处理工具配置",
-		// 	utils.LogInt("tools_count", len(anthropicReq.Tools)),
-		// 	utils.LogString("conversation_id", cwReq.ConversationState.ConversationId))
-
-		var tools []types.CodeWhispererTool
-		for _, tool := range anthropicReq.Tools {
-			// 验证工具定义的完整性 (SOLID-SRP: 单一责任验证)
-			if tool.Name == "" {
-				continue
-			}
-
-			// 过滤不支持的工具：web_search (静默过滤，不发送到上游)
-			if tool.Name == "web_search" || tool.Name == "websearch" {
-				continue
-			}
-
-			// utils.Log("转换工具定义",
-			// 	utils.LogInt("tool_index", i),
-			// 	utils.LogString("tool_name", tool.Name),
-			// utils.LogString("tool_description", tool.Description)
-			// )
-
-			// 根据req.json的实际结构，确保JSON Schema完整性
-			cwTool := types.CodeWhispererTool{}
-			cwTool.ToolSpecification.Name = tool.Name
-
-			// 限制 description 长度为 10000 字符
-			if len(tool.Description) > config.MaxToolDescriptionLength {
-				cwTool.ToolSpecification.Description = tool.Description[:config.MaxToolDescriptionLength]
-			} else {
-				cwTool.ToolSpecification.Description = tool.Description
-			}
-
-			// 直接使用原始的InputSchema，避免过度处理 (恢复v0.4兼容性)
-			cwTool.ToolSpecification.InputSchema = types.InputSchema{
-				Json: tool.InputSchema,
-			}
-			tools = append(tools, cwTool)
-		}
-
-		// 工具配置放在 UserInputMessageContext.Tools 中 (符合req.json结构)
+	// 工具配置放在 UserInputMessageContext.Tools 中 (符合req.json结构)
+	if len(tools) > 0 {
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools = tools
 	}
 
@@ -460,6 +369,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			historyEndIndex = len(anthropicReq.Messages) // 包含最后一条assistant
 		}
 
+		// 历史 assistant 消息的 thinking 从该下标开始保留（HISTORY_THINKING）
+		thinkingStart := historyThinkingStart(anthropicReq)
+
 		for i := 0; i < historyEndIndex; i++ {
 			msg := anthropicReq.Messages[i]
 
@@ -479,7 +391,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 					for _, userMsg := range userMessagesBuffer {
 						// 处理每个user消息的内容和图片
-						messageContent, messageImages, err := processMessageContent(userMsg.Content)
+						messageContent, messageImages, err := processMessageContent(userMsg.Content, len(allImages))
 						if err == nil && messageContent != "" {
 							contentParts = append(contentParts, messageContent)
 							if len(messageImages) > 0 {
@@ -487,10 +399,11 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 							}
 						}
 
-						// 收集工具结果
-						toolResults := extractToolResultsFromMessage(userMsg.Content)
+						// 收集工具结果（及其中的图片）
+						toolResults, toolResultImages := extractToolResultsFromMessage(userMsg.Content, len(allImages))
 						if len(toolResults) > 0 {
 							allToolResults = append(allToolResults, toolResults...)
+							allImages = append(allImages, toolResultImages...)
 						}
 					}
 
@@ -503,8 +416,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					}
 					if len(allToolResults) > 0 {
 						mergedUserMsg.UserInputMessage.UserInputMessageContext.ToolResults = allToolResults
-						// 如果历史用户消息包含工具结果，也将 content 设置为空字符串
-						mergedUserMsg.UserInputMessage.Content = ""
+						// content 保留按原始顺序转换的文本与工具结果占位标记，与当前消息一致
 						// utils.Log("历史用户消息包含工具结果",
 						// 	utils.LogInt("merged_messages", len(userMessagesBuffer)),
 						// 	utils.LogInt("tool_results_count", len(allToolResults)))
@@ -519,7 +431,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 					// 添加assistant消息（只在有配对的user时添加）
 					assistantMsg := types.HistoryAssistantMessage{}
-					assistantContent, err := utils.GetMessageContent(msg.Content)
+					assistantContent, err := assistantHistoryContent(msg.Content, i >= thinkingStart)
 					if err == nil {
 						assistantMsg.AssistantResponseMessage.Content = assistantContent
 					} else {
@@ -527,7 +439,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					}
 
 					// 提取助手消息中的工具调用
-					toolUses := extractToolUsesFromMessage(msg.Content)
+					toolUses := aliasToolUses(extractToolUsesFromMessage(msg.Content))
 					if len(toolUses) > 0 {
 						assistantMsg.AssistantResponseMessage.ToolUses = toolUses
 					} else {
@@ -540,7 +452,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					lastHistoryIdx := len(history) - 1
 					if lastAssistant, ok := history[lastHistoryIdx].(types.HistoryAssistantMessage); ok {
 						// 合并内容
-						additionalContent, err := utils.GetMessageContent(msg.Content)
+						additionalContent, err := assistantHistoryContent(msg.Content, i >= thinkingStart)
 						if err == nil && additionalContent != "" {
 							if lastAssistant.AssistantResponseMessage.Content != "" {
 								lastAssistant.AssistantResponseMessage.Content += "\n" + additionalContent
@@ -550,7 +462,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 						}
 
 						// 合并工具调用
-						additionalToolUses := extractToolUsesFromMessage(msg.Content)
+						additionalToolUses := aliasToolUses(extractToolUsesFromMessage(msg.Content))
 						if len(additionalToolUses) > 0 {
 							lastAssistant.AssistantResponseMessage.ToolUses = append(
 								lastAssistant.AssistantResponseMessage.ToolUses,
@@ -576,7 +488,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			var allToolResults []types.ToolResult
 
 			for _, userMsg := range userMessagesBuffer {
-				messageContent, messageImages, err := processMessageContent(userMsg.Content)
+				messageContent, messageImages, err := processMessageContent(userMsg.Content, len(allImages))
 				if err == nil && messageContent != "" {
 					contentParts = append(contentParts, messageContent)
 					if len(messageImages) > 0 {
@@ -584,9 +496,10 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					}
 				}
 
-				toolResults := extractToolResultsFromMessage(userMsg.Content)
+				toolResults, toolResultImages := extractToolResultsFromMessage(userMsg.Content, len(allImages))
 				if len(toolResults) > 0 {
 					allToolResults = append(allToolResults, toolResults...)
+					allImages = append(allImages, toolResultImages...)
 				}
 			}
 
@@ -596,7 +509,6 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			}
 			if len(allToolResults) > 0 {
 				mergedOrphanUserMsg.UserInputMessage.UserInputMessageContext.ToolResults = allToolResults
-				mergedOrphanUserMsg.UserInputMessage.Content = ""
 			}
 
 			mergedOrphanUserMsg.UserInputMessage.ModelId = modelId
@@ -614,13 +526,12 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	}
 
 	// 设置 InferenceConfig（参考 CLIProxyAPIPlus 格式）
+	// 上游支持 maxTokens、temperature、topP；top_k 在请求校验时拒绝，stop_sequences 由代理在响应侧处理
 	if anthropicReq.MaxTokens > 0 {
 		cwReq.InferenceConfig = &types.InferenceConfig{
-			MaxTokens: anthropicReq.MaxTokens,
-		}
-		// 如果指定了温度参数，也设置它
-		if anthropicReq.Temperature != nil {
-			cwReq.InferenceConfig.Temperature = *anthropicReq.Temperature
+			MaxTokens:   anthropicReq.MaxTokens,
+			Temperature: anthropicReq.Temperature,
+			TopP:        anthropicReq.TopP,
 		}
 	}
 
@@ -632,6 +543,14 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	return cwReq, nil
 }
 
+// aliasToolUses 将历史工具调用的名称替换为上游别名（与工具定义保持一致）
+func aliasToolUses(toolUses []types.ToolUseEntry) []types.ToolUseEntry {
+	for i := range toolUses {
+		toolUses[i].Name = ToolAlias(toolUses[i].Name)
+	}
+	return toolUses
+}
+
 // extractToolUsesFromMessage 从助手消息内容中提取工具调用
 func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 	var toolUses []types.ToolUseEntry
@@ -1,6 +1,7 @@
 package converter
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strings"
 
@@ -10,11 +11,17 @@ import (
 
 // 消息内容处理器
 
-// processMessageContent 处理消息内容，提取文本和图片
-func processMessageContent(content any) (string, []types.CodeWhispererImage, error) {
-	var thinkingParts []string // thinking 内容（放在最前面）
-	var textParts []string
-	var images []types.CodeWhispererImage
+// ImageMarkerFormat 图片位置标记，参数为图片在上游消息 Images 数组中的下标
+const ImageMarkerFormat = "[Image #%d]"
+
+// ToolResultMarkerFormat 工具结果位置标记，参数为 tool_use_id，正文在 ToolResults 中
+const ToolResultMarkerFormat = "[Tool result: %s]"
+
+// processMessageContent 处理消息内容，按原始块顺序提取文本和图片
+// 图片在文本中的位置以 [Image #N] 标记，N 为该图片在 Images 数组中的下标；
+// imageOffset 为同一条上游消息中已收集的图片数（合并多条 user 消息时使用）
+func processMessageContent(content any, imageOffset int) (string, []types.CodeWhispererImage, error) {
+	var blocks []types.ContentBlock
 
 	switch v := content.(type) {
 	case string:
@@ -23,117 +30,93 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 
 	case []any:
 		// 内容块数组
+		blocks = make([]types.ContentBlock, 0, len(v))
 		for i, item := range v {
-			if block, ok := item.(map[string]any); ok {
-				contentBlock, err := parseContentBlock(block)
-				if err != nil {
-					utils.Log("解析内容块失败，跳过", utils.LogErr(err), utils.LogInt("index", i))
-					continue // 跳过无法解析的块
-				}
-
-				switch contentBlock.Type {
-				case "text":
-					if contentBlock.Text != nil {
-						textParts = append(textParts, *contentBlock.Text)
-					} else {
-						utils.Log("文本块的Text字段为nil")
-					}
-				case "image":
-					// ... 图片处理保持不变
-					if contentBlock.Source != nil {
-						// 验证图片内容
-						if err := utils.ValidateImageContent(contentBlock.Source); err != nil {
-							return "", nil, fmt.Errorf("图片验证失败: %v", err)
-						}
-
-						// 转换为 CodeWhisperer 格式
-						cwImage := utils.CreateCodeWhispererImage(contentBlock.Source)
-						if cwImage != nil {
-							images = append(images, *cwImage)
-						}
-					}
-				case "tool_result":
-					// 处理工具结果，支持复杂的内容结构
-					if contentBlock.Content != nil {
-						parsedContent := utils.ParseToolResultContent(contentBlock.Content)
-						// 如果内容为空，提供默认值
-						if parsedContent == "" {
-							parsedContent = "Tool executed successfully"
-						}
-						textParts = append(textParts, parsedContent)
-					}
-				case "thinking":
-					// thinking 块转换为 <thinking> 标签格式，加到正文前面
-					if contentBlock.Text != nil && *contentBlock.Text != "" {
-						thinkingParts = append(thinkingParts, "<thinking>\n"+*contentBlock.Text+"\n</thinking>")
-					}
-				}
-			} else {
+			block, ok := item.(map[string]any)
+			if !ok {
 				utils.Log("内容块不是map[string]any类型",
 					utils.LogInt("index", i),
 					utils.LogString("actual_type", fmt.Sprintf("%T", item)))
+				continue
+			}
+			contentBlock, err := parseContentBlock(block)
+			if err != nil {
+				utils.Log("解析内容块失败，跳过", utils.LogErr(err), utils.LogInt("index", i))
+				continue // 跳过无法解析的块
 			}
+			blocks = append(blocks, contentBlock)
 		}
 
 	case []types.ContentBlock:
 		// 结构化的内容块数组
-		for _, block := range v {
-			switch block.Type {
-			case "text":
-				if block.Text != nil {
-					textParts = append(textParts, *block.Text)
-				} else {
-					utils.Log("结构化文本块的Text字段为nil")
-				}
-			case "image":
-				if block.Source != nil {
-					// 验证图片内容
-					if err := utils.ValidateImageContent(block.Source); err != nil {
-						return "", nil, fmt.Errorf("图片验证失败: %v", err)
-					}
-
-					// 转换为 CodeWhisperer 格式
-					cwImage := utils.CreateCodeWhispererImage(block.Source)
-					if cwImage != nil {
-						images = append(images, *cwImage)
-					}
-				}
-			case "tool_result":
-				// 处理工具结果，支持复杂的内容结构
-				if block.Content != nil {
-					parsedContent := utils.ParseToolResultContent(block.Content)
-					// 如果内容为空，提供默认值
-					if parsedContent == "" {
-						parsedContent = "Tool executed successfully"
-					}
-					textParts = append(textParts, parsedContent)
-				}
-			case "thinking":
-				// thinking 块转换为 <thinking> 标签格式
-				if block.Text != nil && *block.Text != "" {
-					thinkingParts = append(thinkingParts, "<thinking>\n"+*block.Text+"\n</thinking>")
-				}
-			}
-		}
+		blocks = v
 
 	default:
 		// 不支持的内容类型，返回错误而非fallback
 		return "", nil, fmt.Errorf("不支持的内容类型: %T", content)
 	}
 
-	// 组合结果：thinking 内容在前，普通文本在后
-	var allParts []string
-	allParts = append(allParts, thinkingParts...)
-	allParts = append(allParts, textParts...)
-	result := strings.Join(allParts, "\n\n")
+	var parts []string
+	var images []types.CodeWhispererImage
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			if block.Text != nil {
+				parts = append(parts, *block.Text)
+			} else {
+				utils.Log("文本块的Text字段为nil")
+			}
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			source, err := resolveFileSource(block.Source)
+			if err != nil {
+				return "", nil, err
+			}
+			// 验证图片内容
+			if err := utils.ValidateImageContent(source); err != nil {
+				return "", nil, fmt.Errorf("图片验证失败: %v", err)
+			}
+
+			// 转换为 CodeWhisperer 格式，并在原位置插入标记
+			cwImage, err := utils.CreateCodeWhispererImage(source)
+			if err != nil {
+				return "", nil, fmt.Errorf("图片处理失败: %v", err)
+			}
+			parts = append(parts, fmt.Sprintf(ImageMarkerFormat, imageOffset+len(images)))
+			images = append(images, *cwImage)
+		case "document":
+			// 文档转为文本内联到原位置
+			text, err := renderDocument(block)
+			if err != nil {
+				return "", nil, fmt.Errorf("文档处理失败: %v", err)
+			}
+			parts = append(parts, text)
+		case "tool_result":
+			// 工具结果正文只通过 UserInputMessageContext.ToolResults 发送，
+			// 这里仅在原位置插入占位标记以保持与前后文本的顺序，避免正文重复计费
+			toolUseID := ""
+			if block.ToolUseId != nil {
+				toolUseID = *block.ToolUseId
+			}
+			parts = append(parts, fmt.Sprintf(ToolResultMarkerFormat, toolUseID))
+		case "thinking":
+			// thinking 块转换为 <thinking> 标签格式
+			if block.Text != nil && *block.Text != "" {
+				parts = append(parts, "<thinking>\n"+*block.Text+"\n</thinking>")
+			}
+		}
+	}
+
+	result := strings.Join(parts, "\n\n")
 
 	// 保留关键调试信息用于问题定位
 	if result == "" && len(images) == 0 {
 		utils.Log("消息内容处理结果为空",
 			utils.LogString("content_type", fmt.Sprintf("%T", content)),
-			utils.LogInt("thinking_parts_count", len(thinkingParts)),
-			utils.LogInt("text_parts_count", len(textParts)),
-			utils.LogInt("images_count", len(images)))
+			utils.LogInt("blocks_count", len(blocks)))
 	}
 
 	return result, images, nil
@@ -166,19 +149,22 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 
 	case "image":
 		if source, ok := block["source"].(map[string]any); ok {
-			imageSource := &types.ImageSource{}
-
-			if sourceType, ok := source["type"].(string); ok {
-				imageSource.Type = sourceType
-			}
-			if mediaType, ok := source["media_type"].(string); ok {
-				imageSource.MediaType = mediaType
-			}
-			if data, ok := source["data"].(string); ok {
-				imageSource.Data = data
-			}
+			contentBlock.Source = utils.ParseImageSource(source)
+		}
 
-			contentBlock.Source = imageSource
+	case "document":
+		if source, ok := block["source"].(map[string]any); ok {
+			contentBlock.Source = utils.ParseImageSource(source)
+		}
+		if title, ok := block["title"].(string); ok {
+			contentBlock.Title = &title
+		}
+		if context, ok := block["context"].(string); ok {
+			contentBlock.Context = &context
+		}
+		if citations, ok := block["citations"].(map[string]any); ok {
+			enabled, _ := citations["enabled"].(bool)
+			contentBlock.Citations = &types.Citations{Enabled: enabled}
 		}
 
 	case "image_url":
@@ -227,3 +213,20 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 
 	return contentBlock, nil
 }
+
+// resolveFileSource 将 Files API 文件来源读取为 base64 数据源，其他来源原样返回
+// 文件归属在请求校验前已检查，此处只按 file_id 读取
+func resolveFileSource(source *types.ImageSource) (*types.ImageSource, error) {
+	if source == nil || source.Type != "file" {
+		return source, nil
+	}
+	data, meta, err := utils.Files().ReadFile(source.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件 %s 失败: %v", source.FileID, err)
+	}
+	return &types.ImageSource{
+		Type:      "base64",
+		MediaType: meta.MimeType,
+		Data:      base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
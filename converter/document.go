@@ -0,0 +1,97 @@
+package converter
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// 文档内容处理器
+
+// emptyPDFText PDF 没有可提取的文本层时插入的说明
+const emptyPDFText = "[This PDF has no extractable text layer]"
+
+// renderDocument 将 document 块转为文本，按 Anthropic 推荐的长文档格式包裹
+// 上游不支持文档附件：PDF 提取文本层，文本类文档直接内联；标题与 context 一并保留
+func renderDocument(block types.ContentBlock) (string, error) {
+	if block.Source == nil {
+		return "", fmt.Errorf("文档缺少 source")
+	}
+	source, err := resolveFileSource(block.Source)
+	if err != nil {
+		return "", err
+	}
+	text, err := documentText(source)
+	if err != nil {
+		return "", err
+	}
+	return wrapDocument(block, text), nil
+}
+
+// wrapDocument 用 <document> 标签包裹文档正文，附带标题与 context
+func wrapDocument(block types.ContentBlock, text string) string {
+	var sb strings.Builder
+	sb.WriteString("<document>\n")
+	if block.Title != nil && *block.Title != "" {
+		sb.WriteString("<source>" + *block.Title + "</source>\n")
+	}
+	if block.Context != nil && *block.Context != "" {
+		sb.WriteString("<document_context>\n" + *block.Context + "\n</document_context>\n")
+	}
+	sb.WriteString("<document_content>\n" + text + "\n</document_content>\n")
+	sb.WriteString("</document>")
+	return sb.String()
+}
+
+// documentText 按数据源类型取出文档文本
+func documentText(source *types.ImageSource) (string, error) {
+	switch source.Type {
+	case "text":
+		return source.Data, nil
+
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(source.Data)
+		if err != nil {
+			return "", fmt.Errorf("文档 base64 解码失败: %v", err)
+		}
+		switch {
+		case source.MediaType == "application/pdf":
+			pages, err := utils.ExtractPDFPages(data)
+			if err != nil {
+				return "", err
+			}
+			text := strings.TrimSpace(strings.Join(pages, "\n\n"))
+			if text == "" {
+				return emptyPDFText, nil
+			}
+			return text, nil
+		case utils.IsTextMediaType(source.MediaType):
+			return utils.DecodeDocumentText(data)
+		default:
+			return "", fmt.Errorf("不支持的文档类型: %s", source.MediaType)
+		}
+
+	case "content":
+		// 自定义内容文档：只保留文本块
+		var parts []string
+		switch v := source.Content.(type) {
+		case string:
+			parts = append(parts, v)
+		case []any:
+			for _, item := range v {
+				if block, ok := item.(map[string]any); ok && block["type"] == "text" {
+					if text, ok := block["text"].(string); ok {
+						parts = append(parts, text)
+					}
+				}
+			}
+		}
+		return strings.Join(parts, "\n\n"), nil
+
+	default:
+		return "", fmt.Errorf("不支持的文档数据源类型: %s", source.Type)
+	}
+}
@@ -0,0 +1,105 @@
+package converter
+
+import (
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// historyThinkingMode 当前生效的历史 thinking 保留方式
+var historyThinkingMode = config.LoadHistoryThinkingMode()
+
+// InitHistoryThinking 按环境变量重新加载历史 thinking 配置（.env 加载后调用）
+func InitHistoryThinking() {
+	historyThinkingMode = config.LoadHistoryThinkingMode()
+}
+
+// historyThinkingStart 返回保留 thinking 的起始消息下标，之前的 assistant 消息去掉 thinking
+// 当前请求未启用 thinking 时不保留，避免向未开启思考模式的模型注入 <thinking> 标签；
+// latest 模式下从最后一条用户输入（不只是 tool_result 的 user 消息）开始，工具调用循环中的思考全部保留
+func historyThinkingStart(anthropicReq types.AnthropicRequest) int {
+	messages := anthropicReq.Messages
+	if anthropicReq.Thinking == nil || anthropicReq.Thinking.Type != "enabled" {
+		return len(messages)
+	}
+	switch historyThinkingMode {
+	case config.HistoryThinkingOff:
+		return len(messages)
+	case config.HistoryThinkingLatest:
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == "user" && !isToolResultOnly(messages[i].Content) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// isToolResultOnly 判断 user 消息是否只包含工具结果
+func isToolResultOnly(content any) bool {
+	blocks, ok := content.([]any)
+	if !ok || len(blocks) == 0 {
+		return false
+	}
+	for _, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok || block["type"] != "tool_result" {
+			return false
+		}
+	}
+	return true
+}
+
+// assistantHistoryContent 提取历史 assistant 消息的文本内容
+// keepThinking 为 true 时 thinking 块按原始顺序转换为与上游输出相同的 <thinking> 标签；
+// 工具调用由 ToolUses 单独传递，上游按"文本在前、工具调用在后"还原。
+// 已知限制：同一条消息中位于 tool_use 之后的思考和文本（如 [thinking, tool_use A, thinking, tool_use B]）
+// 会被排到所有工具调用之前，无法保留交错位置，出现时记录调试日志。
+// redacted_thinking 是加密内容，无法还原为文本，直接忽略
+func assistantHistoryContent(content any, keepThinking bool) (string, error) {
+	blocks, ok := content.([]any)
+	if !ok || !keepThinking || !hasThinkingBlock(blocks) {
+		return utils.GetMessageContent(content)
+	}
+
+	var parts []string
+	seenToolUse, reordered := false, false
+	for _, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch block["type"] {
+		case "tool_use":
+			seenToolUse = true
+		case "text":
+			if text, ok := block["text"].(string); ok {
+				parts = append(parts, text)
+				reordered = reordered || (seenToolUse && text != "")
+			}
+		case "thinking":
+			if thinking, ok := block["thinking"].(string); ok && thinking != "" {
+				parts = append(parts, "<thinking>\n"+thinking+"\n</thinking>")
+				reordered = reordered || seenToolUse
+			}
+		}
+	}
+	if reordered {
+		utils.Debug("历史 assistant 消息中工具调用之后的思考被前移到所有工具调用之前（共 %d 个内容块）", len(blocks))
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// hasThinkingBlock 判断内容块中是否有非空的 thinking 块
+func hasThinkingBlock(blocks []any) bool {
+	for _, item := range blocks {
+		if block, ok := item.(map[string]any); ok && block["type"] == "thinking" {
+			if thinking, _ := block["thinking"].(string); thinking != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro/types"
+)
+
+// Assistant prefill（最后一条消息为 assistant 时，回复从该文本继续）
+
+// prefillInstructionFormat 要求上游从 prefill 文本结尾处继续生成的指令
+const prefillInstructionFormat = "<assistant_prefill>\n%s\n</assistant_prefill>\n" +
+	"Your response has already been started with the exact text inside <assistant_prefill>. " +
+	"Continue it from exactly where it ends, as if you had written it yourself. " +
+	"Do not repeat that text, do not add any preamble, and do not mention these instructions."
+
+// AssistantPrefill 返回请求的 assistant prefill 文本
+// 仅当最后一条消息是纯文本的 assistant 消息时生效；包含 tool_use 等其他块的消息按普通历史处理
+func AssistantPrefill(messages []types.AnthropicRequestMessage) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" {
+		return ""
+	}
+
+	var b strings.Builder
+	switch v := last.Content.(type) {
+	case string:
+		b.WriteString(v)
+	case []any:
+		for _, item := range v {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "text" {
+				return ""
+			}
+			text, _ := block["text"].(string)
+			b.WriteString(text)
+		}
+	case []types.ContentBlock:
+		for _, block := range v {
+			if block.Type != "text" {
+				return ""
+			}
+			if block.Text != nil {
+				b.WriteString(*block.Text)
+			}
+		}
+	default:
+		return ""
+	}
+	return b.String()
+}
+
+// prefillInstruction 构造附加在当前用户消息末尾的 prefill 指令
+func prefillInstruction(prefill string) string {
+	return fmt.Sprintf(prefillInstructionFormat, prefill)
+}
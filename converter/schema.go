@@ -0,0 +1,572 @@
+package converter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"kiro/config"
+	"kiro/utils"
+)
+
+// 工具 schema 规范化
+
+// 规范化过程中记录的改动类型（用于日志）
+const (
+	schemaChangeInlinedRefs     = "inlined_refs"
+	schemaChangeRecursiveRef    = "recursive_ref"
+	schemaChangeSimplifiedUnion = "simplified_union"
+	schemaChangeStrippedKeyword = "stripped_keywords"
+	schemaChangeDepthLimited    = "depth_limited"
+	schemaChangeSizeLimited     = "size_limited"
+	schemaChangeFixedRoot       = "fixed_root"
+)
+
+// schemaAllowedKeywords 上游可以正确处理的 JSON Schema 关键字，其余关键字会被移除
+var schemaAllowedKeywords = map[string]bool{
+	"type":        true,
+	"description": true,
+	"properties":  true,
+	"required":    true,
+	"items":       true,
+	"enum":        true,
+	"format":      true,
+	"default":     true,
+	"minimum":     true,
+	"maximum":     true,
+	"minLength":   true,
+	"maxLength":   true,
+	"pattern":     true,
+	"minItems":    true,
+	"maxItems":    true,
+}
+
+// schemaNormalizer 单个工具 schema 的规范化器
+// 设计原则：
+// - 只读原始 schema，输出全新的结构，不修改调用方数据
+// - $ref 展开时记录展开路径，遇到循环引用替换为占位对象
+// - 上游不支持的联合类型尽量合并，无法合并时取第一个分支并在描述中注明其他可选类型
+// - 展开节点数有上限：共享 $ref 构成的 DAG 在大小检查之前就可能指数级膨胀
+type schemaNormalizer struct {
+	root     map[string]any
+	maxDepth int
+	nodes    int // 本轮已展开的节点数，超过 ToolSchemaMaxNodes 后不再向下展开
+	changes  map[string]bool
+}
+
+// NormalizeToolSchema 规范化工具的 input_schema，返回新的 schema 与改动列表（无改动时为空）
+func NormalizeToolSchema(schema map[string]any) (map[string]any, []string) {
+	n := &schemaNormalizer{
+		root:     schema,
+		maxDepth: config.ToolSchemaMaxDepth,
+		changes:  make(map[string]bool),
+	}
+
+	normalized := n.normalizeRoot()
+
+	// 超出大小限制：先去掉嵌套描述，再逐步降低深度
+	if !n.fitsSizeLimit(normalized) {
+		n.changes[schemaChangeSizeLimited] = true
+		stripNestedDescriptions(normalized, 0)
+		for n.maxDepth > 1 && !n.fitsSizeLimit(normalized) {
+			n.maxDepth--
+			normalized = n.normalizeRoot()
+			stripNestedDescriptions(normalized, 0)
+		}
+	}
+
+	changes := make([]string, 0, len(n.changes))
+	for change := range n.changes {
+		changes = append(changes, change)
+	}
+	sort.Strings(changes)
+	return normalized, changes
+}
+
+// normalizeRoot 规范化根节点，并保证根节点是带 properties 的 object
+func (n *schemaNormalizer) normalizeRoot() map[string]any {
+	if n.root == nil {
+		n.changes[schemaChangeFixedRoot] = true
+		return map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+
+	n.nodes = 0
+	normalized := n.normalize(n.root, 0, nil)
+	if t, _ := normalized["type"].(string); t != "object" {
+		if _, exists := normalized["type"]; exists {
+			// 非对象根节点：包装为单参数对象
+			n.changes[schemaChangeFixedRoot] = true
+			normalized = map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"value": normalized},
+				"required":   []string{"value"},
+			}
+		} else {
+			normalized["type"] = "object"
+		}
+	}
+	if _, ok := normalized["properties"].(map[string]any); !ok {
+		normalized["properties"] = map[string]any{}
+	}
+	return normalized
+}
+
+// fitsSizeLimit 检查序列化后的大小是否在限制内
+func (n *schemaNormalizer) fitsSizeLimit(schema map[string]any) bool {
+	if config.MaxToolSchemaBytes <= 0 {
+		return true
+	}
+	data, err := utils.SafeMarshal(schema)
+	return err == nil && len(data) <= config.MaxToolSchemaBytes
+}
+
+// normalize 递归规范化一个 schema 节点；refStack 为当前展开路径上的 $ref
+func (n *schemaNormalizer) normalize(node map[string]any, depth int, refStack []string) map[string]any {
+	// 展开 $ref（兄弟字段覆盖被引用的定义）
+	if ref, ok := node["$ref"].(string); ok {
+		for _, seen := range refStack {
+			if seen == ref {
+				n.changes[schemaChangeRecursiveRef] = true
+				return recursiveRefPlaceholder(node, ref)
+			}
+		}
+		target, ok := n.resolveRef(ref)
+		if !ok {
+			n.changes[schemaChangeStrippedKeyword] = true
+			return n.normalize(withoutKey(node, "$ref"), depth, refStack)
+		}
+		n.changes[schemaChangeInlinedRefs] = true
+		merged := make(map[string]any, len(target)+len(node))
+		for k, v := range target {
+			merged[k] = v
+		}
+		for k, v := range node {
+			if k != "$ref" {
+				merged[k] = v
+			}
+		}
+		return n.normalize(merged, depth, append(refStack, ref))
+	}
+
+	// 深度限制：只保留类型与描述
+	if depth >= n.maxDepth {
+		n.changes[schemaChangeDepthLimited] = true
+		return shallowSchema(node)
+	}
+
+	// 展开节点数限制：同样只保留类型与描述
+	n.nodes++
+	if n.nodes > config.ToolSchemaMaxNodes {
+		n.changes[schemaChangeSizeLimited] = true
+		return shallowSchema(node)
+	}
+
+	// 联合类型
+	node = n.simplifyUnions(node, depth, refStack)
+
+	out := make(map[string]any, len(node))
+	for key, value := range node {
+		switch key {
+		case "type":
+			out["type"] = n.normalizeType(value, out)
+		case "properties":
+			props, ok := value.(map[string]any)
+			if !ok {
+				n.changes[schemaChangeStrippedKeyword] = true
+				continue
+			}
+			normalizedProps := make(map[string]any, len(props))
+			for name, prop := range props {
+				if propSchema, ok := prop.(map[string]any); ok {
+					normalizedProps[name] = n.normalize(propSchema, depth+1, refStack)
+				} else {
+					normalizedProps[name] = map[string]any{}
+				}
+			}
+			out["properties"] = normalizedProps
+		case "items":
+			switch items := value.(type) {
+			case map[string]any:
+				out["items"] = n.normalize(items, depth+1, refStack)
+			case []any:
+				// 元组形式：上游不支持，取第一个元素的 schema
+				n.changes[schemaChangeSimplifiedUnion] = true
+				if len(items) > 0 {
+					if first, ok := items[0].(map[string]any); ok {
+						out["items"] = n.normalize(first, depth+1, refStack)
+					}
+				}
+			}
+		case "required":
+			if required := stringSlice(value); len(required) > 0 {
+				out["required"] = required
+			}
+		case "const":
+			// const 转为单值 enum
+			out["enum"] = []any{value}
+		case "description":
+			if s, ok := value.(string); ok {
+				if existing, ok := out["description"].(string); ok && existing != "" {
+					out["description"] = s + " " + existing
+				} else {
+					out["description"] = s
+				}
+			}
+		default:
+			if schemaAllowedKeywords[key] {
+				out[key] = value
+			} else {
+				n.changes[schemaChangeStrippedKeyword] = true
+			}
+		}
+	}
+
+	// required 只保留实际存在的属性
+	if required, ok := out["required"].([]string); ok {
+		props, _ := out["properties"].(map[string]any)
+		filtered := make([]string, 0, len(required))
+		for _, name := range required {
+			if _, exists := props[name]; exists {
+				filtered = append(filtered, name)
+			}
+		}
+		if len(filtered) == 0 {
+			delete(out, "required")
+		} else {
+			out["required"] = filtered
+		}
+	}
+
+	return out
+}
+
+// normalizeType 处理 type 数组（如 ["string", "null"]），上游只接受单一类型
+func (n *schemaNormalizer) normalizeType(value any, out map[string]any) any {
+	typeList, ok := value.([]any)
+	if !ok {
+		return value
+	}
+	n.changes[schemaChangeSimplifiedUnion] = true
+
+	var nonNull []string
+	for _, t := range typeList {
+		if s, ok := t.(string); ok && s != "null" {
+			nonNull = append(nonNull, s)
+		}
+	}
+	if len(nonNull) == 0 {
+		return "string"
+	}
+	if len(nonNull) > 1 {
+		appendDescription(out, fmt.Sprintf("(accepts: %s)", strings.Join(nonNull, ", ")))
+	}
+	return nonNull[0]
+}
+
+// simplifyUnions 合并 allOf，并将 anyOf/oneOf 化简为单一 schema
+func (n *schemaNormalizer) simplifyUnions(node map[string]any, depth int, refStack []string) map[string]any {
+	_, hasAll := node["allOf"]
+	_, hasAny := node["anyOf"]
+	_, hasOne := node["oneOf"]
+	if !hasAll && !hasAny && !hasOne {
+		return node
+	}
+	n.changes[schemaChangeSimplifiedUnion] = true
+
+	base := withoutKey(withoutKey(withoutKey(node, "allOf"), "anyOf"), "oneOf")
+
+	// allOf：所有分支合并进当前节点
+	if variants := n.normalizeVariants(node["allOf"], depth, refStack); len(variants) > 0 {
+		merged := map[string]any{}
+		for _, v := range variants {
+			mergeObjectSchemas(merged, v, true)
+		}
+		mergeObjectSchemas(base, merged, true)
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		variants := n.normalizeVariants(node[key], depth, refStack)
+		if len(variants) == 0 {
+			continue
+		}
+		mergeObjectSchemas(base, simplifyAlternatives(variants), false)
+	}
+	return base
+}
+
+// normalizeVariants 规范化联合类型的各个分支，并去掉 {"type": "null"} 分支
+func (n *schemaNormalizer) normalizeVariants(value any, depth int, refStack []string) []map[string]any {
+	list, ok := value.([]any)
+	if !ok {
+		return nil
+	}
+	variants := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		variant, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		normalized := n.normalize(variant, depth, refStack)
+		if t, _ := normalized["type"].(string); t == "null" {
+			continue
+		}
+		variants = append(variants, normalized)
+	}
+	return variants
+}
+
+// simplifyAlternatives 将 anyOf/oneOf 的多个分支化简为一个 schema
+// - 全部为对象：合并属性，required 取交集
+// - 同一基础类型：合并 enum
+// - 其他情况：取第一个分支，并在描述中列出可选类型
+func simplifyAlternatives(variants []map[string]any) map[string]any {
+	if len(variants) == 1 {
+		return variants[0]
+	}
+
+	firstType, _ := variants[0]["type"].(string)
+	sameType := firstType != ""
+	for _, v := range variants[1:] {
+		if t, _ := v["type"].(string); t != firstType {
+			sameType = false
+			break
+		}
+	}
+
+	if sameType && firstType == "object" {
+		merged := map[string]any{"type": "object"}
+		var required []string
+		for i, v := range variants {
+			mergeObjectSchemas(merged, withoutKey(v, "required"), false)
+			names := stringSlice(v["required"])
+			if i == 0 {
+				required = names
+			} else {
+				required = intersectStrings(required, names)
+			}
+		}
+		if len(required) > 0 {
+			merged["required"] = required
+		}
+		return merged
+	}
+
+	if sameType {
+		merged := map[string]any{}
+		for k, v := range variants[0] {
+			merged[k] = v
+		}
+		var enums []any
+		allEnums := true
+		for _, v := range variants {
+			values, ok := v["enum"].([]any)
+			if !ok {
+				allEnums = false
+				break
+			}
+			enums = append(enums, values...)
+		}
+		if allEnums {
+			merged["enum"] = enums
+		} else {
+			delete(merged, "enum")
+		}
+		return merged
+	}
+
+	chosen := map[string]any{}
+	for k, v := range variants[0] {
+		chosen[k] = v
+	}
+	var alternatives []string
+	for _, v := range variants {
+		if t, _ := v["type"].(string); t != "" {
+			alternatives = append(alternatives, t)
+		}
+	}
+	if len(alternatives) > 1 {
+		appendDescription(chosen, fmt.Sprintf("(accepts one of: %s)", strings.Join(alternatives, ", ")))
+	}
+	return chosen
+}
+
+// resolveRef 解析本地 JSON Pointer 引用（#/definitions/X、#/$defs/X、#/components/schemas/X 等）
+func (n *schemaNormalizer) resolveRef(ref string) (map[string]any, bool) {
+	if ref == "#" {
+		return n.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+
+	var current any = n.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	target, ok := current.(map[string]any)
+	return target, ok
+}
+
+// recursiveRefPlaceholder 循环引用的占位 schema
+func recursiveRefPlaceholder(node map[string]any, ref string) map[string]any {
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	placeholder := map[string]any{
+		"type":        "object",
+		"description": fmt.Sprintf("Recursive reference to %s (same structure as its definition).", name),
+	}
+	if desc, ok := node["description"].(string); ok && desc != "" {
+		placeholder["description"] = desc + " " + placeholder["description"].(string)
+	}
+	return placeholder
+}
+
+// shallowSchema 深度超限时的精简 schema：只保留类型与描述
+func shallowSchema(node map[string]any) map[string]any {
+	out := map[string]any{}
+	switch t := node["type"].(type) {
+	case string:
+		out["type"] = t
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok && s != "null" {
+				out["type"] = s
+				break
+			}
+		}
+	}
+	if desc, ok := node["description"].(string); ok {
+		out["description"] = desc
+	}
+	return out
+}
+
+// stripNestedDescriptions 移除根节点以外的描述（用于压缩过大的 schema）
+func stripNestedDescriptions(node map[string]any, depth int) {
+	if depth > 1 {
+		delete(node, "description")
+	}
+	if props, ok := node["properties"].(map[string]any); ok {
+		for _, prop := range props {
+			if child, ok := prop.(map[string]any); ok {
+				stripNestedDescriptions(child, depth+1)
+			}
+		}
+	}
+	if items, ok := node["items"].(map[string]any); ok {
+		stripNestedDescriptions(items, depth+1)
+	}
+}
+
+// mergeObjectSchemas 将 src 合并进 dst：属性合并，required 按 unionRequired 决定是否并入
+func mergeObjectSchemas(dst, src map[string]any, unionRequired bool) {
+	for key, value := range src {
+		switch key {
+		case "properties":
+			srcProps, _ := value.(map[string]any)
+			existing, _ := dst["properties"].(map[string]any)
+			// 复制后再合并，dst 的 properties 可能引用原始 schema
+			dstProps := make(map[string]any, len(existing)+len(srcProps))
+			for name, prop := range existing {
+				dstProps[name] = prop
+			}
+			dst["properties"] = dstProps
+			for name, prop := range srcProps {
+				if _, exists := dstProps[name]; !exists {
+					dstProps[name] = prop
+				}
+			}
+		case "required":
+			if unionRequired {
+				dst["required"] = unionStrings(stringSlice(dst["required"]), stringSlice(value))
+			} else if _, exists := dst["required"]; !exists {
+				dst["required"] = value
+			}
+		case "description":
+			if _, exists := dst["description"]; !exists {
+				dst["description"] = value
+			} else if s, ok := value.(string); ok && s != "" {
+				appendDescription(dst, s)
+			}
+		default:
+			if _, exists := dst[key]; !exists {
+				dst[key] = value
+			}
+		}
+	}
+}
+
+// appendDescription 在 schema 描述末尾追加说明
+func appendDescription(schema map[string]any, note string) {
+	if desc, ok := schema["description"].(string); ok && desc != "" {
+		if strings.Contains(desc, note) {
+			return
+		}
+		schema["description"] = desc + " " + note
+		return
+	}
+	schema["description"] = note
+}
+
+// withoutKey 返回去掉指定键的浅拷贝
+func withoutKey(m map[string]any, key string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		if k != key {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// stringSlice 将 required 之类的字段转换为字符串数组，忽略非字符串元素
+func stringSlice(value any) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// unionStrings 合并两个字符串数组并去重（保持顺序）
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	out := make([]string, 0, len(a)+len(b))
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// intersectStrings 两个字符串数组的交集（保持 a 的顺序）
+func intersectStrings(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+	}
+	out := make([]string, 0, len(a))
+	for _, s := range a {
+		if inB[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
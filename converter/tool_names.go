@@ -0,0 +1,112 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"kiro/types"
+)
+
+// 工具名称别名
+
+// maxToolNameLength 上游允许的工具名称最大长度
+const maxToolNameLength = 64
+
+// ToolAlias 返回工具名称在上游使用的别名
+// 合法名称（字母开头，仅含字母、数字、下划线、短横线，不超过 64 字符）原样返回；
+// 其他名称替换非法字符并附加原名哈希，保证不同原名不会映射到同一别名。
+// 别名只由原名决定，同一工具在不同请求（包括续写请求）中的别名一致
+func ToolAlias(name string) string {
+	if isValidToolName(name) {
+		return name
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	sanitized := b.String()
+	if sanitized == "" || !isASCIILetter(sanitized[0]) {
+		sanitized = "t_" + sanitized
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	if len(sanitized) > maxToolNameLength-len(suffix) {
+		sanitized = sanitized[:maxToolNameLength-len(suffix)]
+	}
+	return sanitized + suffix
+}
+
+// isValidToolName 检查名称是否可直接发送给上游
+func isValidToolName(name string) bool {
+	if name == "" || len(name) > maxToolNameLength || !isASCIILetter(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !isASCIILetter(c) && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ToolNameMapper 单个请求的工具名称映射（别名 -> 原名）
+// 用于将上游返回的 tool_use 名称还原为客户端定义的原始名称
+type ToolNameMapper struct {
+	originals map[string]string
+}
+
+// NewToolNameMapper 根据请求中的工具定义和历史 tool_use 建立映射
+func NewToolNameMapper(tools []types.AnthropicTool, messages []types.AnthropicRequestMessage) *ToolNameMapper {
+	m := &ToolNameMapper{originals: make(map[string]string)}
+	for _, tool := range tools {
+		m.add(tool.Name)
+	}
+	for _, msg := range messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		for _, toolUse := range extractToolUsesFromMessage(msg.Content) {
+			m.add(toolUse.Name)
+		}
+	}
+	return m
+}
+
+// add 记录一个原始名称
+func (m *ToolNameMapper) add(name string) {
+	if name == "" {
+		return
+	}
+	if alias := ToolAlias(name); alias != name {
+		m.originals[alias] = name
+	}
+}
+
+// Original 将上游返回的名称还原为原始名称，未知名称原样返回
+func (m *ToolNameMapper) Original(alias string) string {
+	if m == nil {
+		return alias
+	}
+	if original, ok := m.originals[alias]; ok {
+		return original
+	}
+	return alias
+}
+
+// Aliased 本次请求中是否有被改写的工具名称
+func (m *ToolNameMapper) Aliased() bool {
+	return m != nil && len(m.originals) > 0
+}
@@ -2,115 +2,118 @@ package converter
 
 import (
 	"fmt"
+	"strings"
+	"unicode/utf8"
 
+	"kiro/config"
 	"kiro/types"
 	"kiro/utils"
 )
 
 // 工具处理器
 
-// cleanAndValidateToolParameters 清理和验证工具参数
-func cleanAndValidateToolParameters(params map[string]any) (map[string]any, error) {
-	if params == nil {
-		return nil, fmt.Errorf("参数不能为nil")
-	}
+// toolDescriptionContinuedNote 描述被拆分时附加在上游描述末尾的说明
+const toolDescriptionContinuedNote = "(Full usage notes for this tool continue in the tool reference section of the system instructions.)"
 
-	// 深拷贝避免修改原始数据
-	cleanedParams, _ := utils.SafeMarshal(params)
-	var tempParams map[string]any
-	if err := utils.SafeUnmarshal(cleanedParams, &tempParams); err != nil {
-		return nil, fmt.Errorf("参数序列化失败: %v", err)
-	}
+// convertTools 将 Anthropic 工具定义转换为 CodeWhisperer 格式
+// 超过 MaxToolDescriptionLength 的描述不再截断：上游描述在句子边界处结束并注明出处，
+// 溢出部分按工具名收集到返回的工具参考章节中，由调用方放入 <system_mode>
+func convertTools(anthropicTools []types.AnthropicTool) ([]types.CodeWhispererTool, string) {
+	var tools []types.CodeWhispererTool
+	var reference strings.Builder
 
-	// 移除不支持的顶级字段
-	delete(tempParams, "additionalProperties")
-	delete(tempParams, "strict")
-	delete(tempParams, "$schema")
-	delete(tempParams, "$id")
-	delete(tempParams, "$ref")
-	delete(tempParams, "definitions")
-	delete(tempParams, "$defs")
-
-	// 处理超长参数名 - CodeWhisperer限制参数名长度；保留原名映射
-	if properties, ok := tempParams["properties"].(map[string]any); ok {
-		cleanedProperties := make(map[string]any)
-		for paramName, paramDef := range properties {
-			cleanedName := paramName
-			// 如果参数名超过64字符，进行简化
-			if len(paramName) > 64 {
-				// 保留前缀和后缀，中间用下划线连接
-				if len(paramName) > 80 {
-					cleanedName = paramName[:20] + "_" + paramName[len(paramName)-20:]
-				} else {
-					cleanedName = paramName[:30] + "_param"
-				}
-			}
-			cleanedProperties[cleanedName] = paramDef
+	for _, tool := range anthropicTools {
+		// 验证工具定义的完整性 (SOLID-SRP: 单一责任验证)
+		if tool.Name == "" {
+			continue
 		}
-		tempParams["properties"] = cleanedProperties
-
-		// 同时更新required字段中的参数名
-		if required, ok := tempParams["required"].([]any); ok {
-			var cleanedRequired []any
-			for _, req := range required {
-				if reqStr, ok := req.(string); ok {
-					if len(reqStr) > 64 {
-						if len(reqStr) > 80 {
-							cleanedRequired = append(cleanedRequired, reqStr[:20]+"_"+reqStr[len(reqStr)-20:])
-						} else {
-							cleanedRequired = append(cleanedRequired, reqStr[:30]+"_param")
-						}
-					} else {
-						cleanedRequired = append(cleanedRequired, reqStr)
-					}
-				}
-			}
-			tempParams["required"] = cleanedRequired
+
+		// 过滤不支持的工具：web_search (静默过滤，不发送到上游)
+		if tool.Name == "web_search" || tool.Name == "websearch" {
+			continue
+		}
+
+		cwTool := types.CodeWhispererTool{}
+		cwTool.ToolSpecification.Name = ToolAlias(tool.Name)
+		if cwTool.ToolSpecification.Name != tool.Name {
+			utils.Log("工具名称使用别名",
+				utils.LogString("tool_name", tool.Name),
+				utils.LogString("alias", cwTool.ToolSpecification.Name))
+		}
+
+		// 超长描述拆分为上游描述 + 工具参考
+		description, overflow := splitToolDescription(tool.Description, config.MaxToolDescriptionLength)
+		cwTool.ToolSpecification.Description = description
+		if overflow != "" {
+			utils.Log("工具描述超长，溢出部分移入工具参考",
+				utils.LogString("tool_name", tool.Name),
+				utils.LogInt("description_length", len(tool.Description)),
+				utils.LogInt("overflow_length", len(overflow)))
+			fmt.Fprintf(&reference, "\n\n## %s\n%s", cwTool.ToolSpecification.Name, overflow)
 		}
+
+		// 规范化 InputSchema：展开 $ref、化简联合类型、移除上游不支持的关键字并限制大小
+		schema, changes := NormalizeToolSchema(tool.InputSchema)
+		if len(changes) > 0 {
+			utils.Log("工具 schema 已规范化",
+				utils.LogString("tool_name", tool.Name),
+				utils.LogString("changes", strings.Join(changes, ",")))
+		}
+		cwTool.ToolSpecification.InputSchema = types.InputSchema{
+			Json: schema,
+		}
+		tools = append(tools, cwTool)
 	}
 
-	// 确保 schema 明确声明顶级 type=object，符合 CodeWhisperer 工具schema约定
-	if _, exists := tempParams["type"]; !exists {
-		tempParams["type"] = "object"
+	if reference.Len() == 0 {
+		return tools, ""
 	}
+	return tools, "<tool_reference>\nThe sections below continue the descriptions of the tools with the same names. " +
+		"Treat each section as part of that tool's description." + reference.String() + "\n</tool_reference>"
+}
 
-	// 验证必需的字段
-	if schemaType, exists := tempParams["type"]; exists {
-		if typeStr, ok := schemaType.(string); ok && typeStr == "object" {
-			// 对象类型应该有properties字段
-			if _, hasProps := tempParams["properties"]; !hasProps {
-				return nil, fmt.Errorf("对象类型缺少properties字段")
-			}
-		}
+// splitToolDescription 将超长描述拆分为不超过 limit 字节的上游描述与溢出部分
+// 拆分点依次尝试段落、句子、空白边界，保证上游描述以完整的句子结束
+func splitToolDescription(description string, limit int) (string, string) {
+	if limit <= 0 || len(description) <= limit {
+		return description, ""
 	}
 
-	// CodeWhisperer 对 schema 的兼容性处理：
-	// - 仅允许标准 JSON Schema 字段：type, properties, required, description
-	// - 去除潜在不兼容的字段（上面已经逐步移除）
-	// - 保证 required 是字符串数组，properties 为对象
-	if req, ok := tempParams["required"]; ok && req != nil {
-		if arr, ok := req.([]any); ok {
-			cleaned := make([]string, 0, len(arr))
-			for _, v := range arr {
-				if s, ok := v.(string); ok && s != "" {
-					cleaned = append(cleaned, s)
-				}
+	budget := limit - len(toolDescriptionContinuedNote) - 1
+	if budget <= 0 {
+		return description[:limit], ""
+	}
+
+	cut := -1
+	head := description[:budget]
+	// 段落边界（至少保留一半预算，避免上游描述过短）
+	if i := strings.LastIndex(head, "\n\n"); i >= budget/2 {
+		cut = i
+	}
+	// 句子边界
+	if cut < 0 {
+		for _, sep := range []string{". ", ".\n", "。", "! ", "? "} {
+			if i := strings.LastIndex(head, sep); i >= budget/2 && i+len(sep) > cut {
+				cut = i + len(sep)
 			}
-			tempParams["required"] = cleaned
-		} else {
-			delete(tempParams, "required")
 		}
 	}
-	if props, ok := tempParams["properties"]; ok {
-		if _, ok := props.(map[string]any); !ok {
-			delete(tempParams, "properties")
-			tempParams["properties"] = map[string]any{}
+	// 空白边界
+	if cut < 0 {
+		if i := strings.LastIndexAny(head, " \n\t"); i > 0 {
+			cut = i
 		}
-	} else {
-		tempParams["properties"] = map[string]any{}
+	}
+	if cut < 0 {
+		cut = budget
+	}
+	// 不在 UTF-8 多字节字符中间拆分
+	for cut > 0 && !utf8.RuneStart(description[cut]) {
+		cut--
 	}
 
-	return tempParams, nil
+	return strings.TrimSpace(description[:cut]) + " " + toolDescriptionContinuedNote,
+		strings.TrimSpace(description[cut:])
 }
 
 // convertAnthropicToolChoiceToAnthropic 处理 Anthropic 格式的 tool_choice
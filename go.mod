@@ -1,10 +1,12 @@
 module kiro
 
-go 1.24.0
+go 1.24.1
 
 require (
 	github.com/gin-gonic/gin v1.11.0
+	github.com/ledongthuc/pdf v0.0.0-20260907135840-6c8c28e0e8a0
 	github.com/sugarme/tokenizer v0.3.0
+	golang.org/x/image v0.25.0
 	golang.org/x/sync v0.17.0
 )
 
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"kiro/types"
 	"kiro/utils"
 )
 
@@ -218,6 +219,24 @@ func (pr *ParseResult) GetCompletionText() string {
 	return text
 }
 
+// GetUpstreamMetadata 汇总响应中的引用、链接与后续提示，没有时返回 nil
+func (pr *ParseResult) GetUpstreamMetadata() *types.UpstreamMetadata {
+	var merged *types.UpstreamMetadata
+	for _, event := range pr.Events {
+		if event.Event != "upstream_metadata" {
+			continue
+		}
+		data, _ := event.Data.(map[string]any)
+		if metadata, ok := data["metadata"].(*types.UpstreamMetadata); ok {
+			if merged == nil {
+				merged = &types.UpstreamMetadata{}
+			}
+			merged.Merge(metadata)
+		}
+	}
+	return merged
+}
+
 // GetToolCalls 获取所有工具调用
 func (pr *ParseResult) GetToolCalls() []*ToolExecution {
 	var tools []*ToolExecution
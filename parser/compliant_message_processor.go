@@ -79,6 +79,18 @@ func (cmp *CompliantMessageProcessor) registerEventHandlers() {
 	// 标准事件处理器 - 将assistantResponseEvent作为标准事件
 	cmp.eventHandlers[EventTypes.ASSISTANT_RESPONSE_EVENT] = &StandardAssistantResponseEventHandler{cmp}
 
+	// 引用、链接与后续提示：只输出 upstream_metadata 事件
+	metadataHandler := &UpstreamMetadataEventHandler{}
+	cmp.eventHandlers[EventTypes.CODE_REFERENCE_EVENT] = metadataHandler
+	cmp.eventHandlers[EventTypes.SUPPLEMENTARY_WEB_LINKS_EVENT] = metadataHandler
+	cmp.eventHandlers[EventTypes.FOLLOWUP_PROMPT_EVENT] = metadataHandler
+
+	// 生成结束标记：只输出 upstream_completion 事件，供续写判断响应是否正常结束
+	completionHandler := &CompletionMarkerEventHandler{}
+	cmp.eventHandlers[EventTypes.METERING_EVENT] = completionHandler
+	cmp.eventHandlers[EventTypes.CONTEXT_USAGE_EVENT] = completionHandler
+	cmp.eventHandlers[EventTypes.MESSAGE_METADATA_EVENT] = completionHandler
+
 	// 旧格式兼容处理器（合并到统一的eventHandlers中）
 	cmp.eventHandlers[EventTypes.TOOL_USE_EVENT] = &LegacyToolUseEventHandler{
 		toolManager: cmp.toolManager,
@@ -100,6 +100,16 @@ var EventTypes = struct {
 	// 兼容旧格式
 	ASSISTANT_RESPONSE_EVENT string
 	TOOL_USE_EVENT           string
+
+	// 引用、链接与后续提示
+	CODE_REFERENCE_EVENT          string
+	SUPPLEMENTARY_WEB_LINKS_EVENT string
+	FOLLOWUP_PROMPT_EVENT         string
+
+	// 生成结束后上游发送的计量与元数据事件（表示响应正常结束）
+	METERING_EVENT         string
+	CONTEXT_USAGE_EVENT    string
+	MESSAGE_METADATA_EVENT string
 }{
 	COMPLETION:       "completion",
 	COMPLETION_CHUNK: "completion_chunk",
@@ -115,6 +125,14 @@ var EventTypes = struct {
 
 	ASSISTANT_RESPONSE_EVENT: "assistantResponseEvent",
 	TOOL_USE_EVENT:           "toolUseEvent",
+
+	CODE_REFERENCE_EVENT:          "codeReferenceEvent",
+	SUPPLEMENTARY_WEB_LINKS_EVENT: "supplementaryWebLinksEvent",
+	FOLLOWUP_PROMPT_EVENT:         "followupPromptEvent",
+
+	METERING_EVENT:         "meteringEvent",
+	CONTEXT_USAGE_EVENT:    "contextUsageEvent",
+	MESSAGE_METADATA_EVENT: "messageMetadataEvent",
 }
 
 // ToolExecution 工具执行状态
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"kiro/types"
 	"kiro/utils"
 	"strings"
 )
@@ -309,14 +310,20 @@ func (h *StandardAssistantResponseEventHandler) Handle(message *EventStreamMessa
 
 	// 作为标准事件，优先尝试解析完整格式
 	if fullEvent, err := parseFullAssistantResponseEvent(message.Payload); err == nil {
+		var events []SSEEvent
 		// 对于流式响应，放宽验证要求
 		if isStreamingResponse(fullEvent) {
 			// utils.Log("检测到流式格式assistantResponseEvent，使用宽松验证")
-			return h.handleStreamingEvent(fullEvent)
+			events, err = h.handleStreamingEvent(fullEvent)
+		} else {
+			// utils.Log("检测到完整格式assistantResponseEvent，使用标准处理器")
+			events, err = h.handleFullAssistantEvent(fullEvent)
 		}
-
-		// utils.Log("检测到完整格式assistantResponseEvent，使用标准处理器")
-		return h.handleFullAssistantEvent(fullEvent)
+		// 事件中附带的引用、链接与后续提示随文本一并输出
+		if metadata := types.NewUpstreamMetadata(&fullEvent.AssistantResponseEvent); metadata != nil {
+			events = append(events, newUpstreamMetadataEvent(metadata))
+		}
+		return events, err
 	}
 
 	// 如果完整格式解析失败，回退到legacy格式处理
@@ -624,3 +631,57 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 	// 非stop事件的流式片段处理完成，返回空事件
 	return []SSEEvent{}, nil
 }
+
+// UpstreamMetadataEventHandler 处理 codeReferenceEvent、supplementaryWebLinksEvent 与 followupPromptEvent
+// 这些事件不含文本，只转换为 upstream_metadata 事件，由响应侧决定是否下发
+type UpstreamMetadataEventHandler struct{}
+
+// Handle 实现EventHandler接口
+func (h *UpstreamMetadataEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent, error) {
+	var data map[string]any
+	if err := utils.FastUnmarshal(message.Payload, &data); err != nil {
+		return nil, err
+	}
+	// 兼容以事件类型为键的嵌套格式
+	if nested, ok := data[message.GetEventType()].(map[string]any); ok {
+		data = nested
+	}
+
+	var event types.AssistantResponseEvent
+	if err := event.FromDict(data); err != nil {
+		return nil, err
+	}
+	metadata := types.NewUpstreamMetadata(&event)
+	if metadata == nil {
+		return []SSEEvent{}, nil
+	}
+	return []SSEEvent{newUpstreamMetadataEvent(metadata)}, nil
+}
+
+// newUpstreamMetadataEvent 创建 upstream_metadata 事件（代理内部事件，不直接转发给客户端）
+func newUpstreamMetadataEvent(metadata *types.UpstreamMetadata) SSEEvent {
+	return SSEEvent{
+		Event: "upstream_metadata",
+		Data: map[string]any{
+			"type":     "upstream_metadata",
+			"metadata": metadata,
+		},
+	}
+}
+
+// CompletionMarkerEventHandler 处理 meteringEvent、contextUsageEvent 与 messageMetadataEvent
+// 上游只在生成结束后发送这些事件，收到即表示本次响应正常结束（未被截断）
+type CompletionMarkerEventHandler struct{}
+
+// Handle 实现EventHandler接口
+func (h *CompletionMarkerEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent, error) {
+	return []SSEEvent{
+		{
+			Event: "upstream_completion",
+			Data: map[string]any{
+				"type":  "upstream_completion",
+				"event": message.GetEventType(),
+			},
+		},
+	}, nil
+}
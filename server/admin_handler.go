@@ -0,0 +1,20 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * handleAdminStatus 返回上游运行状态（熔断器等）
+ */
+func handleAdminStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"time":             time.Now().Format(time.RFC3339),
+		"circuit_breakers": snapshotCircuitBreakers(),
+		"stream_watchdog":  snapshotWatchdogTrips(),
+		"concurrency":      snapshotAccountLimiters(),
+	})
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+)
+
+// CircuitState 熔断器状态
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // 正常放行
+	CircuitOpen                         // 熔断，快速失败
+	CircuitHalfOpen                     // 半开，放行少量探测请求
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// 熔断器端点名称
+const (
+	circuitEndpointGenerate = "generateAssistantResponse"
+)
+
+// CircuitOpenError 熔断器打开时返回的错误
+type CircuitOpenError struct {
+	AccountID  string
+	Endpoint   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Upstream is temporarily unavailable for this account (circuit open), retry after %ds",
+		int(e.RetryAfter.Seconds()+0.5))
+}
+
+// CircuitBreaker 单个 账号+端点 的熔断器
+// 设计原则：
+// - 滑动窗口统计最近 N 次调用的失败（含慢调用）比例
+// - 状态切换时递增 generation，丢弃跨状态返回的旧调用结果
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	accountID string
+	endpoint  string
+	cfg       *config.CircuitBreakerConfig
+
+	state      CircuitState
+	generation uint64
+	openedAt   time.Time
+
+	// 滑动窗口（true 表示失败）
+	outcomes []bool
+	pos      int
+	count    int
+	failures int
+
+	// 半开状态探测计数
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+
+	// 统计信息
+	totalCalls    int64
+	totalFailures int64
+	totalRejected int64
+	lastLatency   time.Duration
+	lastError     string
+	lastChange    time.Time
+}
+
+// CircuitBreakerStatus 熔断器状态快照（用于状态端点）
+type CircuitBreakerStatus struct {
+	AccountID     string  `json:"account_id"`
+	Endpoint      string  `json:"endpoint"`
+	State         string  `json:"state"`
+	FailureRate   float64 `json:"failure_rate"`
+	WindowCalls   int     `json:"window_calls"`
+	TotalCalls    int64   `json:"total_calls"`
+	TotalFailures int64   `json:"total_failures"`
+	TotalRejected int64   `json:"total_rejected"`
+	LastLatencyMs int64   `json:"last_latency_ms"`
+	LastError     string  `json:"last_error,omitempty"`
+	LastChange    string  `json:"last_change,omitempty"`
+	RetryAfterSec int     `json:"retry_after_seconds,omitempty"`
+}
+
+var (
+	// circuitBreakers 熔断器注册表（key: 账号ID|端点）
+	circuitBreakers      = make(map[string]*CircuitBreaker)
+	circuitBreakersMutex sync.Mutex
+	circuitBreakerConfig = config.LoadCircuitBreakerConfig()
+)
+
+// initCircuitBreakers 按当前环境变量重新加载熔断器配置（.env 加载后调用）
+func initCircuitBreakers() {
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+	circuitBreakerConfig = config.LoadCircuitBreakerConfig()
+	circuitBreakers = make(map[string]*CircuitBreaker)
+}
+
+// getCircuitBreaker 获取（或创建）指定 账号+端点 的熔断器，未启用时返回 nil
+func getCircuitBreaker(accountID, endpoint string) *CircuitBreaker {
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+
+	if !circuitBreakerConfig.Enabled {
+		return nil
+	}
+
+	key := accountID + "|" + endpoint
+	cb, exists := circuitBreakers[key]
+	if !exists {
+		cb = &CircuitBreaker{
+			accountID:  accountID,
+			endpoint:   endpoint,
+			cfg:        circuitBreakerConfig,
+			outcomes:   make([]bool, circuitBreakerConfig.WindowSize),
+			lastChange: time.Now(),
+		}
+		circuitBreakers[key] = cb
+	}
+	return cb
+}
+
+// snapshotCircuitBreakers 导出所有熔断器状态（按账号、端点排序）
+func snapshotCircuitBreakers() []CircuitBreakerStatus {
+	circuitBreakersMutex.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(circuitBreakers))
+	for _, cb := range circuitBreakers {
+		breakers = append(breakers, cb)
+	}
+	circuitBreakersMutex.Unlock()
+
+	statuses := make([]CircuitBreakerStatus, 0, len(breakers))
+	for _, cb := range breakers {
+		statuses = append(statuses, cb.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].AccountID != statuses[j].AccountID {
+			return statuses[i].AccountID < statuses[j].AccountID
+		}
+		return statuses[i].Endpoint < statuses[j].Endpoint
+	})
+	return statuses
+}
+
+// Allow 判断是否放行请求，返回本次调用所属的 generation，用于 Record
+func (cb *CircuitBreaker) Allow() (uint64, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	if cb.state == CircuitOpen {
+		if now.Sub(cb.openedAt) < cb.cfg.OpenDuration {
+			cb.totalRejected++
+			return 0, &CircuitOpenError{
+				AccountID:  cb.accountID,
+				Endpoint:   cb.endpoint,
+				RetryAfter: cb.cfg.OpenDuration - now.Sub(cb.openedAt),
+			}
+		}
+		cb.transition(CircuitHalfOpen, now)
+	}
+
+	if cb.state == CircuitHalfOpen {
+		if cb.halfOpenInFlight+cb.halfOpenSuccesses >= cb.cfg.HalfOpenMaxCalls {
+			cb.totalRejected++
+			return 0, &CircuitOpenError{
+				AccountID:  cb.accountID,
+				Endpoint:   cb.endpoint,
+				RetryAfter: time.Second,
+			}
+		}
+		cb.halfOpenInFlight++
+	}
+
+	return cb.generation, nil
+}
+
+// Record 记录一次调用结果；失败或耗时超过慢调用阈值都计为失败
+func (cb *CircuitBreaker) Record(generation uint64, success bool, latency time.Duration, reason string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	failed := !success || latency >= cb.cfg.SlowCallThreshold
+	if success && failed {
+		reason = fmt.Sprintf("slow call: %dms", latency.Milliseconds())
+	}
+
+	cb.totalCalls++
+	cb.lastLatency = latency
+	if failed {
+		cb.totalFailures++
+		cb.lastError = reason
+	}
+
+	// 状态已切换，旧调用结果不再影响当前状态
+	if generation != cb.generation {
+		return
+	}
+
+	now := time.Now()
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.halfOpenInFlight--
+		if failed {
+			cb.transition(CircuitOpen, now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.cfg.HalfOpenMaxCalls {
+			cb.transition(CircuitClosed, now)
+		}
+	case CircuitClosed:
+		cb.pushOutcome(failed)
+		if cb.count >= cb.cfg.MinRequests && cb.failures*100 >= cb.cfg.FailureRateThreshold*cb.count {
+			cb.transition(CircuitOpen, now)
+		}
+	}
+}
+
+// Cancel 放弃一次已放行但未发出的调用（如排队失败），归还半开探测名额
+func (cb *CircuitBreaker) Cancel(generation uint64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation == cb.generation && cb.state == CircuitHalfOpen && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight--
+	}
+}
+
+// pushOutcome 将调用结果写入滑动窗口
+func (cb *CircuitBreaker) pushOutcome(failed bool) {
+	if cb.count == len(cb.outcomes) {
+		if cb.outcomes[cb.pos] {
+			cb.failures--
+		}
+	} else {
+		cb.count++
+	}
+	cb.outcomes[cb.pos] = failed
+	if failed {
+		cb.failures++
+	}
+	cb.pos = (cb.pos + 1) % len(cb.outcomes)
+}
+
+// transition 切换状态并重置对应计数（调用方需持有锁）
+func (cb *CircuitBreaker) transition(state CircuitState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+
+	utils.Info("熔断器状态变更: account=%s endpoint=%s %s -> %s (last_error=%s)",
+		cb.accountID, cb.endpoint, cb.state, state, cb.lastError)
+
+	cb.state = state
+	cb.generation++
+	cb.lastChange = now
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = now
+	case CircuitClosed:
+		for i := range cb.outcomes {
+			cb.outcomes[i] = false
+		}
+		cb.pos, cb.count, cb.failures = 0, 0, 0
+	}
+}
+
+// Status 导出状态快照
+func (cb *CircuitBreaker) Status() CircuitBreakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	status := CircuitBreakerStatus{
+		AccountID:     cb.accountID,
+		Endpoint:      cb.endpoint,
+		State:         cb.state.String(),
+		WindowCalls:   cb.count,
+		TotalCalls:    cb.totalCalls,
+		TotalFailures: cb.totalFailures,
+		TotalRejected: cb.totalRejected,
+		LastLatencyMs: cb.lastLatency.Milliseconds(),
+		LastError:     cb.lastError,
+		LastChange:    cb.lastChange.Format(time.RFC3339),
+	}
+	if cb.count > 0 {
+		status.FailureRate = float64(cb.failures) / float64(cb.count)
+	}
+	if cb.state == CircuitOpen {
+		if remaining := cb.cfg.OpenDuration - time.Since(cb.openedAt); remaining > 0 {
+			status.RetryAfterSec = int(remaining.Seconds() + 0.5)
+		}
+	}
+	return status
+}
+
+// isCircuitFailureStatus 判断上游状态码是否计入熔断失败
+// 只有上游自身的故障（5xx、限流）才计入，客户端错误与 token 失效不计入
+func isCircuitFailureStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+// recordOnClose 上游响应体关闭时向熔断器记录本次调用结果
+// 耗时取到首个字节的时间（生成总时长随输出长度变化，不参与慢调用判断）；
+// 读取出错或看门狗中断计为失败，客户端断开导致的取消不计入
+type recordOnClose struct {
+	io.ReadCloser
+	breaker    *CircuitBreaker
+	generation uint64
+	start      time.Time
+
+	mu        sync.Mutex
+	firstByte time.Duration
+	failure   string
+	once      sync.Once
+}
+
+func (r *recordOnClose) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	if n > 0 && r.firstByte == 0 {
+		r.firstByte = time.Since(r.start)
+	}
+	if err != nil && err != io.EOF && r.failure == "" && !errors.Is(err, context.Canceled) {
+		r.failure = err.Error()
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+// reportStreamFailure 记录流中断原因（看门狗触发时调用）
+func (r *recordOnClose) reportStreamFailure(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failure == "" {
+		r.failure = reason
+	}
+}
+
+func (r *recordOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() {
+		r.mu.Lock()
+		latency, failure := r.firstByte, r.failure
+		r.mu.Unlock()
+		if latency == 0 {
+			latency = time.Since(r.start)
+		}
+		r.breaker.Record(r.generation, failure == "", latency, failure)
+	})
+	return err
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	"kiro/converter"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// citationIndexKey gin 上下文中保存本次请求文档分块表的键
+const citationIndexKey = "citation_index"
+
+// 模型在回复中标注引用的标签
+const (
+	citeOpenTag  = "<cite"
+	citeCloseTag = "</cite>"
+	// citeTagMaxLength 开始标签的最大长度，超过仍未闭合时按普通文本输出
+	citeTagMaxLength = 512
+)
+
+// citeIDsPattern 从开始标签中提取分块 id 列表
+var citeIDsPattern = regexp.MustCompile(`ids\s*=\s*"([^"]*)"`)
+
+// applyCitations 将启用 citations 的文档替换为带分块标记的文本，并在系统提示末尾追加引用说明
+// 分块表保存在 gin 上下文中，响应侧据此把 <cite> 标记转为 citations
+func applyCitations(c *gin.Context, req types.AnthropicRequest) (types.AnthropicRequest, error) {
+	messages, index, err := converter.PrepareCitations(req.Messages)
+	if err != nil || index == nil {
+		return req, err
+	}
+	req.Messages = messages
+	req.System = withCitationInstruction(req.System)
+	c.Set(citationIndexKey, index)
+	return req, nil
+}
+
+// withCitationInstruction 在系统提示末尾追加引用说明（追加在末尾，不影响已有前缀的缓存）
+func withCitationInstruction(system types.SystemMessages) types.SystemMessages {
+	out := make(types.SystemMessages, 0, len(system)+1)
+	out = append(out, system...)
+	return append(out, types.AnthropicSystemMessage{Type: "text", Text: converter.CitationInstruction})
+}
+
+// citationIndex 本次请求的文档分块表，未启用 citations 时为 nil
+func citationIndex(c *gin.Context) *converter.CitationIndex {
+	if index, ok := c.Get(citationIndexKey); ok {
+		return index.(*converter.CitationIndex)
+	}
+	return nil
+}
+
+// citationPart 引用提取器输出的片段：开始引用、结束引用或文本
+type citationPart struct {
+	open  bool   // <cite ids="..."> 开始
+	close bool   // </cite> 结束
+	ids   string // 开始标签中的分块 id 列表
+	text  string
+}
+
+// citationExtractor 从文本流中提取 <cite> 标记
+// 与 ThinkingExtractor 相同，跨增量的部分标签暂存到下一次输入
+type citationExtractor struct {
+	pending string // 未完成的标签
+	inCite  bool   // 是否在 <cite> 内
+}
+
+// Feed 处理一段文本增量，返回可以立即输出的片段
+func (ce *citationExtractor) Feed(text string) []citationPart {
+	content := ce.pending + text
+	ce.pending = ""
+
+	var parts []citationPart
+	for content != "" {
+		if ce.inCite {
+			if idx := strings.Index(content, citeCloseTag); idx >= 0 {
+				parts = appendCitationText(parts, content[:idx])
+				parts = append(parts, citationPart{close: true})
+				ce.inCite = false
+				content = content[idx+len(citeCloseTag):]
+				continue
+			}
+			keep := partialTagSuffix(content, citeCloseTag)
+			parts = appendCitationText(parts, content[:len(content)-keep])
+			ce.pending = content[len(content)-keep:]
+			break
+		}
+
+		idx := strings.Index(content, citeOpenTag)
+		if idx < 0 {
+			keep := partialTagSuffix(content, citeOpenTag)
+			parts = appendCitationText(parts, content[:len(content)-keep])
+			ce.pending = content[len(content)-keep:]
+			break
+		}
+
+		rest := content[idx:]
+		tagEnd := strings.IndexByte(rest, '>')
+		if tagEnd < 0 && len(rest) <= citeTagMaxLength {
+			// 开始标签尚未完整，等待后续增量
+			parts = appendCitationText(parts, content[:idx])
+			ce.pending = rest
+			break
+		}
+		if tagEnd < 0 || !isCiteOpenTag(rest[:tagEnd+1]) {
+			// 不是引用标签（如 <citation>），按普通文本输出
+			parts = appendCitationText(parts, content[:idx+len(citeOpenTag)])
+			content = content[idx+len(citeOpenTag):]
+			continue
+		}
+
+		parts = appendCitationText(parts, content[:idx])
+		ids := ""
+		if m := citeIDsPattern.FindStringSubmatch(rest[:tagEnd+1]); m != nil {
+			ids = m[1]
+		}
+		parts = append(parts, citationPart{open: true, ids: ids})
+		ce.inCite = true
+		content = rest[tagEnd+1:]
+	}
+	return parts
+}
+
+// Flush 输出暂存的内容并结束未闭合的引用
+func (ce *citationExtractor) Flush() []citationPart {
+	parts := appendCitationText(nil, ce.pending)
+	if ce.inCite {
+		parts = append(parts, citationPart{close: true})
+	}
+	ce.pending = ""
+	ce.inCite = false
+	return parts
+}
+
+// isCiteOpenTag 判断是否为 <cite> 或 <cite ...> 开始标签
+func isCiteOpenTag(tag string) bool {
+	next := tag[len(citeOpenTag)]
+	return next == '>' || next == ' ' || next == '\t' || next == '\n'
+}
+
+// partialTagSuffix 文本末尾与标签前缀重合的长度（可能是被截断的标签）
+func partialTagSuffix(content, tag string) int {
+	for n := min(len(tag)-1, len(content)); n > 0; n-- {
+		if strings.HasSuffix(content, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// appendCitationText 追加非空文本片段
+func appendCitationText(parts []citationPart, text string) []citationPart {
+	if text == "" {
+		return parts
+	}
+	return append(parts, citationPart{text: text})
+}
+
+// citedTextBlocks 非流式响应：按 <cite> 标记把文本拆分为文本块，引用的部分带 citations
+// 未启用 citations 时返回单个文本块
+func citedTextBlocks(index *converter.CitationIndex, text string) []map[string]any {
+	if index == nil {
+		return []map[string]any{{"type": "text", "text": text}}
+	}
+
+	extractor := &citationExtractor{}
+	parts := append(extractor.Feed(text), extractor.Flush()...)
+
+	var blocks []map[string]any
+	var current map[string]any
+	for _, part := range parts {
+		switch {
+		case part.open:
+			citations := index.Citations(part.ids)
+			if len(citations) == 0 {
+				continue // 没有有效的分块 id，按普通文本处理
+			}
+			current = map[string]any{"type": "text", "text": "", "citations": citations}
+			blocks = append(blocks, current)
+		case part.close:
+			if current != nil && current["citations"] != nil {
+				current = nil
+			}
+		default:
+			if current == nil {
+				current = map[string]any{"type": "text", "text": ""}
+				blocks = append(blocks, current)
+			}
+			current["text"] = current["text"].(string) + part.text
+		}
+	}
+	return blocks
+}
+
+// emitCitationText 引用模式下输出文本：<cite> 包裹的部分单独成块，并以 citations_delta 发送引用
+func (ctx *StreamProcessorContext) emitCitationText(text string) {
+	for _, part := range ctx.citationExtractor.Feed(text) {
+		ctx.emitCitationPart(part)
+	}
+}
+
+// emitCitationPart 输出一个引用片段
+func (ctx *StreamProcessorContext) emitCitationPart(part citationPart) {
+	switch {
+	case part.open:
+		citations := ctx.citations.Citations(part.ids)
+		if len(citations) == 0 {
+			return // 没有有效的分块 id，按普通文本处理
+		}
+		ctx.stopTextBlock()
+		ctx.startTextBlock(true)
+		for _, citation := range citations {
+			deltaEvent := map[string]any{
+				"type":  "content_block_delta",
+				"index": ctx.textBlockIndex,
+				"delta": map[string]any{
+					"type":     "citations_delta",
+					"citation": citation,
+				},
+			}
+			if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, deltaEvent); err != nil {
+				utils.Log("发送 citations delta 失败", utils.LogErr(err))
+			}
+		}
+	case part.close:
+		if ctx.textBlockCited {
+			ctx.stopTextBlock()
+		}
+	default:
+		if !ctx.textBlockStarted {
+			ctx.startTextBlock(false)
+		}
+		ctx.sendTextDelta(ctx.textBlockIndex, part.text)
+	}
+}
+
+// flushCitations 输出 stop_sequences 与引用提取器暂存的文本，并关闭当前文本块
+func (ctx *StreamProcessorContext) flushCitations() {
+	if ctx.citations == nil {
+		return
+	}
+	if held := ctx.stopSequences.Flush(); held != "" {
+		ctx.emitCitationText(held)
+	}
+	for _, part := range ctx.citationExtractor.Flush() {
+		ctx.emitCitationPart(part)
+	}
+	ctx.stopTextBlock()
+}
+
+// handleCitationDelta 引用模式下处理直传的 text_delta（非 thinking 模式）
+// 返回 true 表示事件已处理，不需要原样转发
+func (esp *EventStreamProcessor) handleCitationDelta(dataMap map[string]any) bool {
+	delta, _ := dataMap["delta"].(map[string]any)
+	if deltaType, _ := delta["type"].(string); deltaType != "text_delta" {
+		return false
+	}
+	text, _ := delta["text"].(string)
+	esp.ctx.emitCitationText(esp.ctx.stopSequences.Feed(text))
+	if matched := esp.ctx.stopSequences.Matched(); matched != "" {
+		utils.Log("命中stop_sequence，结束消息",
+			addReqFields(esp.ctx.c, utils.LogString("stop_sequence", matched))...)
+	}
+	return true
+}
+
+// remapCitationToolIndex 引用模式下文本块由代理分配索引：工具块开始前结束当前文本块，
+// 并为上游工具块重新分配索引避免冲突（续写段的索引已由续写逻辑重映射）
+func (ctx *StreamProcessorContext) remapCitationToolIndex(dataMap map[string]any) {
+	index := extractIndex(dataMap)
+	if index < 0 {
+		return
+	}
+	if dataMap["type"] == "content_block_start" {
+		cb, _ := dataMap["content_block"].(map[string]any)
+		if cbType, _ := cb["type"].(string); cbType == "tool_use" {
+			ctx.flushCitations()
+			if ctx.continuation.segment == 0 && !isPrunedTool(ctx.c, ctx.toolNames.Original(getStringField(cb, "name"))) {
+				ctx.citationToolIndex[index] = ctx.sseStateManager.AllocateBlockIndex()
+			}
+		}
+	}
+	if ctx.continuation.segment > 0 {
+		return
+	}
+	if mapped, ok := ctx.citationToolIndex[index]; ok {
+		dataMap["index"] = mapped
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"kiro/config"
 	"kiro/converter"
@@ -15,9 +16,10 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// UpstreamError 上游 API 错误类型
+// UpstreamError 上游 API 错误类型（已映射为 Anthropic 错误类型与状态码）
 type UpstreamError struct {
-	StatusCode int
+	StatusCode int    // 返回给客户端的 HTTP 状态码
+	ErrorType  string // Anthropic 错误类型，如 rate_limit_error
 	Message    string
 }
 
@@ -25,51 +27,88 @@ func (e *UpstreamError) Error() string {
 	return e.Message
 }
 
-// respondErrorWithCode 标准化的错误响应结构
-// 统一返回: {"error": {"message": string, "code": string}}
-func respondErrorWithCode(c *gin.Context, statusCode int, code string, format string, args ...any) {
-	c.JSON(statusCode, gin.H{
-		"error": gin.H{
-			"message": fmt.Sprintf(format, args...),
-			"code":    code,
-		},
-	})
-}
-
-// respondError 简化封装，依据statusCode映射默认code
-func respondError(c *gin.Context, statusCode int, format string, args ...any) {
-	var code string
+// anthropicErrorType 根据 HTTP 状态码选择 Anthropic 错误类型
+func anthropicErrorType(statusCode int) string {
 	switch statusCode {
 	case http.StatusBadRequest:
-		code = "bad_request"
+		return "invalid_request_error"
 	case http.StatusUnauthorized:
-		code = "unauthorized"
+		return "authentication_error"
 	case http.StatusForbidden:
-		code = "forbidden"
+		return "permission_error"
 	case http.StatusNotFound:
-		code = "not_found"
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
 	case http.StatusTooManyRequests:
-		code = "rate_limited"
+		return "rate_limit_error"
+	case http.StatusGatewayTimeout:
+		return "timeout_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
 	default:
-		code = "internal_error"
+		return "api_error"
 	}
-	respondErrorWithCode(c, statusCode, code, format, args...)
+}
+
+// respondAnthropicError Anthropic 标准错误响应
+// 返回: {"type": "error", "error": {"type": string, "message": string}, "request_id": string}
+func respondAnthropicError(c *gin.Context, statusCode int, errorType string, message string) {
+	resp := gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errorType,
+			"message": message,
+		},
+	}
+	if rid := GetRequestID(c); rid != "" {
+		resp["request_id"] = rid
+	}
+	c.JSON(statusCode, resp)
+}
+
+// respondStatusError 按状态码推断错误类型的简化封装
+func respondStatusError(c *gin.Context, statusCode int, format string, args ...any) {
+	respondAnthropicError(c, statusCode, anthropicErrorType(statusCode), fmt.Sprintf(format, args...))
+}
+
+// respondUpstreamError 返回已映射的上游错误
+func respondUpstreamError(c *gin.Context, err *UpstreamError) {
+	respondAnthropicError(c, err.StatusCode, err.ErrorType, err.Message)
+}
+
+// respondOverloaded 返回 overloaded_error（HTTP 529），retryAfter > 0 时附带 Retry-After
+func respondOverloaded(c *gin.Context, retryAfter time.Duration, message string) {
+	if retryAfter > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds()+0.5)))
+	}
+	respondAnthropicError(c, 529, "overloaded_error", message)
+}
+
+// respondCircuitOpen 熔断器打开时快速失败
+func respondCircuitOpen(c *gin.Context, err *CircuitOpenError) {
+	respondOverloaded(c, err.RetryAfter, err.Error())
+}
+
+// respondConcurrencyLimit 排队超时或队列已满
+func respondConcurrencyLimit(c *gin.Context, err *ConcurrencyLimitError) {
+	respondOverloaded(c, time.Second, err.Error())
 }
 
 // 通用请求处理错误函数
 func handleRequestBuildError(c *gin.Context, err error) {
 	utils.Error("构建请求失败: %v", err)
-	respondError(c, http.StatusInternalServerError, "构建请求失败: %v", err)
+	respondStatusError(c, http.StatusInternalServerError, "Failed to build upstream request: %v", err)
 }
 
 func handleRequestSendError(c *gin.Context, err error) {
 	utils.Error("发送请求失败: %v", err)
-	respondError(c, http.StatusInternalServerError, "发送请求失败: %v", err)
+	respondStatusError(c, http.StatusBadGateway, "Failed to reach upstream: %v", err)
 }
 
 func handleResponseReadError(c *gin.Context, err error) {
 	utils.Error("读取响应体失败: %v", err)
-	respondError(c, http.StatusInternalServerError, "读取响应体失败: %v", err)
+	respondStatusError(c, http.StatusBadGateway, "Failed to read upstream response: %v", err)
 }
 
 // 通用请求执行函数
@@ -107,13 +146,65 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 		return nil, err
 	}
 
-	resp, err := utils.DoRequest(req)
+	accountID := GetAccountID(c)
+
+	// 熔断器：账号+端点 维度，打开时快速失败；先于排队判断，避免熔断期间请求在队列中堆积
+	breaker := getCircuitBreaker(accountID, circuitEndpointGenerate)
+	var generation uint64
+	if breaker != nil {
+		generation, err = breaker.Allow()
+		if err != nil {
+			utils.Error("熔断器拒绝请求: account=%s endpoint=%s", accountID, circuitEndpointGenerate)
+			if !isStream {
+				respondCircuitOpen(c, err.(*CircuitOpenError))
+			}
+			return nil, err
+		}
+	}
+
+	// 并发限制：按账号排队，许可在响应体关闭（生成结束）时归还
+	release := func() {}
+	if limiter := getAccountLimiter(accountID); limiter != nil {
+		client := limiterClientKey(c, anthropicReq)
+		waited, err := limiter.Acquire(c.Request.Context(), client)
+		if waited > 0 {
+			c.Header("X-Queue-Wait-Ms", fmt.Sprintf("%d", waited.Milliseconds()))
+		}
+		if err != nil {
+			if breaker != nil {
+				breaker.Cancel(generation)
+			}
+			utils.Error("并发排队失败: account=%s: %v", accountID, err)
+			if limitErr, ok := err.(*ConcurrencyLimitError); ok && !isStream {
+				respondConcurrencyLimit(c, limitErr)
+			}
+			return nil, err
+		}
+		release = func() { limiter.Release(client) }
+	}
+
+	start := time.Now()
+	resp, err := utils.DoRequestForAccount(req, accountID)
+	if breaker != nil {
+		if err != nil {
+			breaker.Record(generation, false, time.Since(start), err.Error())
+		} else if resp.StatusCode != http.StatusOK {
+			breaker.Record(generation, !isCircuitFailureStatus(resp.StatusCode), time.Since(start),
+				fmt.Sprintf("upstream status %d", resp.StatusCode))
+		}
+	}
 	if err != nil {
+		release()
 		if !isStream {
 			handleRequestSendError(c, err)
 		}
 		return nil, err
 	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	if breaker != nil && resp.StatusCode == http.StatusOK {
+		// 正常响应在响应体关闭时记录结果，流中途的读取错误与看门狗中断同样计入熔断
+		resp.Body = &recordOnClose{ReadCloser: resp.Body, breaker: breaker, generation: generation, start: start}
+	}
 
 	upstreamErr := handleCodeWhispererError(c, resp, isStream)
 	if upstreamErr != nil {
@@ -124,17 +215,32 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 	return resp, nil
 }
 
+// limiterClientKey 并发排队使用的客户端标识
+// 以认证后的 API Key 标识（refresh token 哈希）为主键；X-Client-ID 请求头 > metadata.user_id 只作为同一 Key 下的子标识，
+// 格式为 "Key标识/子标识"，客户端无法通过请求头冒用其他 Key 的标识与权重；
+// 未在权重文件中列出的子标识由限制器归入 Key 标识（见 AccountLimiter.resolveClient）
+func limiterClientKey(c *gin.Context, anthropicReq types.AnthropicRequest) string {
+	key := AccountID(c.GetString("refreshToken"))
+	if clientID := c.GetHeader("X-Client-ID"); clientID != "" {
+		return key + "/" + clientID
+	}
+	if userID, ok := anthropicReq.Metadata["user_id"].(string); ok && userID != "" {
+		return key + "/" + userID
+	}
+	return key
+}
+
 // execCWRequest 供测试覆盖的请求执行入口（可在测试中替换）
 var execCWRequest = executeCodeWhispererRequest
 
 // buildCodeWhispererRequest 构建通用的CodeWhisperer请求
 func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
+	anthropicReq = applyToolPruning(c, anthropicReq)
 	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
 	if err != nil {
 		// 检查是否是模型未找到错误
 		if modelNotFoundErr, ok := err.(*types.ModelNotFoundErrorType); ok {
-			// 直接返回用户期望的JSON格式
-			c.JSON(http.StatusBadRequest, modelNotFoundErr.ErrorData)
+			respondAnthropicError(c, http.StatusNotFound, "not_found_error", modelNotFoundErr.Error())
 			return nil, err
 		}
 		return nil, fmt.Errorf("构建CodeWhisperer请求失败: %v", err)
@@ -169,6 +275,7 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 }
 
 // handleCodeWhispererError 处理CodeWhisperer API错误响应
+// 上游错误经 ErrorMapper 映射为 Anthropic 错误类型与状态码；
 // 对于流式请求，只返回错误信息；对于非流式请求，发送JSON响应
 func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool) *UpstreamError {
 	if resp.StatusCode == http.StatusOK {
@@ -178,52 +285,51 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		utils.Error("读取错误响应失败: %v", err)
+		upstreamErr := &UpstreamError{
+			StatusCode: http.StatusBadGateway,
+			ErrorType:  "api_error",
+			Message:    "Failed to read upstream error response",
+		}
 		if !isStream {
-			respondError(c, http.StatusInternalServerError, "%s", "读取响应失败")
+			respondUpstreamError(c, upstreamErr)
 		}
-		return &UpstreamError{StatusCode: resp.StatusCode, Message: "读取响应失败"}
+		return upstreamErr
 	}
 
 	utils.Error("上游错误: status=%d, body=%s", resp.StatusCode, string(body))
 
-	// 尝试解析上游错误信息
-	errorMsg := string(body)
-	var errorResp map[string]any
-	if err := utils.SafeUnmarshal(body, &errorResp); err == nil {
-		if msg, ok := errorResp["message"].(string); ok && msg != "" {
-			errorMsg = msg
-		}
-	}
-
-	// 特殊处理：403错误表示账号被封禁
+	// 特殊处理：403错误表示账号被封禁，清除失效的 token 缓存
 	if resp.StatusCode == http.StatusForbidden {
-		// 清除失效的 token 缓存
 		if refreshToken, exists := c.Get("refreshToken"); exists {
 			if token, ok := refreshToken.(string); ok {
 				InvalidateToken(token)
 			}
 		}
-
-		if !isStream {
-			respondErrorWithCode(c, http.StatusForbidden, "forbidden", "%s", errorMsg)
-		}
-		return &UpstreamError{StatusCode: resp.StatusCode, Message: errorMsg}
 	}
 
 	// 使用错误映射器处理错误
 	errorMapper := NewErrorMapper()
 	claudeError := errorMapper.MapCodeWhispererError(resp.StatusCode, body)
 
+	upstreamErr := &UpstreamError{
+		StatusCode: claudeError.StatusCode,
+		ErrorType:  claudeError.Type,
+		Message:    claudeError.Message,
+	}
+	if claudeError.StopReason == "max_tokens" {
+		upstreamErr.ErrorType = "invalid_request_error"
+	}
+
 	if !isStream {
 		// 非流式请求：发送JSON响应
 		if claudeError.StopReason == "max_tokens" {
 			errorMapper.SendClaudeError(c, claudeError)
 		} else {
-			respondErrorWithCode(c, http.StatusInternalServerError, "cw_error", "%s", errorMsg)
+			respondUpstreamError(c, upstreamErr)
 		}
 	}
 
-	return &UpstreamError{StatusCode: resp.StatusCode, Message: errorMsg}
+	return upstreamErr
 }
 
 // StreamEventSender 统一的流事件发送接口
@@ -393,6 +499,14 @@ func convertContentBlockStart(m map[string]any) *types.ContentBlockStartEvent {
 				Type: "text",
 				Text: text,
 			}
+			if citations, ok := cb["citations"].([]any); ok {
+				// 引用文本块：保留 citations 数组
+				block = &types.SSECitedTextContentBlock{
+					Type:      "text",
+					Text:      text,
+					Citations: citations,
+				}
+			}
 		} else if blockType == "tool_use" {
 			// 工具使用块：使用专用结构体确保 input 字段始终存在
 			toolBlock := &types.SSEToolUseContentBlock{
@@ -466,6 +580,16 @@ func convertContentBlockDelta(m map[string]any) *types.ContentBlockDeltaEvent {
 			Type:     deltaType,
 			Thinking: thinking,
 		}
+	case "citations_delta":
+		// citations_delta：引用对象原样输出
+		var citation any
+		if d, ok := m["delta"].(map[string]any); ok {
+			citation = d["citation"]
+		}
+		delta = &types.CitationsDeltaBlock{
+			Type:     deltaType,
+			Citation: citation,
+		}
 	case "signature_delta":
 		// signature_delta：使用专用结构体确保 signature 字段存在
 		delta = &types.SignatureDeltaBlock{
@@ -495,8 +619,13 @@ func convertContentBlockStop(m map[string]any) *types.ContentBlockStopEvent {
 
 func convertMessageDelta(m map[string]any) *types.MessageDeltaEvent {
 	stopReason := ""
+	var stopSequence *string
 	if delta, ok := m["delta"].(map[string]any); ok {
 		stopReason, _ = delta["stop_reason"].(string)
+		// 命中 stop_sequences 时返回命中的序列
+		if seq, ok := delta["stop_sequence"].(string); ok {
+			stopSequence = &seq
+		}
 	}
 
 	var usage *types.UsageInfo
@@ -525,7 +654,7 @@ func convertMessageDelta(m map[string]any) *types.MessageDeltaEvent {
 			usage.OutputTokens = int(v)
 		}
 	}
-	return types.NewMessageDeltaEvent(stopReason, usage)
+	return types.NewMessageDeltaEvent(stopReason, stopSequence, usage)
 }
 
 func convertError(m map[string]any) *types.ErrorEvent {
@@ -559,7 +688,7 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 	tokenInfo, err := rc.AuthService.GetToken()
 	if err != nil {
 		utils.Error("获取token失败: %v", err)
-		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
+		respondStatusError(rc.GinContext, http.StatusInternalServerError, "Failed to obtain access token: %v", err)
 		return types.TokenInfo{}, nil, err
 	}
 
@@ -567,7 +696,7 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		utils.Error("读取请求体失败: %v", err)
-		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
+		respondStatusError(rc.GinContext, http.StatusBadRequest, "Failed to read request body: %v", err)
 		return types.TokenInfo{}, nil, err
 	}
 
@@ -581,7 +710,7 @@ func (rc *RequestContext) GetTokenWithUsageAndBody() (*types.TokenWithUsage, []b
 	tokenWithUsage, err := rc.AuthService.GetTokenWithUsage()
 	if err != nil {
 		utils.Error("获取token失败: %v", err)
-		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
+		respondStatusError(rc.GinContext, http.StatusInternalServerError, "Failed to obtain access token: %v", err)
 		return nil, nil, err
 	}
 
@@ -589,7 +718,7 @@ func (rc *RequestContext) GetTokenWithUsageAndBody() (*types.TokenWithUsage, []b
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		utils.Error("读取请求体失败: %v", err)
-		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
+		respondStatusError(rc.GinContext, http.StatusBadRequest, "Failed to read request body: %v", err)
 		return nil, nil, err
 	}
 
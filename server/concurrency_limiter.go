@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+)
+
+// ConcurrencyLimitError 排队超时或队列已满
+type ConcurrencyLimitError struct {
+	AccountID string
+	Reason    string // queue_full | queue_timeout
+	Waited    time.Duration
+}
+
+func (e *ConcurrencyLimitError) Error() string {
+	if e.Reason == "queue_full" {
+		return "Too many concurrent requests for this account, the wait queue is full"
+	}
+	return fmt.Sprintf("Timed out after %ds waiting for a free upstream slot for this account", int(e.Waited.Seconds()+0.5))
+}
+
+// queueWaiter 排队中的请求
+type queueWaiter struct {
+	client   string
+	tag      float64 // 虚拟完成时间，越小越先调度
+	seq      uint64  // 同 tag 时按到达顺序
+	enqueued time.Time
+	granted  chan struct{}
+	done     bool // 已出队（获得许可或放弃）
+}
+
+// AccountLimiter 单个上游账号的并发限制器
+// 设计原则：
+// - 加权公平排队（WFQ）：每个客户端按权重累加虚拟完成时间，批量任务无法饿死交互请求
+// - 有界队列 + 排队超时，超时返回 overloaded_error
+type AccountLimiter struct {
+	mu sync.Mutex
+
+	accountID string
+	cfg       *config.ConcurrencyConfig
+
+	active      int
+	queue       []*queueWaiter
+	virtualTime float64
+	lastFinish  map[string]float64 // 各客户端最近一次的虚拟完成时间
+	inflight    map[string]int     // 各客户端排队中与执行中的请求数，归零时清理 lastFinish
+	seq         uint64
+
+	// 统计信息
+	totalAcquired int64
+	totalTimeouts int64
+	totalRejected int64
+	totalWait     time.Duration
+	maxWait       time.Duration
+	lastWait      time.Duration
+}
+
+// AccountLimiterStatus 并发限制器状态快照（用于状态端点）
+type AccountLimiterStatus struct {
+	AccountID     string         `json:"account_id"`
+	Active        int            `json:"active"`
+	Limit         int            `json:"limit"`
+	QueueDepth    int            `json:"queue_depth"`
+	QueueByClient map[string]int `json:"queue_by_client,omitempty"`
+	OldestWaitMs  int64          `json:"oldest_wait_ms"`
+	AvgWaitMs     int64          `json:"avg_wait_ms"`
+	MaxWaitMs     int64          `json:"max_wait_ms"`
+	LastWaitMs    int64          `json:"last_wait_ms"`
+	TotalAcquired int64          `json:"total_acquired"`
+	TotalTimeouts int64          `json:"total_timeouts"`
+	TotalRejected int64          `json:"total_rejected"`
+}
+
+var (
+	// accountLimiters 并发限制器注册表（key: 账号ID）
+	accountLimiters      = make(map[string]*AccountLimiter)
+	accountLimitersMutex sync.Mutex
+	concurrencyConfig    = &config.ConcurrencyConfig{ClientWeights: map[string]int{}}
+)
+
+// initConcurrencyLimiters 按当前环境变量重新加载并发限制配置（.env 加载后调用）
+func initConcurrencyLimiters() {
+	cfg, err := config.LoadConcurrencyConfig()
+	if err != nil {
+		utils.Error("并发权重配置无效，所有客户端使用默认权重: %v", err)
+	}
+
+	accountLimitersMutex.Lock()
+	defer accountLimitersMutex.Unlock()
+	concurrencyConfig = cfg
+	accountLimiters = make(map[string]*AccountLimiter)
+
+	if cfg.MaxPerAccount > 0 {
+		utils.Info("账号并发限制已启用: max=%d, queue=%d, timeout=%s",
+			cfg.MaxPerAccount, cfg.QueueSize, cfg.QueueTimeout)
+	}
+}
+
+// getAccountLimiter 获取（或创建）账号的并发限制器，未启用时返回 nil
+func getAccountLimiter(accountID string) *AccountLimiter {
+	accountLimitersMutex.Lock()
+	defer accountLimitersMutex.Unlock()
+
+	if concurrencyConfig.MaxPerAccount <= 0 {
+		return nil
+	}
+
+	limiter, exists := accountLimiters[accountID]
+	if !exists {
+		limiter = &AccountLimiter{
+			accountID:  accountID,
+			cfg:        concurrencyConfig,
+			lastFinish: make(map[string]float64),
+			inflight:   make(map[string]int),
+		}
+		accountLimiters[accountID] = limiter
+	}
+	return limiter
+}
+
+// snapshotAccountLimiters 导出所有并发限制器状态（按账号排序）
+func snapshotAccountLimiters() []AccountLimiterStatus {
+	accountLimitersMutex.Lock()
+	limiters := make([]*AccountLimiter, 0, len(accountLimiters))
+	for _, limiter := range accountLimiters {
+		limiters = append(limiters, limiter)
+	}
+	accountLimitersMutex.Unlock()
+
+	statuses := make([]AccountLimiterStatus, 0, len(limiters))
+	for _, limiter := range limiters {
+		statuses = append(statuses, limiter.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].AccountID < statuses[j].AccountID
+	})
+	return statuses
+}
+
+// resolveClient 归并客户端标识：只有在权重文件中列出的 "Key标识/子标识" 才单独排队，
+// 其余子标识归入 Key 标识，避免客户端轮换子标识绕过公平排队
+func (l *AccountLimiter) resolveClient(client string) string {
+	if _, ok := l.cfg.ClientWeights[client]; ok {
+		return client
+	}
+	key, _, _ := strings.Cut(client, "/")
+	return key
+}
+
+// weight 获取客户端权重（client 为 resolveClient 归并后的标识）
+func (l *AccountLimiter) weight(client string) float64 {
+	if w, ok := l.cfg.ClientWeights[client]; ok && w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+// untrack 客户端一个请求结束（调用方需持有锁）；没有排队或执行中的请求时清理其虚拟完成时间
+func (l *AccountLimiter) untrack(client string) {
+	if l.inflight[client] <= 1 {
+		delete(l.inflight, client)
+		delete(l.lastFinish, client)
+		return
+	}
+	l.inflight[client]--
+}
+
+// Acquire 获取一个并发许可，返回实际排队时长
+// 有空闲槽位且无人排队时立即返回；否则进入加权公平队列等待。获得许可后须以相同 client 调用 Release
+func (l *AccountLimiter) Acquire(ctx context.Context, client string) (time.Duration, error) {
+	client = l.resolveClient(client)
+	l.mu.Lock()
+
+	if l.active < l.cfg.MaxPerAccount && len(l.queue) == 0 {
+		l.inflight[client]++
+		l.active++
+		l.totalAcquired++
+		l.recordWait(0)
+		l.mu.Unlock()
+		return 0, nil
+	}
+
+	if len(l.queue) >= l.cfg.QueueSize {
+		l.totalRejected++
+		l.mu.Unlock()
+		return 0, &ConcurrencyLimitError{AccountID: l.accountID, Reason: "queue_full"}
+	}
+
+	// 虚拟完成时间 = max(当前虚拟时间, 该客户端上次完成时间) + 1/权重
+	start := l.virtualTime
+	if last := l.lastFinish[client]; last > start {
+		start = last
+	}
+	tag := start + 1/l.weight(client)
+	l.lastFinish[client] = tag
+	l.inflight[client]++
+	l.seq++
+
+	w := &queueWaiter{
+		client:   client,
+		tag:      tag,
+		seq:      l.seq,
+		enqueued: time.Now(),
+		granted:  make(chan struct{}),
+	}
+	l.queue = append(l.queue, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.granted:
+		return time.Since(w.enqueued), nil
+	case <-ctx.Done():
+		if l.abandon(w) {
+			return time.Since(w.enqueued), ctx.Err()
+		}
+	case <-timer.C:
+		if l.abandon(w) {
+			waited := time.Since(w.enqueued)
+			l.mu.Lock()
+			l.totalTimeouts++
+			l.mu.Unlock()
+			return waited, &ConcurrencyLimitError{AccountID: l.accountID, Reason: "queue_timeout", Waited: waited}
+		}
+	}
+
+	// 放弃与获得许可同时发生：许可已分配，按获得处理
+	<-w.granted
+	return time.Since(w.enqueued), nil
+}
+
+// abandon 将等待者移出队列，返回 false 表示其已获得许可
+func (l *AccountLimiter) abandon(w *queueWaiter) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w.done {
+		return false
+	}
+	w.done = true
+	for i, q := range l.queue {
+		if q == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	l.untrack(w.client)
+	return true
+}
+
+// Release 归还 client 的许可，并按虚拟完成时间调度下一个等待者
+func (l *AccountLimiter) Release(client string) {
+	client = l.resolveClient(client)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	l.untrack(client)
+	for l.active < l.cfg.MaxPerAccount && len(l.queue) > 0 {
+		next := 0
+		for i, q := range l.queue {
+			if q.tag < l.queue[next].tag || (q.tag == l.queue[next].tag && q.seq < l.queue[next].seq) {
+				next = i
+			}
+		}
+		w := l.queue[next]
+		l.queue = append(l.queue[:next], l.queue[next+1:]...)
+
+		w.done = true
+		l.virtualTime = w.tag
+		l.active++
+		l.totalAcquired++
+		l.recordWait(time.Since(w.enqueued))
+		close(w.granted)
+	}
+
+	// 队列清空后重置虚拟时钟，避免浮点数无限增长
+	if len(l.queue) == 0 && l.active == 0 {
+		l.virtualTime = 0
+	}
+}
+
+// recordWait 记录排队时长（调用方需持有锁）
+func (l *AccountLimiter) recordWait(waited time.Duration) {
+	l.totalWait += waited
+	l.lastWait = waited
+	if waited > l.maxWait {
+		l.maxWait = waited
+	}
+}
+
+// Status 导出状态快照
+func (l *AccountLimiter) Status() AccountLimiterStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := AccountLimiterStatus{
+		AccountID:     l.accountID,
+		Active:        l.active,
+		Limit:         l.cfg.MaxPerAccount,
+		QueueDepth:    len(l.queue),
+		MaxWaitMs:     l.maxWait.Milliseconds(),
+		LastWaitMs:    l.lastWait.Milliseconds(),
+		TotalAcquired: l.totalAcquired,
+		TotalTimeouts: l.totalTimeouts,
+		TotalRejected: l.totalRejected,
+	}
+	if l.totalAcquired > 0 {
+		status.AvgWaitMs = (l.totalWait / time.Duration(l.totalAcquired)).Milliseconds()
+	}
+	if len(l.queue) > 0 {
+		status.QueueByClient = make(map[string]int)
+		oldest := l.queue[0].enqueued
+		for _, w := range l.queue {
+			status.QueueByClient[w.client]++
+			if w.enqueued.Before(oldest) {
+				oldest = w.enqueued
+			}
+		}
+		status.OldestWaitMs = time.Since(oldest).Milliseconds()
+	}
+	return status
+}
+
+// releaseOnClose 响应体关闭时归还并发许可（生成结束前一直占用槽位）
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
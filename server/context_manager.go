@@ -0,0 +1,440 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro/config"
+	"kiro/parser"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// contextStrategyHeader 响应头：本次请求实际应用的上下文策略（逗号分隔）
+	contextStrategyHeader = "X-Context-Strategy"
+
+	// contextTruncatedNote 丢弃或摘要较早轮次后附加到首条用户消息的说明
+	contextTruncatedNote = "[Earlier turns of this conversation were omitted to fit the context window.]"
+
+	// summaryToolResultMaxChars 摘要转录中单个工具结果保留的最大字符数
+	summaryToolResultMaxChars = 2000
+	// summaryToolInputMaxChars 摘要转录中单个工具参数保留的最大字符数
+	summaryToolInputMaxChars = 500
+)
+
+// contextSummarySystemPrompt 摘要请求的系统提示
+const contextSummarySystemPrompt = "You compress conversation history. Summarize the transcript you are given so that an assistant " +
+	"can continue the conversation without it. Keep the user's goals, decisions that were made, important facts, " +
+	"file paths, identifiers, commands and their outcomes, and any unfinished work. Write plain prose or short bullet points, " +
+	"no preamble."
+
+// contextWindowConfig 当前生效的上下文窗口管理配置
+var contextWindowConfig = &config.ContextWindowConfig{ModelBudgets: map[string]int{}}
+
+// initContextWindow 按当前环境变量重新加载上下文窗口配置（.env 加载后调用）
+func initContextWindow() {
+	cfg, err := config.LoadContextWindowConfig()
+	if err != nil {
+		utils.Error("上下文窗口配置无效，仅使用有效部分: %v", err)
+	}
+	contextWindowConfig = cfg
+}
+
+// contextTurn 一个对话轮次：assistant 消息及其后的 user 消息（tool_use 与对应的 tool_result 总在同一轮）
+type contextTurn struct {
+	messages []types.AnthropicRequestMessage
+	tokens   []int // 各消息的估算 token 数
+}
+
+// total 轮次的估算 token 数
+func (t *contextTurn) total() int {
+	sum := 0
+	for _, n := range t.tokens {
+		sum += n
+	}
+	return sum
+}
+
+// contextWindow 上下文窗口管理过程中的对话视图
+// 设计原则：
+// - 首批 user 消息（任务描述）与最近若干轮始终原样保留，只处理中间的历史
+// - 按轮次整体操作，保证 tool_use/tool_result 成对出现
+// - 不修改原请求中的消息，所有改动都作用于副本
+type contextWindow struct {
+	c         *gin.Context
+	cfg       *config.ContextWindowConfig
+	req       types.AnthropicRequest
+	token     types.TokenInfo
+	estimator *utils.TokenEstimator
+
+	budget     int
+	baseTokens int // 系统提示与工具定义
+
+	lead       []types.AnthropicRequestMessage
+	leadTokens []int
+	turns      []*contextTurn
+	summary    string // 已生成的较早轮次摘要
+}
+
+// manageContextWindow 估算请求大小，超出模型预算时按配置的策略压缩对话历史
+// 返回压缩后的请求；应用过的策略写入 X-Context-Strategy 响应头
+func manageContextWindow(c *gin.Context, req types.AnthropicRequest, token types.TokenInfo) types.AnthropicRequest {
+	cfg := contextWindowConfig
+	if len(cfg.Strategies) == 0 || len(req.Messages) < 2 {
+		return req
+	}
+
+	w := newContextWindow(c, cfg, req, token)
+	before := w.totalTokens()
+	if before <= w.budget || len(w.lead) == 0 {
+		return req
+	}
+
+	// 可压缩的轮次：最近 KeepRecentTurns 轮之前的部分
+	if len(w.turns) <= cfg.KeepRecentTurns {
+		utils.Info("上下文超出预算但没有可压缩的历史: tokens=%d, budget=%d, request_id=%s",
+			before, w.budget, GetRequestID(c))
+		return req
+	}
+
+	var applied []string
+	for _, strategy := range cfg.Strategies {
+		if w.totalTokens() <= w.budget {
+			break
+		}
+		var changed bool
+		switch strategy {
+		case config.ContextStrategyElideToolResults:
+			changed = w.elideToolResults()
+		case config.ContextStrategySummarize:
+			changed = w.summarize()
+		case config.ContextStrategyTruncate:
+			changed = w.truncate()
+		}
+		if changed {
+			applied = append(applied, strategy)
+		}
+	}
+
+	if len(applied) == 0 {
+		return req
+	}
+
+	after := w.totalTokens()
+	utils.Info("上下文窗口已压缩: strategies=%s, tokens=%d->%d, budget=%d, turns=%d, request_id=%s",
+		strings.Join(applied, ","), before, after, w.budget, len(w.turns), GetRequestID(c))
+	c.Header(contextStrategyHeader, strings.Join(applied, ","))
+	return w.build()
+}
+
+// newContextWindow 将消息切分为首批 user 消息与后续轮次，并逐条估算 token
+func newContextWindow(c *gin.Context, cfg *config.ContextWindowConfig, req types.AnthropicRequest, token types.TokenInfo) *contextWindow {
+	w := &contextWindow{
+		c:         c,
+		cfg:       cfg,
+		req:       req,
+		token:     token,
+		estimator: utils.NewTokenEstimator(),
+		budget:    cfg.BudgetFor(req.Model),
+	}
+
+	// 按完整的工具描述估算：超长描述的溢出部分会移入 <system_mode> 的工具参考章节，同样计入预算
+	w.baseTokens = w.estimator.EstimateTokens(&types.CountTokensRequest{
+		Model:  req.Model,
+		System: req.System,
+		Tools:  filterSupportedTools(req.Tools),
+	})
+
+	var current *contextTurn
+	for _, msg := range req.Messages {
+		tokens := w.messageTokens(msg)
+		if msg.Role == "assistant" {
+			current = &contextTurn{}
+			w.turns = append(w.turns, current)
+		}
+		if current == nil {
+			w.lead = append(w.lead, msg)
+			w.leadTokens = append(w.leadTokens, tokens)
+			continue
+		}
+		current.messages = append(current.messages, msg)
+		current.tokens = append(current.tokens, tokens)
+	}
+	return w
+}
+
+// messageTokens 估算单条消息的 token 数
+func (w *contextWindow) messageTokens(msg types.AnthropicRequestMessage) int {
+	// EstimateTokens 含 4 个基础请求开销，单条消息不重复计算
+	return w.estimator.EstimateTokens(&types.CountTokensRequest{
+		Messages: []types.AnthropicRequestMessage{msg},
+	}) - 4
+}
+
+// totalTokens 当前视图的估算 token 总数
+func (w *contextWindow) totalTokens() int {
+	total := w.baseTokens
+	for _, n := range w.leadTokens {
+		total += n
+	}
+	for _, turn := range w.turns {
+		total += turn.total()
+	}
+	return total
+}
+
+// compressible 可压缩的轮次数（最近的轮次始终保留）
+func (w *contextWindow) compressible() int {
+	return max(len(w.turns)-w.cfg.KeepRecentTurns, 0)
+}
+
+// elideToolResults 将较早轮次中较长的 tool_result 内容替换为占位说明
+func (w *contextWindow) elideToolResults() bool {
+	changed := false
+	for _, turn := range w.turns[:w.compressible()] {
+		for i, msg := range turn.messages {
+			blocks, ok := msg.Content.([]any)
+			if !ok {
+				continue
+			}
+			var elided []any
+			for j, block := range blocks {
+				m, ok := block.(map[string]any)
+				if !ok || m["type"] != "tool_result" {
+					continue
+				}
+				size := len(utils.ParseToolResultContent(m["content"]))
+				if size <= w.cfg.ElideMinChars {
+					continue
+				}
+				if elided == nil {
+					elided = append([]any(nil), blocks...)
+				}
+				replaced := make(map[string]any, len(m))
+				for k, v := range m {
+					replaced[k] = v
+				}
+				replaced["content"] = fmt.Sprintf("[Tool output elided to save context: %d characters]", size)
+				elided[j] = replaced
+			}
+			if elided == nil {
+				continue
+			}
+			turn.messages[i].Content = elided
+			turn.tokens[i] = w.messageTokens(turn.messages[i])
+			changed = true
+		}
+		if w.totalTokens() <= w.budget {
+			break
+		}
+	}
+	return changed
+}
+
+// truncate 从最早的轮次开始整轮丢弃，直到回到预算内
+func (w *contextWindow) truncate() bool {
+	drop := 0
+	excess := w.totalTokens() - w.budget
+	for drop < w.compressible() && excess > 0 {
+		excess -= w.turns[drop].total()
+		drop++
+	}
+	if drop == 0 {
+		return false
+	}
+	w.turns = w.turns[drop:]
+	w.markOmitted()
+	return true
+}
+
+// summarize 额外调用一次上游，将较早的轮次压缩为摘要
+func (w *contextWindow) summarize() bool {
+	// 选择需要摘要的轮次：为摘要本身预留 SummaryMaxTokens
+	count := 0
+	excess := w.totalTokens() - w.budget + w.cfg.SummaryMaxTokens
+	for count < w.compressible() && excess > 0 {
+		excess -= w.turns[count].total()
+		count++
+	}
+	if count == 0 {
+		return false
+	}
+
+	var transcript strings.Builder
+	if w.summary != "" {
+		transcript.WriteString("Summary of even earlier turns:\n" + w.summary + "\n\n")
+	}
+	for _, turn := range w.turns[:count] {
+		for _, msg := range turn.messages {
+			transcript.WriteString(renderMessageForSummary(msg))
+			transcript.WriteString("\n\n")
+		}
+	}
+
+	summary, err := w.requestSummary(transcript.String())
+	if err != nil {
+		utils.Error("上下文摘要失败: request_id=%s: %v", GetRequestID(w.c), err)
+		return false
+	}
+
+	w.summary = summary
+	w.turns = w.turns[count:]
+	w.markOmitted()
+	return true
+}
+
+// summaryContextKeys 摘要请求从原请求继承的上下文键（账号与日志关联），不继承会话ID、工具裁剪与引用状态
+var summaryContextKeys = []string{"accessToken", "refreshToken", "accountID", "request_id"}
+
+// summaryContext 为摘要请求创建独立的 gin 上下文
+// 摘要是一次独立的对话：去掉 X-Conversation-ID 请求头，会话ID按摘要请求本身的内容生成，
+// 不会以原对话的会话ID发往上游
+func summaryContext(c *gin.Context) *gin.Context {
+	request := c.Request.Clone(c.Request.Context())
+	request.Header.Del("X-Conversation-ID")
+	sc := &gin.Context{Request: request, Writer: c.Writer}
+	for _, key := range summaryContextKeys {
+		if value, ok := c.Get(key); ok {
+			sc.Set(key, value)
+		}
+	}
+	return sc
+}
+
+// requestSummary 以非流式方式调用上游生成摘要
+func (w *contextWindow) requestSummary(transcript string) (string, error) {
+	summaryReq := types.AnthropicRequest{
+		Model:     strings.TrimSuffix(w.req.Model, "-thinking"),
+		MaxTokens: w.cfg.SummaryMaxTokens,
+		System:    types.SystemMessages{{Type: "text", Text: contextSummarySystemPrompt}},
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "Summarize this conversation transcript:\n\n" + transcript},
+		},
+		Metadata: w.req.Metadata,
+	}
+
+	// isStream=true：失败时只返回错误，不向客户端写响应
+	resp, err := execCWRequest(summaryContext(w.c), summaryReq, w.token, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	watchdog := NewStreamWatchdog(resp.Body, streamWatchdogConfig)
+	body, err := utils.ReadHTTPResponse(&watchdogReader{r: resp.Body, wd: watchdog})
+	watchdog.Stop()
+	if err != nil {
+		if timeoutErr := watchdog.Err(); timeoutErr != nil {
+			return "", timeoutErr
+		}
+		return "", err
+	}
+
+	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser.SetMaxErrors(config.ParserMaxErrors)
+	result, err := compliantParser.ParseResponse(body)
+	if err != nil {
+		return "", err
+	}
+
+	_, summary := ExtractThinkingFromFinalText(result.GetCompletionText())
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return "", fmt.Errorf("上游返回了空摘要")
+	}
+	return summary, nil
+}
+
+// markOmitted 在首批 user 消息末尾附加省略说明与摘要
+func (w *contextWindow) markOmitted() {
+	if len(w.lead) == 0 {
+		return
+	}
+
+	// 每次重新基于原始内容生成，避免重复追加
+	last := len(w.lead) - 1
+	note := contextTruncatedNote
+	if w.summary != "" {
+		note += "\n\nSummary of the omitted turns:\n" + w.summary
+	}
+	w.lead[last].Content = appendTextContent(w.req.Messages[last].Content, note)
+	w.leadTokens[last] = w.messageTokens(w.lead[last])
+}
+
+// build 生成压缩后的请求
+func (w *contextWindow) build() types.AnthropicRequest {
+	out := w.req
+	out.Messages = make([]types.AnthropicRequestMessage, 0, len(w.req.Messages))
+	out.Messages = append(out.Messages, w.lead...)
+	for _, turn := range w.turns {
+		out.Messages = append(out.Messages, turn.messages...)
+	}
+	return out
+}
+
+// appendTextContent 在消息内容末尾追加一段文本（不修改原内容）
+func appendTextContent(content any, text string) any {
+	switch v := content.(type) {
+	case string:
+		return v + "\n\n" + text
+	case []any:
+		out := make([]any, 0, len(v)+1)
+		out = append(out, v...)
+		return append(out, map[string]any{"type": "text", "text": text})
+	case []types.ContentBlock:
+		out := make([]types.ContentBlock, 0, len(v)+1)
+		out = append(out, v...)
+		return append(out, types.ContentBlock{Type: "text", Text: &text})
+	default:
+		return content
+	}
+}
+
+// renderMessageForSummary 将消息渲染为摘要转录文本
+func renderMessageForSummary(msg types.AnthropicRequestMessage) string {
+	role := "User"
+	if msg.Role == "assistant" {
+		role = "Assistant"
+	}
+
+	blocks, ok := msg.Content.([]any)
+	if !ok {
+		text, _ := utils.GetMessageContent(msg.Content)
+		return role + ": " + text
+	}
+
+	var parts []string
+	for _, block := range blocks {
+		m, ok := block.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch m["type"] {
+		case "text":
+			if text, ok := m["text"].(string); ok && text != "" {
+				parts = append(parts, text)
+			}
+		case "tool_use":
+			input, _ := utils.SafeMarshal(m["input"])
+			parts = append(parts, fmt.Sprintf("[Called tool %v with input %s]", m["name"], truncateRunes(string(input), summaryToolInputMaxChars)))
+		case "tool_result":
+			result := utils.ParseToolResultContent(m["content"])
+			parts = append(parts, fmt.Sprintf("[Tool result: %s]", truncateRunes(result, summaryToolResultMaxChars)))
+		case "image":
+			parts = append(parts, "[Image]")
+		}
+	}
+	return role + ": " + strings.Join(parts, "\n")
+}
+
+// truncateRunes 按字符截断文本，超出部分以省略号表示
+func truncateRunes(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit]) + "..."
+}
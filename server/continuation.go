@@ -0,0 +1,372 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro/config"
+	"kiro/converter"
+	"kiro/parser"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// 续写触发原因
+const (
+	continueReasonContentLength = "content_length_exceeded"
+	continueReasonUnterminated  = "unterminated_tool_input"
+	continueReasonInterrupted   = "stream_interrupted"
+	continueReasonIdle          = "idle_timeout"
+	continueReasonPrunedTool    = "pruned_tool_requested"
+)
+
+const (
+	// continuationOverlapProbe 续写开头缓冲的字符数，用于去除模型重复输出的重叠部分
+	continuationOverlapProbe = 256
+	// continuationOverlapWindow 参与重叠比较的已输出文本尾部长度
+	continuationOverlapWindow = 1024
+	// continuationMinOverlap 最小重叠长度，过短的重叠可能是巧合，不做裁剪
+	continuationMinOverlap = 8
+)
+
+// continuationConfig 当前生效的自动续写配置
+var continuationConfig = config.LoadContinuationConfig()
+
+// initContinuation 按当前环境变量重新加载自动续写配置（.env 加载后调用）
+func initContinuation() {
+	continuationConfig = config.LoadContinuationConfig()
+}
+
+// partialToolUse 被截断的工具调用（续写时要求模型以相同前缀重新发起）
+type partialToolUse struct {
+	clientIndex   int    // 已发给客户端的块索引
+	id            string // 已发给客户端的 tool_use id
+	name          string
+	sent          string          // 已发给客户端的参数 JSON 前缀
+	upstreamIndex int             // 续写响应中对应工具的块索引（-1 表示尚未出现）
+	buf           strings.Builder // 续写参数缓冲，直到覆盖已发送前缀
+	matched       bool
+}
+
+// continuationState 自动续写状态
+// 设计原则：
+// - 原始响应与各次续写共用同一个 SSE 状态管理器，客户端看到的是一条连续的流
+// - 续写响应的块索引重新映射到客户端索引，文本去重叠，截断的工具参数按前缀拼接
+type continuationState struct {
+	maxContinuations int
+	count            int // 已发起的续写次数
+	segment          int // 当前处理的上游响应序号（0 为原始响应）
+
+	requestPrefill string                   // 原请求自带的 assistant prefill（参与重叠比较）
+	assistantText  strings.Builder          // 已发给客户端的文本（作为续写 prefill）
+	toolInput      map[int]*strings.Builder // 各工具块已发给客户端的参数 JSON
+	toolNames      map[int]string
+
+	interruptReason string              // 本段响应的中断原因（空表示正常结束）
+	completed       bool                // 本段是否收到上游的生成结束标记（计量/元数据事件）
+	pendingTimeout  *StreamTimeoutError // 看门狗中断时保留，续写失败后用于报错
+	prunedTool      string              // 模型请求的被裁剪工具名，续写失败后用于报错
+
+	// 续写段状态
+	indexMap    map[int]int // 上游块索引 -> 客户端块索引
+	overlapBuf  strings.Builder
+	overlapDone bool
+	stitchTool  *partialToolUse
+}
+
+// newContinuationState 创建自动续写状态
+func newContinuationState(requestPrefill string) *continuationState {
+	return &continuationState{
+		maxContinuations: continuationConfig.MaxContinuations,
+		requestPrefill:   requestPrefill,
+		toolInput:        make(map[int]*strings.Builder),
+		toolNames:        make(map[int]string),
+		indexMap:         make(map[int]int),
+	}
+}
+
+// canContinue 判断当前中断能否续写
+// 已有完整工具调用的回合不续写：续写请求无法在不提供 tool_result 的情况下回放这些调用
+func (ctx *StreamProcessorContext) canContinue() bool {
+	cs := ctx.continuation
+	return cs.interruptReason == "" &&
+		cs.count < cs.maxContinuations &&
+		len(ctx.completedToolUseIds) == 0 &&
+		ctx.totalProcessedEvents > 0
+}
+
+// hasPartialOutput 判断本轮是否有可续写的残留输出：未结束的工具块或非空的文本尾部
+func (ctx *StreamProcessorContext) hasPartialOutput() bool {
+	return len(ctx.toolUseIdByBlockIndex) > 0 ||
+		strings.TrimSpace(ctx.continuation.assistantText.String()) != ""
+}
+
+// markInterrupted 记录中断原因，等待续写
+func (ctx *StreamProcessorContext) markInterrupted(reason string) {
+	ctx.continuation.interruptReason = reason
+	utils.Info("上游生成中断，准备续写: reason=%s, request_id=%s, continuation=%d/%d",
+		reason, GetRequestID(ctx.c), ctx.continuation.count+1, ctx.continuation.maxContinuations)
+}
+
+// recordText 记录已发给客户端的文本
+func (ctx *StreamProcessorContext) recordText(text string) {
+	ctx.continuation.assistantText.WriteString(text)
+}
+
+// recordToolInput 记录已发给客户端的工具参数片段
+func (ctx *StreamProcessorContext) recordToolInput(index int, partialJSON string) {
+	b, ok := ctx.continuation.toolInput[index]
+	if !ok {
+		b = &strings.Builder{}
+		ctx.continuation.toolInput[index] = b
+	}
+	b.WriteString(partialJSON)
+}
+
+// unterminatedTool 返回尚未结束的工具调用（取索引最大的一个）
+func (ctx *StreamProcessorContext) unterminatedTool() *partialToolUse {
+	var tool *partialToolUse
+	for index, id := range ctx.toolUseIdByBlockIndex {
+		if tool != nil && index < tool.clientIndex {
+			continue
+		}
+		sent := ""
+		if b, ok := ctx.continuation.toolInput[index]; ok {
+			sent = b.String()
+		}
+		tool = &partialToolUse{
+			clientIndex:   index,
+			id:            id,
+			name:          ctx.continuation.toolNames[index],
+			sent:          sent,
+			upstreamIndex: -1,
+		}
+	}
+	return tool
+}
+
+// requestContinuation 发起续写请求，返回新的上游响应
+func (ctx *StreamProcessorContext) requestContinuation() (*http.Response, error) {
+	cs := ctx.continuation
+	tool := ctx.unterminatedTool()
+	contReq := buildContinuationRequest(ctx.req, cs.assistantText.String(), tool)
+
+	cs.count++
+	utils.Info("发起续写请求: reason=%s, request_id=%s, continuation=%d/%d, prefill_len=%d",
+		cs.interruptReason, GetRequestID(ctx.c), cs.count, cs.maxContinuations, cs.assistantText.Len())
+
+	resp, err := execCWRequest(ctx.c, contReq, ctx.token, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// 进入新的续写段：重置解析器与拼接状态
+	cs.segment++
+	cs.interruptReason = ""
+	cs.pendingTimeout = nil
+	cs.completed = false
+	cs.indexMap = make(map[int]int)
+	cs.overlapBuf.Reset()
+	cs.overlapDone = cs.assistantText.Len() == 0 && cs.requestPrefill == ""
+	cs.stitchTool = tool
+	ctx.compliantParser = parser.NewCompliantEventStreamParser()
+	return resp, nil
+}
+
+// buildContinuationRequest 构造续写请求：已输出内容作为 assistant prefill，再追加续写指令
+func buildContinuationRequest(req types.AnthropicRequest, partialText string, tool *partialToolUse) types.AnthropicRequest {
+	// 原请求自带 assistant prefill 时，与已输出内容合并为同一条 prefill
+	messages := req.Messages
+	requestPrefill := converter.AssistantPrefill(messages)
+	if requestPrefill != "" {
+		messages = messages[:len(messages)-1]
+	}
+
+	contReq := req
+	contReq.Messages = make([]types.AnthropicRequestMessage, 0, len(messages)+2)
+	contReq.Messages = append(contReq.Messages, messages...)
+
+	prefill := requestPrefill + partialText
+	var instruction string
+	if tool != nil && tool.name != "" {
+		if strings.TrimSpace(prefill) == "" {
+			prefill = fmt.Sprintf("I'll call the `%s` tool.", converter.ToolAlias(tool.name))
+		}
+		// 模型看到的是上游别名
+		alias := converter.ToolAlias(tool.name)
+		instruction = fmt.Sprintf("Your previous response was interrupted while you were writing the input of a `%s` tool call. "+
+			"Call the `%s` tool again now. Its JSON input must start with exactly the following characters, unchanged, "+
+			"and then continue until the input is complete. Do not write any text before the tool call.\n\n%s",
+			alias, alias, tool.sent)
+	} else if strings.TrimSpace(prefill) == "" {
+		// 尚未输出任何文本，直接重试原请求
+		return req
+	} else {
+		instruction = "Your previous response was interrupted before it was finished. " +
+			"Continue writing exactly from the point where it stopped. Do not repeat any text that was already written, " +
+			"do not restart, and do not add any commentary about the interruption."
+	}
+
+	contReq.Messages = append(contReq.Messages,
+		types.AnthropicRequestMessage{Role: "assistant", Content: prefill},
+		types.AnthropicRequestMessage{Role: "user", Content: instruction},
+	)
+	return contReq
+}
+
+// trimOverlap 去除续写开头与已输出文本尾部重叠的部分
+func trimOverlap(emitted, next string) string {
+	tail := emitted
+	if len(tail) > continuationOverlapWindow {
+		tail = tail[len(tail)-continuationOverlapWindow:]
+	}
+	for k := min(len(tail), len(next)); k >= continuationMinOverlap; k-- {
+		if strings.HasSuffix(tail, next[:k]) {
+			return next[k:]
+		}
+	}
+	return next
+}
+
+// stitchContinuationEvent 处理续写段的事件：重映射块索引、去重叠、拼接截断的工具参数
+// 返回 skip=true 表示该事件已被吸收，不需要继续处理
+func (esp *EventStreamProcessor) stitchContinuationEvent(dataMap map[string]any) (skip bool, err error) {
+	cs := esp.ctx.continuation
+	ssm := esp.ctx.sseStateManager
+	eventType, _ := dataMap["type"].(string)
+	index := extractIndex(dataMap)
+
+	switch eventType {
+	case "content_block_start":
+		cb, _ := dataMap["content_block"].(map[string]any)
+		blockType, _ := cb["type"].(string)
+		if blockType == "tool_use" {
+			if st := cs.stitchTool; st != nil && st.upstreamIndex < 0 && esp.ctx.toolNames.Original(getStringField(cb, "name")) == st.name {
+				// 重新发起的截断工具：并入客户端已有的块，不再发送 start
+				st.upstreamIndex = index
+				cs.indexMap[index] = st.clientIndex
+				return true, nil
+			}
+		}
+		if _, mapped := cs.indexMap[index]; !mapped {
+			cs.indexMap[index] = ssm.AllocateBlockIndex()
+		}
+		dataMap["index"] = cs.indexMap[index]
+		return false, nil
+
+	case "content_block_delta":
+		delta, _ := dataMap["delta"].(map[string]any)
+		deltaType, _ := delta["type"].(string)
+
+		switch deltaType {
+		case "text_delta":
+			text, _ := delta["text"].(string)
+			if text == "" {
+				return true, nil
+			}
+			if !cs.overlapDone {
+				cs.overlapBuf.WriteString(text)
+				if cs.overlapBuf.Len() < continuationOverlapProbe {
+					return true, nil
+				}
+				text = cs.resolveOverlap()
+				if text == "" {
+					return true, nil
+				}
+				delta["text"] = text
+			}
+
+		case "input_json_delta":
+			if st := cs.stitchTool; st != nil && index == st.upstreamIndex && !st.matched {
+				partialJSON, _ := delta["partial_json"].(string)
+				st.buf.WriteString(partialJSON)
+				if st.buf.Len() < len(st.sent) {
+					return true, nil
+				}
+				full := st.buf.String()
+				if !strings.HasPrefix(full, st.sent) {
+					return true, esp.abortStream("api_error",
+						"The upstream response was interrupted and the continuation could not be stitched to the partial tool input")
+				}
+				st.matched = true
+				if full[len(st.sent):] == "" {
+					return true, nil
+				}
+				delta["partial_json"] = full[len(st.sent):]
+			}
+		}
+
+		dataMap["index"] = esp.continuationTargetIndex(index, deltaType)
+		return false, nil
+
+	case "content_block_stop":
+		if st := cs.stitchTool; st != nil && index == st.upstreamIndex && !st.matched {
+			// 续写的工具参数比已发送的前缀还短，无法拼接
+			return true, esp.abortStream("api_error",
+				"The upstream response was interrupted and the continuation could not be stitched to the partial tool input")
+		}
+		mapped, ok := cs.indexMap[index]
+		if !ok {
+			return true, nil
+		}
+		dataMap["index"] = mapped
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// continuationTargetIndex 计算续写段增量事件的客户端索引
+// 文本增量优先并入客户端仍在输出的文本块，实现无缝衔接
+func (esp *EventStreamProcessor) continuationTargetIndex(index int, deltaType string) int {
+	cs := esp.ctx.continuation
+	if mapped, ok := cs.indexMap[index]; ok {
+		return mapped
+	}
+
+	target := -1
+	if deltaType == "text_delta" {
+		for blockIndex, block := range esp.ctx.sseStateManager.GetActiveBlocks() {
+			if block.Type == "text" && block.Started && !block.Stopped && blockIndex > target {
+				target = blockIndex
+			}
+		}
+	}
+	if target < 0 {
+		target = esp.ctx.sseStateManager.AllocateBlockIndex()
+	}
+	cs.indexMap[index] = target
+	return target
+}
+
+// resolveOverlap 结束重叠缓冲，返回去重后的文本
+func (cs *continuationState) resolveOverlap() string {
+	cs.overlapDone = true
+	text := trimOverlap(cs.requestPrefill+cs.assistantText.String(), cs.overlapBuf.String())
+	cs.overlapBuf.Reset()
+	return text
+}
+
+// flushContinuationOverlap 续写段结束时输出尚在重叠缓冲中的文本
+func (esp *EventStreamProcessor) flushContinuationOverlap() error {
+	cs := esp.ctx.continuation
+	if cs.segment == 0 || cs.overlapDone {
+		return nil
+	}
+	text := cs.resolveOverlap()
+	if text == "" {
+		return nil
+	}
+	return esp.processEvent(parser.SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]any{
+				"type": "text_delta",
+				"text": text,
+			},
+		},
+	})
+}
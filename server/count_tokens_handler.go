@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"kiro/converter"
 	"kiro/types"
 	"kiro/utils"
 
@@ -24,30 +25,46 @@ func handleCountTokens(c *gin.Context) {
 			addReqFields(c,
 				utils.LogErr(err),
 			)...)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"type":    "invalid_request_error",
-				"message": fmt.Sprintf("Invalid request body: %v", err),
-			},
-		})
+		respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
+	// 虚拟模型预设：按基础模型、system 前缀与工具过滤后的输入计数
+	req = applyModelPresetToCount(req)
+
 	// 验证模型参数（支持所有Claude模型）
 	if !utils.IsValidClaudeModel(req.Model) {
 		utils.Log("无效的模型参数",
 			addReqFields(c,
 				utils.LogString("model", req.Model),
 			)...)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"type":    "invalid_request_error",
-				"message": fmt.Sprintf("Invalid model: %s", req.Model),
-			},
-		})
+		respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Invalid model: %s", req.Model))
+		return
+	}
+
+	// URL 图片与文档来源按下载后的内容计数
+	resolved, err := resolveURLSources(c.Request.Context(), req.Messages)
+	if err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	req.Messages = resolved
+	if err := checkFileSources(fileOwner(c), req.Messages); err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 		return
 	}
 
+	// 启用 citations 的文档按分块后的文本计数
+	messages, index, err := converter.PrepareCitations(req.Messages)
+	if err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if index != nil {
+		req.Messages = messages
+		req.System = withCitationInstruction(req.System)
+	}
+
 	// 创建token估算器
 	estimator := utils.NewTokenEstimator()
 
@@ -2,9 +2,10 @@ package server
 
 import (
 	"encoding/json"
-	"fmt"
 	"kiro/utils"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,12 +21,35 @@ type ClaudeErrorResponse struct {
 	Type       string `json:"type"`
 	Message    string `json:"message"`
 	StopReason string `json:"stop_reason,omitempty"` // 用于内容长度超限等情况
+	StatusCode int    `json:"-"`                     // 返回给客户端的 HTTP 状态码
 }
 
 // CodeWhispererErrorBody AWS CodeWhisperer错误响应体
 type CodeWhispererErrorBody struct {
-	Message string `json:"message"`
-	Reason  string `json:"reason"`
+	ErrorType string `json:"__type"` // 如 com.amazon.aws.codewhisperer#ThrottlingException
+	Message   string `json:"message"`
+	Reason    string `json:"reason"`
+}
+
+// parseCodeWhispererErrorBody 解析上游错误响应体，非 JSON 时以原文作为消息
+func parseCodeWhispererErrorBody(responseBody []byte) CodeWhispererErrorBody {
+	var errorBody CodeWhispererErrorBody
+	if err := json.Unmarshal(responseBody, &errorBody); err != nil || errorBody.Message == "" {
+		errorBody.Message = strings.TrimSpace(string(responseBody))
+	}
+	return errorBody
+}
+
+// ExceptionName 返回不带命名空间的异常名（如 ThrottlingException）
+func (b CodeWhispererErrorBody) ExceptionName() string {
+	name := b.ErrorType
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
 }
 
 // ContentLengthExceedsStrategy 内容长度超限错误映射策略 (SRP原则)
@@ -47,6 +71,7 @@ func (s *ContentLengthExceedsStrategy) MapError(statusCode int, responseBody []b
 			Type:       "message_delta", // 按Claude规范发送message_delta事件
 			StopReason: "max_tokens",    // 映射为max_tokens stop_reason
 			Message:    "Content length exceeds threshold, response truncated",
+			StatusCode: http.StatusBadRequest,
 		}, true
 	}
 
@@ -57,13 +82,56 @@ func (s *ContentLengthExceedsStrategy) GetErrorType() string {
 	return "content_length_exceeds"
 }
 
+// UpstreamExceptionStrategy 按上游异常类型映射为 Anthropic 错误类型 (OCP原则)
+// 优先按异常名与 reason 匹配；上游未返回异常名时按 HTTP 状态码匹配
+type UpstreamExceptionStrategy struct {
+	name       string   // 策略名（日志用）
+	exceptions []string // 上游异常名
+	reasons    []string // reason 中包含的关键字
+	statuses   []int    // 无异常名时匹配的上游状态码
+	errorType  string   // Anthropic 错误类型
+	httpStatus int      // 返回给客户端的 HTTP 状态码
+}
+
+func (s *UpstreamExceptionStrategy) MapError(statusCode int, responseBody []byte) (*ClaudeErrorResponse, bool) {
+	errorBody := parseCodeWhispererErrorBody(responseBody)
+	exception := errorBody.ExceptionName()
+
+	matched := slices.Contains(s.exceptions, exception)
+	for _, reason := range s.reasons {
+		matched = matched || strings.Contains(strings.ToUpper(errorBody.Reason), reason)
+	}
+	if !matched && exception == "" {
+		matched = slices.Contains(s.statuses, statusCode)
+	}
+	if !matched {
+		return nil, false
+	}
+
+	return &ClaudeErrorResponse{
+		Type:       s.errorType,
+		Message:    errorBody.Message,
+		StatusCode: s.httpStatus,
+	}, true
+}
+
+func (s *UpstreamExceptionStrategy) GetErrorType() string {
+	return s.name
+}
+
 // DefaultErrorStrategy 默认错误映射策略 (YAGNI原则)
+// 按上游状态码选择最接近的 Anthropic 错误类型
 type DefaultErrorStrategy struct{}
 
 func (s *DefaultErrorStrategy) MapError(statusCode int, responseBody []byte) (*ClaudeErrorResponse, bool) {
+	errorType := anthropicErrorType(statusCode)
+	if errorType == "api_error" {
+		statusCode = http.StatusInternalServerError
+	}
 	return &ClaudeErrorResponse{
-		Type:    "error",
-		Message: fmt.Sprintf("Upstream error: %s", string(responseBody)),
+		Type:       errorType,
+		Message:    parseCodeWhispererErrorBody(responseBody).Message,
+		StatusCode: statusCode,
 	}, true
 }
 
@@ -81,7 +149,44 @@ func NewErrorMapper() *ErrorMapper {
 	return &ErrorMapper{
 		strategies: []ErrorMappingStrategy{
 			&ContentLengthExceedsStrategy{}, // 优先处理特定错误
-			&DefaultErrorStrategy{},         // 默认处理器
+			&UpstreamExceptionStrategy{
+				// 额度耗尽属于账号用量限制，按 rate_limit_error 返回，与 Anthropic 的用量超限语义一致
+				name:       "quota_exceeded",
+				exceptions: []string{"ServiceQuotaExceededException"},
+				reasons:    []string{"QUOTA", "MONTHLY_REQUEST_COUNT"},
+				statuses:   []int{http.StatusPaymentRequired},
+				errorType:  "rate_limit_error",
+				httpStatus: http.StatusTooManyRequests,
+			},
+			&UpstreamExceptionStrategy{
+				name:       "throttling",
+				exceptions: []string{"ThrottlingException", "TooManyRequestsException"},
+				statuses:   []int{http.StatusTooManyRequests},
+				errorType:  "rate_limit_error",
+				httpStatus: http.StatusTooManyRequests,
+			},
+			&UpstreamExceptionStrategy{
+				name:       "validation",
+				exceptions: []string{"ValidationException"},
+				statuses:   []int{http.StatusBadRequest},
+				errorType:  "invalid_request_error",
+				httpStatus: http.StatusBadRequest,
+			},
+			&UpstreamExceptionStrategy{
+				name:       "access_denied",
+				exceptions: []string{"AccessDeniedException"},
+				statuses:   []int{http.StatusForbidden},
+				errorType:  "permission_error",
+				httpStatus: http.StatusForbidden,
+			},
+			&UpstreamExceptionStrategy{
+				name:       "service_unavailable",
+				exceptions: []string{"ServiceUnavailableException"},
+				statuses:   []int{http.StatusServiceUnavailable},
+				errorType:  "overloaded_error",
+				httpStatus: 529,
+			},
+			&DefaultErrorStrategy{}, // 默认处理器
 		},
 	}
 }
@@ -102,8 +207,9 @@ func (em *ErrorMapper) MapCodeWhispererError(statusCode int, responseBody []byte
 
 	// 理论上不会到达这里，因为DefaultErrorStrategy总是返回true
 	return &ClaudeErrorResponse{
-		Type:    "error",
-		Message: "Unknown error",
+		Type:       "api_error",
+		Message:    "Unknown upstream error",
+		StatusCode: http.StatusInternalServerError,
 	}
 }
 
@@ -153,7 +259,7 @@ func (em *ErrorMapper) sendStandardError(c *gin.Context, claudeError *ClaudeErro
 	errorResp := map[string]any{
 		"type": "error",
 		"error": map[string]any{
-			"type":    "overloaded_error",
+			"type":    claudeError.Type,
 			"message": claudeError.Message,
 		},
 	}
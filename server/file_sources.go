@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// checkFileSources 校验消息中引用的 Files API 文件
+// 文件必须存在且属于当前 API Key，类型与内容块匹配；文件内容在格式转换时读取
+func checkFileSources(owner string, messages []types.AnthropicRequestMessage) error {
+	for i, msg := range messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		if err := checkBlockFileSources(owner, fmt.Sprintf("messages.%d.content", i), blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBlockFileSources 校验内容块数组（包括 tool_result 中的图片）
+func checkBlockFileSources(owner, path string, blocks []any) error {
+	for j, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		blockPath := fmt.Sprintf("%s.%d", path, j)
+		blockType, _ := block["type"].(string)
+
+		if blockType == "tool_result" {
+			if content, ok := block["content"].([]any); ok {
+				if err := checkBlockFileSources(owner, blockPath+".content", content); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if blockType != "image" && blockType != "document" {
+			continue
+		}
+		source, _ := block["source"].(map[string]any)
+		if source["type"] != "file" {
+			continue
+		}
+
+		fileID, _ := source["file_id"].(string)
+		if fileID == "" {
+			return fmt.Errorf("%s.source.file_id: Field required", blockPath)
+		}
+		meta, err := utils.Files().Get(owner, fileID)
+		if err != nil {
+			return fmt.Errorf("%s.source.file_id: File not found: %s", blockPath, fileID)
+		}
+		switch {
+		case blockType == "image" && !utils.IsSupportedImageFormat(meta.MimeType):
+			return fmt.Errorf("%s.source.file_id: file %s is %s, not a supported image", blockPath, fileID, meta.MimeType)
+		case blockType == "document" && meta.MimeType != "application/pdf" && !utils.IsTextMediaType(meta.MimeType):
+			return fmt.Errorf("%s.source.file_id: file %s is %s, documents must be PDF or plain text", blockPath, fileID, meta.MimeType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead 上传请求体中 multipart 边界与表单字段的额外字节
+const multipartOverhead = 1 << 20
+
+// registerFileRoutes 注册 Files API 端点（需在 AuthMiddleware 之后）
+func registerFileRoutes(r *gin.Engine) {
+	r.POST("/v1/files", handleUploadFile)
+	r.GET("/v1/files", handleListFiles)
+	r.GET("/v1/files/:file_id", handleGetFile)
+	r.GET("/v1/files/:file_id/content", handleDownloadFile)
+	r.DELETE("/v1/files/:file_id", handleDeleteFile)
+}
+
+// fileOwner 当前请求的文件归属（客户端 API Key 的哈希）
+func fileOwner(c *gin.Context) string {
+	return utils.FileOwner(c.GetString("refreshToken"))
+}
+
+// handleUploadFile 上传文件（multipart/form-data，字段名 file）
+// 请求体以流的方式写入磁盘，不会整体读入内存
+func handleUploadFile(c *gin.Context) {
+	store := utils.Files()
+	if !store.Enabled() {
+		respondFileError(c, utils.ErrFilesDisabled)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, store.MaxFileBytes()+multipartOverhead)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		respondStatusError(c, http.StatusBadRequest, "Request body must be multipart/form-data with a \"file\" field")
+		return
+	}
+	part, err := nextFilePart(reader)
+	if err != nil {
+		respondStatusError(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	defer part.Close()
+
+	meta, err := store.Create(fileOwner(c), part.FileName(), part.Header.Get("Content-Type"), part)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondStatusError(c, http.StatusRequestEntityTooLarge, "file exceeds the maximum size of %d bytes", store.MaxFileBytes())
+			return
+		}
+		respondFileError(c, err)
+		return
+	}
+
+	utils.Info("文件已上传: file_id=%s, mime_type=%s, size=%d, request_id=%s", meta.ID, meta.MimeType, meta.SizeBytes, GetRequestID(c))
+	c.JSON(http.StatusOK, fileObject(meta))
+}
+
+// nextFilePart 找到名为 file 的表单字段
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("file: Field required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %v", err)
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// handleListFiles 列出当前 API Key 的文件（按创建时间倒序，支持 limit/after_id/before_id）
+func handleListFiles(c *gin.Context) {
+	limit := 20
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			respondStatusError(c, http.StatusBadRequest, "limit: must be an integer between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	files, hasMore := utils.Files().List(fileOwner(c), limit, c.Query("after_id"), c.Query("before_id"))
+	resp := types.FileListResponse{Data: make([]types.FileObject, 0, len(files)), HasMore: hasMore}
+	for _, meta := range files {
+		resp.Data = append(resp.Data, fileObject(meta))
+	}
+	if len(files) > 0 {
+		resp.FirstID = &files[0].ID
+		resp.LastID = &files[len(files)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleGetFile 返回文件元数据
+func handleGetFile(c *gin.Context) {
+	meta, err := utils.Files().Get(fileOwner(c), c.Param("file_id"))
+	if err != nil {
+		respondFileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fileObject(meta))
+}
+
+// handleDownloadFile 下载文件内容
+func handleDownloadFile(c *gin.Context) {
+	store := utils.Files()
+	meta, err := store.Get(fileOwner(c), c.Param("file_id"))
+	if err != nil {
+		respondFileError(c, err)
+		return
+	}
+	f, err := store.Open(meta.ID)
+	if err != nil {
+		respondFileError(c, err)
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", meta.MimeType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(meta.Filename)))
+	http.ServeContent(c.Writer, c.Request, meta.Filename, meta.CreatedAt, f)
+}
+
+// handleDeleteFile 删除文件
+func handleDeleteFile(c *gin.Context) {
+	id := c.Param("file_id")
+	if err := utils.Files().Delete(fileOwner(c), id); err != nil {
+		respondFileError(c, err)
+		return
+	}
+	utils.Info("文件已删除: file_id=%s, request_id=%s", id, GetRequestID(c))
+	c.JSON(http.StatusOK, types.FileDeletedResponse{ID: id, Type: "file_deleted"})
+}
+
+// respondFileError 按错误类型返回 Files API 错误
+func respondFileError(c *gin.Context, err error) {
+	var limitErr *utils.FileLimitError
+	switch {
+	case errors.Is(err, utils.ErrFileNotFound):
+		respondStatusError(c, http.StatusNotFound, "File not found: %s", c.Param("file_id"))
+	case errors.Is(err, utils.ErrFilesDisabled):
+		respondStatusError(c, http.StatusNotFound, "%v", err)
+	case errors.As(err, &limitErr):
+		respondStatusError(c, http.StatusRequestEntityTooLarge, "%v", err)
+	default:
+		utils.Error("Files API 操作失败: %v, request_id=%s", err, GetRequestID(c))
+		respondStatusError(c, http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// fileObject 转换为 API 响应格式
+func fileObject(meta *utils.StoredFile) types.FileObject {
+	return types.FileObject{
+		ID:           meta.ID,
+		Type:         "file",
+		Filename:     meta.Filename,
+		MimeType:     meta.MimeType,
+		SizeBytes:    meta.SizeBytes,
+		CreatedAt:    meta.CreatedAt,
+		Downloadable: true,
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"kiro/cache"
 	"kiro/config"
+	"kiro/converter"
 
 	"kiro/parser"
 	"kiro/types"
@@ -82,11 +83,19 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 			return
 		}
 		// 上游请求失败，返回 HTTP 错误（不建立 SSE 连接）
+		var circuitErr *CircuitOpenError
+		var limitErr *ConcurrencyLimitError
 		var upstreamErr *UpstreamError
-		if errors.As(err, &upstreamErr) {
-			respondErrorWithCode(c, upstreamErr.StatusCode, "upstream_error", "%s", upstreamErr.Message)
+		if errors.As(err, &circuitErr) {
+			respondCircuitOpen(c, circuitErr)
+		} else if errors.As(err, &limitErr) {
+			respondConcurrencyLimit(c, limitErr)
+		} else if c.Request.Context().Err() != nil {
+			// 客户端已断开，无需响应
+		} else if errors.As(err, &upstreamErr) {
+			respondUpstreamError(c, upstreamErr)
 		} else {
-			respondError(c, http.StatusBadGateway, "%s", err.Error())
+			respondStatusError(c, http.StatusBadGateway, "%s", err.Error())
 		}
 		return
 	}
@@ -95,7 +104,7 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 	// 上游成功，初始化 SSE 响应
 	if err := initializeSSEResponse(c); err != nil {
 		resp.Body.Close()
-		respondError(c, http.StatusInternalServerError, "连接不支持SSE: %v", err)
+		respondStatusError(c, http.StatusInternalServerError, "Streaming is not supported by this connection: %v", err)
 		return
 	}
 
@@ -108,11 +117,26 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 		return
 	}
 
-	// 处理事件流
+	// 处理事件流（上游生成中断时自动续写，拼接为同一条流）
 	processor := NewEventStreamProcessor(ctx)
-	if err := processor.ProcessEventStream(resp.Body); err != nil {
-		utils.Log("事件流处理失败", utils.LogErr(err))
-		return
+	body := resp.Body
+	for {
+		if err := processor.ProcessEventStream(body); err != nil {
+			utils.Log("事件流处理失败", utils.LogErr(err))
+			return
+		}
+		body.Close()
+
+		contResp, err := processor.ContinueOrFinish()
+		if err != nil {
+			utils.Log("事件流处理失败", utils.LogErr(err))
+			return
+		}
+		if contResp == nil {
+			break
+		}
+		body = contResp.Body
+		defer body.Close()
 	}
 
 	// 发送结束事件
@@ -169,7 +193,7 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 }
 
 // createAnthropicFinalEvents 创建Anthropic流式结束事件
-func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string, cacheResult *cache.CacheResult) []map[string]any {
+func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason, stopSequence string, cacheResult *cache.CacheResult) []map[string]any {
 	// 计算实际 input_tokens（扣除 cache_read）
 	actualInputTokens := inputTokens
 	if cacheResult != nil && cacheResult.CacheReadTokens > 0 {
@@ -189,7 +213,7 @@ func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string
 			"type": "message_delta",
 			"delta": map[string]any{
 				"stop_reason":   stopReason,
-				"stop_sequence": nil,
+				"stop_sequence": stopSequenceValue(stopSequence),
 			},
 			"usage": map[string]any{
 				"output_tokens": outputTokens,
@@ -227,40 +251,33 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		_ = Body.Close()
 	}(resp.Body)
 
-	// 读取响应体
-	body, err := utils.ReadHTTPResponse(resp.Body)
+	// 读取响应体（看门狗限制首字节、读取间隔与总时长）
+	watchdog := NewStreamWatchdog(resp.Body, streamWatchdogConfig)
+	body, err := utils.ReadHTTPResponse(&watchdogReader{r: resp.Body, wd: watchdog})
+	watchdog.Stop()
 	if err != nil {
+		if timeoutErr := watchdog.Err(); timeoutErr != nil {
+			c.Set("stream_abort_reason", timeoutErr.Reason)
+			utils.Error("上游响应被看门狗中断: reason=%s, request_id=%s", timeoutErr.Reason, GetRequestID(c))
+			respondAnthropicError(c, http.StatusGatewayTimeout, "timeout_error", timeoutErr.Error())
+			return
+		}
 		handleResponseReadError(c, err)
 		return
 	}
 
-	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
+	// 使用新的符合AWS规范的解析器
 	compliantParser := parser.NewCompliantEventStreamParser()
 	compliantParser.SetMaxErrors(config.ParserMaxErrors) // 限制最大错误次数以防死循环
 
-	// 为非流式解析添加超时保护
-	result, err := func() (*parser.ParseResult, error) {
-		done := make(chan struct{})
-		var result *parser.ParseResult
-		var err error
-
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("解析器panic: %v", r)
-				}
-				close(done)
-			}()
-			result, err = compliantParser.ParseResponse(body)
+	// 响应体已完整读入内存，解析无需超时保护，仅兜底 panic
+	result, err := func() (result *parser.ParseResult, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("解析器panic: %v", r)
+			}
 		}()
-
-		select {
-		case <-done:
-			return result, err
-		case <-time.After(600 * time.Second): // 600秒超时
-			utils.Log("非流式解析超时")
-			return nil, fmt.Errorf("解析超时")
-		}
+		return compliantParser.ParseResponse(body)
 	}()
 
 	if err != nil {
@@ -269,30 +286,20 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 			utils.LogString("model", anthropicReq.Model),
 			utils.LogInt("response_size", len(body)))
 
-		// 提供更详细的错误信息和建议
-		errorResp := gin.H{
-			"error":   "响应解析失败",
-			"type":    "parsing_error",
-			"message": "无法解析AWS CodeWhisperer响应格式",
-		}
-
 		// 根据错误类型提供不同的HTTP状态码
-		statusCode := http.StatusInternalServerError
-		if strings.Contains(err.Error(), "解析超时") {
-			statusCode = http.StatusRequestTimeout
-			errorResp["message"] = "请求处理超时，请稍后重试"
-		} else if strings.Contains(err.Error(), "格式错误") {
-			statusCode = http.StatusBadRequest
-			errorResp["message"] = "请求格式不正确"
+		if strings.Contains(err.Error(), "格式错误") {
+			respondStatusError(c, http.StatusBadRequest, "%s", "Malformed request")
+			return
 		}
-
-		c.JSON(statusCode, errorResp)
+		respondStatusError(c, http.StatusBadGateway, "%s", "Failed to parse upstream response")
 		return
 	}
 
 	// 转换为Anthropic格式
 	var contexts []map[string]any
 	textAgg := result.GetCompletionText()
+	// assistant prefill：只返回 prefill 之后的续写内容
+	textAgg = stripPrefillEcho(converter.AssistantPrefill(anthropicReq.Messages), textAgg)
 
 	// 检查是否启用了 thinking 模式
 	thinkingEnabled := anthropicReq.Thinking != nil && anthropicReq.Thinking.Type == "enabled"
@@ -311,6 +318,22 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		allTools = append(allTools, tool)
 	}
 
+	// 上游返回的是工具别名，需还原为客户端定义的原始名称
+	toolNames := converter.NewToolNameMapper(anthropicReq.Tools, anthropicReq.Messages)
+
+	// 模型请求了被裁剪的工具：关闭裁剪，以完整工具集重试一次（重试时不再裁剪，不会重复触发）
+	for _, tool := range allTools {
+		name := toolNames.Original(tool.Name)
+		if !isPrunedTool(c, name) {
+			continue
+		}
+		utils.Info("模型请求了被裁剪的工具，以完整工具集重试: tool=%s, request_id=%s", name, GetRequestID(c))
+		disableToolPruning(c)
+		_ = resp.Body.Close() // 先释放并发槽位，再发起重试
+		handleNonStreamRequest(c, anthropicReq, token)
+		return
+	}
+
 	// 基于实际工具数量判断是否包含工具调用
 	sawToolUse := len(allTools) > 0
 
@@ -322,6 +345,8 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	// 	)...)
 
 	// 添加文本内容（如果启用 thinking 模式，需要提取 thinking 块）
+	// 文本中命中 stop_sequences 时在该处截断，之后的工具调用一并丢弃
+	stopSequence := ""
 	if textAgg != "" {
 		if thinkingEnabled {
 			// 提取 thinking 内容
@@ -340,20 +365,23 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 			}
 
 			// 添加清理后的文本（如果有）
+			cleanText, stopSequence = cutAtStopSequence(cleanText, anthropicReq.StopSequences)
 			if cleanText != "" {
-				contexts = append(contexts, map[string]any{
-					"type": "text",
-					"text": cleanText,
-				})
+				contexts = append(contexts, citedTextBlocks(citationIndex(c), cleanText)...)
 			}
 		} else {
 			// 非 thinking 模式，直接添加文本
-			contexts = append(contexts, map[string]any{
-				"type": "text",
-				"text": textAgg,
-			})
+			textAgg, stopSequence = cutAtStopSequence(textAgg, anthropicReq.StopSequences)
+			if textAgg != "" {
+				// 启用 citations 时按 <cite> 标记拆分为带引用的文本块
+				contexts = append(contexts, citedTextBlocks(citationIndex(c), textAgg)...)
+			}
 		}
 	}
+	if stopSequence != "" {
+		allTools = nil
+		sawToolUse = false
+	}
 
 	// 添加工具调用
 	// 工具已经在前面从toolManager获取到allTools中
@@ -372,7 +400,7 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		toolUseBlock := map[string]any{
 			"type":  "tool_use",
 			"id":    tool.ID,
-			"name":  tool.Name,
+			"name":  toolNames.Original(tool.Name),
 			"input": tool.Arguments,
 		}
 
@@ -435,6 +463,9 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 
 	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
 	stopReason := stopReasonManager.DetermineStopReason()
+	if stopSequence != "" {
+		stopReason = "stop_sequence"
+	}
 
 	// utils.Log("非流式响应stop_reason决策",
 	// 	utils.LogString("stop_reason", stopReason),
@@ -464,13 +495,17 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 
 	anthropicResp := map[string]any{
 		"content":       contexts,
-		"model":         anthropicReq.Model,
+		"model":         responseModel(c, anthropicReq.Model),
 		"role":          "assistant",
 		"stop_reason":   stopReason,
-		"stop_sequence": nil,
+		"stop_sequence": stopSequenceValue(stopSequence),
 		"type":          "message",
 		"usage":         usageMap,
 	}
+	// 扩展字段：上游的代码引用、网页链接与后续提示
+	if metadata := result.GetUpstreamMetadata(); !metadata.IsEmpty() {
+		anthropicResp["upstream_metadata"] = metadata
+	}
 
 	// utils.Log("非流式响应最终数据",
 	// 	utils.LogString("stop_reason", stopReason),
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"crypto/subtle"
 	"net/http"
+	"os"
 	"strings"
 
 	"kiro/utils"
@@ -26,12 +28,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		if token == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": gin.H{
-					"type":    "authentication_error",
-					"message": "Missing authentication. Provide Authorization header or x-api-key",
-				},
-			})
+			respondAnthropicError(c, http.StatusUnauthorized, "authentication_error", "Missing authentication. Provide Authorization header or x-api-key")
 			c.Abort()
 			return
 		}
@@ -40,12 +37,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		accessToken, err := GetOrRefreshToken(token)
 		if err != nil {
 			utils.Error("Token 认证失败: %v", err)
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": gin.H{
-					"type":    "authentication_error",
-					"message": "Identity verification fails, please check its validity",
-				},
-			})
+			respondAnthropicError(c, http.StatusUnauthorized, "authentication_error", "Identity verification fails, please check its validity")
 			c.Abort()
 			return
 		}
@@ -53,6 +45,34 @@ func AuthMiddleware() gin.HandlerFunc {
 		// 将 access token 和原始 refresh token 存入上下文
 		c.Set("accessToken", accessToken)
 		c.Set("refreshToken", token)
+		c.Set("accountID", AccountID(token))
+		c.Next()
+	}
+}
+
+/**
+ * AdminAuthMiddleware 管理端点认证，校验 ADMIN_API_KEY
+ * 未配置 ADMIN_API_KEY 时管理端点不可用（返回 404）
+ */
+func AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminKey := os.Getenv("ADMIN_API_KEY")
+		if adminKey == "" {
+			respondStatusError(c, http.StatusNotFound, "%s", "Not found")
+			c.Abort()
+			return
+		}
+
+		token := c.GetHeader("x-api-key")
+		if token == "" {
+			token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminKey)) != 1 {
+			respondAnthropicError(c, http.StatusUnauthorized, "authentication_error", "Invalid admin key")
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -72,6 +92,13 @@ func RequestIDMiddleware() gin.HandlerFunc {
 	}
 }
 
+/**
+ * GetAccountID 从上下文读取上游账号ID
+ */
+func GetAccountID(c *gin.Context) string {
+	return c.GetString("accountID")
+}
+
 /**
  * GetRequestID 从上下文读取 request_id
  */
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"slices"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelPresetKey 本次请求使用的虚拟模型预设名（响应中回显）
+const modelPresetKey = "model_preset"
+
+// defaultPresetThinkingBudget 预设开启 thinking 且请求与预设都未指定预算时使用的 budget_tokens
+const defaultPresetThinkingBudget = 16000
+
+// modelPresets 虚拟模型预设（key: 预设名）
+var modelPresets = map[string]*config.ModelPreset{}
+
+// initModelPresets 按当前环境变量重新加载虚拟模型预设（.env 加载后调用）
+func initModelPresets() {
+	presets, err := config.LoadModelPresets()
+	if err != nil {
+		utils.Error("虚拟模型预设配置无效，仅使用有效部分: %v", err)
+	}
+	modelPresets = presets
+	if len(presets) > 0 {
+		utils.Info("已加载虚拟模型预设: count=%d", len(presets))
+	}
+}
+
+// applyModelPreset 请求模型是预设名时解析为基础模型并应用预设参数
+// 设计原则：
+// - 在请求校验与格式转换之前执行，后续流程只看到基础模型与最终参数
+// - system 前缀、thinking 开关、max_tokens 上限与工具过滤由预设强制；temperature 仅在请求未指定时生效
+// - 预设名记录在上下文中，响应的 model 字段回显预设名
+func applyModelPreset(c *gin.Context, req types.AnthropicRequest) types.AnthropicRequest {
+	preset := modelPresets[req.Model]
+	if preset == nil {
+		return req
+	}
+	c.Set(modelPresetKey, req.Model)
+	req.Model = preset.Model
+
+	req.System = withSystemPrefix(preset, req.System)
+	req.Tools = filterPresetTools(preset, req.Tools)
+
+	if preset.MaxTokens > 0 && (req.MaxTokens <= 0 || req.MaxTokens > preset.MaxTokens) {
+		req.MaxTokens = preset.MaxTokens
+	}
+	if req.Temperature == nil && preset.Temperature != nil {
+		temperature := *preset.Temperature
+		req.Temperature = &temperature
+	}
+
+	if preset.Thinking != nil {
+		if !*preset.Thinking {
+			req.Thinking = nil
+		} else {
+			budget := preset.ThinkingBudget
+			if budget == 0 && req.Thinking != nil {
+				budget = req.Thinking.BudgetTokens
+			}
+			if budget == 0 {
+				budget = defaultPresetThinkingBudget
+			}
+			// budget_tokens 必须小于 max_tokens；过小的 max_tokens 交给请求校验报错
+			if req.MaxTokens > 0 && budget >= req.MaxTokens {
+				budget = max(req.MaxTokens-1, 1024)
+			}
+			req.Thinking = &types.ThinkingConfig{Type: "enabled", BudgetTokens: budget}
+		}
+	}
+	return req
+}
+
+// applyModelPresetToCount 对 token 计数请求应用预设中影响输入的部分（基础模型、system 前缀、工具过滤）
+func applyModelPresetToCount(req types.CountTokensRequest) types.CountTokensRequest {
+	preset := modelPresets[req.Model]
+	if preset == nil {
+		return req
+	}
+	req.Model = preset.Model
+	req.System = withSystemPrefix(preset, req.System)
+	req.Tools = filterPresetTools(preset, req.Tools)
+	return req
+}
+
+// withSystemPrefix 将预设的 system 前缀插入到最前面
+func withSystemPrefix(preset *config.ModelPreset, system types.SystemMessages) types.SystemMessages {
+	if preset.SystemPrefix == "" {
+		return system
+	}
+	prefixed := make(types.SystemMessages, 0, len(system)+1)
+	prefixed = append(prefixed, types.AnthropicSystemMessage{Type: "text", Text: preset.SystemPrefix})
+	return append(prefixed, system...)
+}
+
+// filterPresetTools 按预设的允许/禁止列表过滤工具
+func filterPresetTools(preset *config.ModelPreset, tools []types.AnthropicTool) []types.AnthropicTool {
+	if len(preset.AllowTools) == 0 && len(preset.DenyTools) == 0 {
+		return tools
+	}
+	filtered := make([]types.AnthropicTool, 0, len(tools))
+	for _, tool := range tools {
+		if len(preset.AllowTools) > 0 && !slices.Contains(preset.AllowTools, tool.Name) {
+			continue
+		}
+		if slices.Contains(preset.DenyTools, tool.Name) {
+			continue
+		}
+		filtered = append(filtered, tool)
+	}
+	return filtered
+}
+
+// responseModel 响应中回显的模型名：使用预设时为预设名，否则为请求模型
+func responseModel(c *gin.Context, model string) string {
+	if preset := c.GetString(modelPresetKey); preset != "" {
+		return preset
+	}
+	return model
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strings"
+)
+
+// prefillEchoStripper 去除上游在回复开头重复的 assistant prefill 文本
+// 设计原则：
+// - 客户端只收到 prefill 之后的续写内容，与 Anthropic API 的 prefill 语义一致
+// - 回复开头与 prefill 一致时先缓冲，确认是完整重复后丢弃；一旦出现差异立即原样输出
+// - 只处理回复开头，确认后不再产生任何额外开销
+type prefillEchoStripper struct {
+	prefix string
+	buf    strings.Builder
+	done   bool
+}
+
+// newPrefillEchoStripper 根据请求创建 prefill 去重器，请求没有 prefill 时返回 nil
+func newPrefillEchoStripper(prefix string) *prefillEchoStripper {
+	if prefix == "" {
+		return nil
+	}
+	return &prefillEchoStripper{prefix: prefix}
+}
+
+// Feed 输入一段上游文本，返回应发给客户端的文本（仍在判断中时返回空字符串）
+func (p *prefillEchoStripper) Feed(text string) string {
+	if p == nil || p.done {
+		return text
+	}
+	p.buf.WriteString(text)
+	buffered := p.buf.String()
+	// 上游可能在重复的 prefill 前输出空白
+	candidate := strings.TrimLeft(buffered, " \t\r\n")
+
+	if len(candidate) < len(p.prefix) {
+		if strings.HasPrefix(p.prefix, candidate) {
+			return ""
+		}
+		p.finish()
+		return buffered
+	}
+
+	p.finish()
+	if strings.HasPrefix(candidate, p.prefix) {
+		return candidate[len(p.prefix):]
+	}
+	return buffered
+}
+
+// Done 是否已完成开头判断
+func (p *prefillEchoStripper) Done() bool {
+	return p == nil || p.done
+}
+
+// finish 结束判断，释放缓冲
+func (p *prefillEchoStripper) finish() {
+	p.done = true
+	p.buf.Reset()
+}
+
+// stripPrefillEcho 去除完整响应文本开头重复的 prefill（非流式响应使用）
+// 响应只包含 prefill 的一部分时视为被截断的重复，返回空字符串
+func stripPrefillEcho(prefix, text string) string {
+	return newPrefillEchoStripper(prefix).Feed(text)
+}
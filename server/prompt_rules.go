@@ -0,0 +1,168 @@
+package server
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promptRules 提示注入规则（内置规则 + PROMPT_RULES_FILE）
+var promptRules = config.BuiltinPromptRules()
+
+// initPromptRules 按当前环境变量重新加载提示注入规则（.env 加载后调用）
+func initPromptRules() {
+	rules, err := config.LoadPromptRules()
+	if err != nil {
+		utils.Error("提示注入规则配置无效，仅使用有效部分: %v", err)
+	}
+	promptRules = rules
+}
+
+// applyPromptRules 按规则向 system 提示追加注入文本，返回发送给上游的请求
+// 设计原则：
+// - 注入由运维配置的规则决定，客户端只能通过规则允许的标记触发
+// - 规则要求去掉标记时，所有用户消息开头的标记都会被去掉，历史中的标记也不会进入对话
+// - 多条规则按配置顺序注入，同一请求中每条规则最多注入一次
+func applyPromptRules(c *gin.Context, req types.AnthropicRequest) types.AnthropicRequest {
+	var applied []string
+	for _, rule := range promptRules {
+		if rule.Disabled || !promptRuleMatches(c, rule, req) {
+			continue
+		}
+		if rule.StripMarker {
+			req.Messages = stripMessageMarker(req.Messages, rule.MessagePrefix)
+		}
+		if text := strings.TrimSpace(rule.Template); text != "" {
+			req.System = append(slices.Clone(req.System), types.AnthropicSystemMessage{Type: "text", Text: text})
+		}
+		applied = append(applied, rule.Name)
+	}
+	if len(applied) > 0 {
+		utils.Info("提示注入规则命中: rules=%s, request_id=%s", strings.Join(applied, ","), GetRequestID(c))
+	}
+	return req
+}
+
+// promptRuleMatches 判断规则的条件是否全部满足
+func promptRuleMatches(c *gin.Context, rule *config.PromptRule, req types.AnthropicRequest) bool {
+	for name, pattern := range rule.Headers {
+		value := c.GetHeader(name)
+		if value == "" || (pattern != "" && pattern != "*" && !matchPattern(pattern, value)) {
+			return false
+		}
+	}
+	if len(rule.APIKeys) > 0 && !slices.Contains(rule.APIKeys, AccountID(c.GetString("refreshToken"))) {
+		return false
+	}
+	if len(rule.Models) > 0 && !slices.ContainsFunc(rule.Models, func(p string) bool { return matchPattern(p, req.Model) }) {
+		return false
+	}
+	if len(rule.Tools) > 0 && !requestHasTool(req.Tools, rule.Tools) {
+		return false
+	}
+	if len(rule.UserAgents) > 0 {
+		ua := strings.ToLower(c.GetHeader("User-Agent"))
+		if !slices.ContainsFunc(rule.UserAgents, func(k string) bool { return strings.Contains(ua, strings.ToLower(k)) }) {
+			return false
+		}
+	}
+	if rule.MessagePrefix != "" {
+		if !strings.HasPrefix(strings.TrimSpace(lastUserText(req.Messages)), rule.MessagePrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern 通配符匹配（不区分大小写），模式无效时按相等比较
+func matchPattern(pattern, value string) bool {
+	pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	if ok, err := path.Match(pattern, value); err == nil {
+		return ok
+	}
+	return pattern == value
+}
+
+// requestHasTool 请求是否包含任一指定工具（* 表示任意工具）
+func requestHasTool(tools []types.AnthropicTool, names []string) bool {
+	for _, tool := range tools {
+		if slices.Contains(names, "*") || slices.Contains(names, tool.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastUserText 最后一条用户消息的第一个文本块
+func lastUserText(messages []types.AnthropicRequestMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			text, _ := firstText(messages[i].Content)
+			return text
+		}
+	}
+	return ""
+}
+
+// firstText 返回消息内容中的第一个文本块及其位置（字符串内容位置为 -1，没有文本块时为 -2）
+func firstText(content any) (string, int) {
+	switch v := content.(type) {
+	case string:
+		return v, -1
+	case []any:
+		for i, item := range v {
+			if block, ok := item.(map[string]any); ok && block["type"] == "text" {
+				text, _ := block["text"].(string)
+				return text, i
+			}
+		}
+	case []types.ContentBlock:
+		for i, block := range v {
+			if block.Type == "text" && block.Text != nil {
+				return *block.Text, i
+			}
+		}
+	}
+	return "", -2
+}
+
+// stripMessageMarker 去掉用户消息第一个文本块开头的标记（返回新的消息切片，不修改原请求）
+func stripMessageMarker(messages []types.AnthropicRequestMessage, marker string) []types.AnthropicRequestMessage {
+	out := slices.Clone(messages)
+	for i, msg := range out {
+		if msg.Role != "user" {
+			continue
+		}
+		text, index := firstText(msg.Content)
+		trimmed := strings.TrimLeft(text, " \t\r\n")
+		if index == -2 || !strings.HasPrefix(trimmed, marker) {
+			continue
+		}
+		stripped := strings.TrimLeft(strings.TrimPrefix(trimmed, marker), " \t\r\n")
+
+		switch v := msg.Content.(type) {
+		case string:
+			out[i].Content = stripped
+		case []any:
+			blocks := slices.Clone(v)
+			block := make(map[string]any, len(v[index].(map[string]any)))
+			for k, val := range v[index].(map[string]any) {
+				block[k] = val
+			}
+			block["text"] = stripped
+			blocks[index] = block
+			out[i].Content = blocks
+		case []types.ContentBlock:
+			blocks := slices.Clone(v)
+			blocks[index].Text = &stripped
+			out[i].Content = blocks
+		}
+	}
+	return out
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// thinkingMinBudgetTokens thinking.budget_tokens 的最小值（与 Anthropic API 一致）
+const thinkingMinBudgetTokens = 1024
+
+// validateMessagesRequest 在转换为上游请求前校验 /v1/messages 请求
+// 设计原则：
+// - 规则与 Anthropic API 保持一致，错误信息指向具体字段（如 messages.2.content.0.tool_use_id）
+// - 无效请求直接返回 invalid_request_error，不再发往上游后以不透明的上游错误返回
+// - 连续的同角色消息按 Anthropic 的规则视为同一轮，不视为错误
+func validateMessagesRequest(req types.AnthropicRequest) error {
+	if strings.TrimSpace(req.Model) == "" {
+		return fmt.Errorf("model: Field required")
+	}
+	if req.MaxTokens < 1 {
+		return fmt.Errorf("max_tokens: Field required and must be greater than or equal to 1")
+	}
+
+	thinkingEnabled := req.Thinking != nil && req.Thinking.Type == "enabled"
+	if thinkingEnabled && req.Thinking.BudgetTokens > 0 {
+		if req.Thinking.BudgetTokens < thinkingMinBudgetTokens {
+			return fmt.Errorf("thinking.budget_tokens: must be greater than or equal to %d", thinkingMinBudgetTokens)
+		}
+		if req.Thinking.BudgetTokens >= req.MaxTokens {
+			return fmt.Errorf("max_tokens: must be greater than thinking.budget_tokens")
+		}
+	}
+
+	toolNames, err := validateToolDefinitions(req.Tools)
+	if err != nil {
+		return err
+	}
+	if err := validateToolChoice(req.ToolChoice, toolNames, thinkingEnabled); err != nil {
+		return err
+	}
+	if err := validateMessageSequence(req.Messages); err != nil {
+		return err
+	}
+	return validateSamplingParams(req)
+}
+
+// validateToolDefinitions 校验工具定义，返回工具名集合
+func validateToolDefinitions(tools []types.AnthropicTool) (map[string]bool, error) {
+	names := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		if strings.TrimSpace(tool.Name) == "" {
+			return nil, fmt.Errorf("tools.%d.name: Field required", i)
+		}
+		if names[tool.Name] {
+			return nil, fmt.Errorf("tools.%d.name: tool names must be unique, %q is defined more than once", i, tool.Name)
+		}
+		names[tool.Name] = true
+
+		// 服务端工具（如 web_search）没有 input_schema，由转换层过滤
+		if tool.InputSchema != nil {
+			if schemaType, ok := tool.InputSchema["type"]; ok && schemaType != "object" {
+				return nil, fmt.Errorf("tools.%d.input_schema.type: must be \"object\"", i)
+			}
+		}
+	}
+	return names, nil
+}
+
+// validateToolChoice 校验 tool_choice
+func validateToolChoice(toolChoice any, toolNames map[string]bool, thinkingEnabled bool) error {
+	var choiceType, name string
+	switch tc := toolChoice.(type) {
+	case nil:
+		return nil
+	case string:
+		choiceType = tc
+	case map[string]any:
+		choiceType, _ = tc["type"].(string)
+		name, _ = tc["name"].(string)
+	default:
+		return fmt.Errorf("tool_choice: must be an object")
+	}
+
+	switch choiceType {
+	case "auto", "none":
+	case "any":
+		if thinkingEnabled {
+			return fmt.Errorf("tool_choice: thinking may not be enabled when tool_choice forces tool use")
+		}
+	case "tool":
+		if thinkingEnabled {
+			return fmt.Errorf("tool_choice: thinking may not be enabled when tool_choice forces tool use")
+		}
+		if name == "" {
+			return fmt.Errorf("tool_choice.name: Field required")
+		}
+		if !toolNames[name] {
+			return fmt.Errorf("tool_choice.name: tool %q is not defined in tools", name)
+		}
+	default:
+		return fmt.Errorf("tool_choice.type: must be one of \"auto\", \"any\", \"tool\" or \"none\", got %q", choiceType)
+	}
+	return nil
+}
+
+// validateMessageSequence 校验消息角色、内容块以及 tool_use/tool_result 的配对
+func validateMessageSequence(messages []types.AnthropicRequestMessage) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("messages: at least one message is required")
+	}
+
+	seenToolUses := make(map[string]bool)    // 已出现的 tool_use id（检查重复）
+	seenToolResults := make(map[string]bool) // 已出现的 tool_result id（检查重复）
+	var pending []pendingToolUse             // 上一轮 assistant 中的 tool_use，需在紧随其后的 user 轮次中得到结果
+	prevRole := ""
+
+	for i, msg := range messages {
+		path := fmt.Sprintf("messages.%d", i)
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return fmt.Errorf("%s.role: must be \"user\" or \"assistant\", got %q", path, msg.Role)
+		}
+
+		// 新的 assistant 轮次开始：上一轮的 tool_use 必须都已得到结果
+		if msg.Role == "assistant" && prevRole != "assistant" {
+			if err := unansweredToolUseError(pending, seenToolResults); err != nil {
+				return err
+			}
+			pending = nil
+		}
+
+		isFinalAssistant := i == len(messages)-1 && msg.Role == "assistant"
+		emptyContentErr := fmt.Errorf("%s.content: all messages must have non-empty content except for the optional final assistant message", path)
+
+		switch content := msg.Content.(type) {
+		case nil:
+			return fmt.Errorf("%s.content: Field required", path)
+		case string:
+			if strings.TrimSpace(content) == "" && !(isFinalAssistant && content == "") {
+				return emptyContentErr
+			}
+			if isFinalAssistant && content != strings.TrimRight(content, " \t\r\n") {
+				return fmt.Errorf("%s.content: final assistant content cannot end with trailing whitespace", path)
+			}
+		case []any:
+			if len(content) == 0 && !isFinalAssistant {
+				return emptyContentErr
+			}
+			lastText := ""
+			for j, item := range content {
+				blockPath := fmt.Sprintf("%s.content.%d", path, j)
+				block, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s: content blocks must be objects", blockPath)
+				}
+				blockType, _ := block["type"].(string)
+				if blockType == "" {
+					return fmt.Errorf("%s.type: Field required", blockPath)
+				}
+				lastText, _ = block["text"].(string) // 只有末尾的文本块参与结尾空白检查
+
+				switch blockType {
+				case "tool_use":
+					if msg.Role != "assistant" {
+						return fmt.Errorf("%s: tool_use blocks are only allowed in assistant messages", blockPath)
+					}
+					id, _ := block["id"].(string)
+					if id == "" {
+						return fmt.Errorf("%s.id: Field required", blockPath)
+					}
+					if seenToolUses[id] {
+						return fmt.Errorf("%s.id: tool_use ids must be unique, %q is used more than once", blockPath, id)
+					}
+					seenToolUses[id] = true
+					pending = append(pending, pendingToolUse{id: id, path: blockPath})
+
+				case "tool_result":
+					if msg.Role != "user" {
+						return fmt.Errorf("%s: tool_result blocks are only allowed in user messages", blockPath)
+					}
+					id, _ := block["tool_use_id"].(string)
+					if id == "" {
+						return fmt.Errorf("%s.tool_use_id: Field required", blockPath)
+					}
+					if seenToolResults[id] {
+						return fmt.Errorf("%s.tool_use_id: multiple tool_result blocks found for tool_use_id %q", blockPath, id)
+					}
+					if !containsToolUse(pending, id) {
+						return fmt.Errorf("%s: unexpected tool_use_id found in tool_result blocks: %s. "+
+							"Each tool_result block must have a corresponding tool_use block in the previous message", blockPath, id)
+					}
+					seenToolResults[id] = true
+				}
+
+				if err := validateContentBlock(blockPath, blockType, block); err != nil {
+					return err
+				}
+			}
+			if isFinalAssistant && lastText != strings.TrimRight(lastText, " \t\r\n") {
+				return fmt.Errorf("%s.content: final assistant content cannot end with trailing whitespace", path)
+			}
+		default:
+			return fmt.Errorf("%s.content: must be a string or an array of content blocks", path)
+		}
+
+		prevRole = msg.Role
+	}
+
+	// 以 user 轮次结束时，最后一轮 assistant 的 tool_use 也必须都已得到结果
+	if prevRole == "user" {
+		return unansweredToolUseError(pending, seenToolResults)
+	}
+	return nil
+}
+
+// pendingToolUse 等待 tool_result 的 tool_use
+type pendingToolUse struct {
+	id   string
+	path string
+}
+
+// containsToolUse 判断 id 是否属于上一轮 assistant 的 tool_use
+func containsToolUse(pending []pendingToolUse, id string) bool {
+	for _, p := range pending {
+		if p.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// unansweredToolUseError 返回第一个没有对应 tool_result 的 tool_use 错误
+func unansweredToolUseError(pending []pendingToolUse, answered map[string]bool) error {
+	for _, p := range pending {
+		if !answered[p.id] {
+			return fmt.Errorf("%s: tool_use ids were found without tool_result blocks immediately after: %s. "+
+				"Each tool_use block must have a corresponding tool_result block in the next message", p.path, p.id)
+		}
+	}
+	return nil
+}
+
+// validateContentBlock 校验单个内容块的字段
+func validateContentBlock(path, blockType string, block map[string]any) error {
+	switch blockType {
+	case "text":
+		text, ok := block["text"].(string)
+		if !ok {
+			return fmt.Errorf("%s.text: Field required", path)
+		}
+		if strings.TrimSpace(text) == "" {
+			return fmt.Errorf("%s.text: text content blocks must contain non-whitespace text", path)
+		}
+
+	case "image":
+		source, ok := block["source"].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.source: Field required", path)
+		}
+		sourceType, _ := source["type"].(string)
+		switch sourceType {
+		case "url":
+			// 下载在校验之后进行，下载结果的格式与大小在下载时校验
+			return validateSourceURL(path+".source.url", source["url"])
+		case "file":
+			// 文件归属与类型在校验之后检查
+			return validateFileID(path+".source.file_id", source["file_id"])
+		}
+		if sourceType != "base64" {
+			return fmt.Errorf("%s.source.type: unsupported image source type %q, expected one of base64, url, file", path, sourceType)
+		}
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		return validateImageData(path+".source", mediaType, data)
+
+	case "image_url":
+		imageURL, _ := block["image_url"].(map[string]any)
+		url, _ := imageURL["url"].(string)
+		if url == "" {
+			return fmt.Errorf("%s.image_url.url: Field required", path)
+		}
+		if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+			return nil
+		}
+		header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		if !strings.HasPrefix(url, "data:") || !ok || !strings.HasSuffix(header, ";base64") {
+			return fmt.Errorf("%s.image_url.url: expected a base64 data URL or an http(s) URL", path)
+		}
+		return validateImageData(path+".image_url.url", strings.TrimSuffix(header, ";base64"), data)
+
+	case "document":
+		source, ok := block["source"].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.source: Field required", path)
+		}
+		if citations, ok := block["citations"]; ok && citations != nil {
+			settings, isObject := citations.(map[string]any)
+			if !isObject {
+				return fmt.Errorf("%s.citations: must be an object", path)
+			}
+			if _, isBool := settings["enabled"].(bool); !isBool {
+				return fmt.Errorf("%s.citations.enabled: must be a boolean", path)
+			}
+		}
+		return validateDocumentSource(path+".source", source)
+
+	case "tool_use":
+		name, _ := block["name"].(string)
+		if name == "" {
+			return fmt.Errorf("%s.name: Field required", path)
+		}
+		if input, ok := block["input"]; ok {
+			if _, isObject := input.(map[string]any); !isObject {
+				return fmt.Errorf("%s.input: must be an object", path)
+			}
+		}
+
+	case "tool_result":
+		switch content := block["content"].(type) {
+		case nil, string:
+		case []any:
+			for k, item := range content {
+				itemPath := fmt.Sprintf("%s.content.%d", path, k)
+				sub, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s: content blocks must be objects", itemPath)
+				}
+				subType, _ := sub["type"].(string)
+				if subType == "image" || subType == "image_url" {
+					if err := validateContentBlock(itemPath, subType, sub); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			return fmt.Errorf("%s.content: must be a string or an array of content blocks", path)
+		}
+	}
+	return nil
+}
+
+// validateDocumentSource 校验文档数据源（URL 来源在校验之后下载替换）
+func validateDocumentSource(path string, source map[string]any) error {
+	sourceType, _ := source["type"].(string)
+	switch sourceType {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		if mediaType != "application/pdf" && !utils.IsTextMediaType(mediaType) {
+			return fmt.Errorf("%s.media_type: unsupported document media type %q, expected application/pdf or text/plain", path, mediaType)
+		}
+		data, _ := source["data"].(string)
+		if data == "" {
+			return fmt.Errorf("%s.data: Field required", path)
+		}
+		if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+			return fmt.Errorf("%s.data: invalid base64 data", path)
+		}
+	case "text":
+		if _, ok := source["data"].(string); !ok {
+			return fmt.Errorf("%s.data: Field required", path)
+		}
+	case "url":
+		return validateSourceURL(path+".url", source["url"])
+	case "file":
+		// 文件归属与类型在校验之后检查
+		return validateFileID(path+".file_id", source["file_id"])
+	case "content":
+		switch source["content"].(type) {
+		case string, []any:
+		default:
+			return fmt.Errorf("%s.content: must be a string or an array of content blocks", path)
+		}
+	default:
+		return fmt.Errorf("%s.type: unsupported document source type %q, expected one of base64, text, content, url, file", path, sourceType)
+	}
+	return nil
+}
+
+// validateSourceURL 校验 URL 数据源的地址形式（只接受 http/https）
+func validateSourceURL(path string, rawURL any) error {
+	url, _ := rawURL.(string)
+	if url == "" {
+		return fmt.Errorf("%s: Field required", path)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("%s: expected an http(s) URL", path)
+	}
+	return nil
+}
+
+// validateFileID 校验 Files API 数据源的 file_id
+func validateFileID(path string, fileID any) error {
+	if id, _ := fileID.(string); id == "" {
+		return fmt.Errorf("%s: Field required", path)
+	}
+	return nil
+}
+
+// validateImageData 校验 base64 图片的格式声明、编码与大小
+func validateImageData(path, mediaType, data string) error {
+	if !utils.IsSupportedImageFormat(mediaType) {
+		return fmt.Errorf("%s.media_type: unsupported image media type %q, expected one of image/jpeg, image/png, image/gif, image/webp, image/bmp, image/tiff", path, mediaType)
+	}
+	if data == "" {
+		return fmt.Errorf("%s.data: Field required", path)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("%s.data: invalid base64 data", path)
+	}
+	if len(decoded) > utils.MaxImageSize {
+		return fmt.Errorf("%s.data: image exceeds the maximum size of %d bytes (got %d bytes)", path, utils.MaxImageSize, len(decoded))
+	}
+	if detected, err := utils.DetectImageFormat(decoded); err == nil && detected != mediaType {
+		return fmt.Errorf("%s.media_type: image data does not match the declared media type %s (detected %s)", path, mediaType, detected)
+	}
+	if width, height, err := utils.GetImageDimensions(decoded); err == nil {
+		if err := utils.CheckImagePixels(width, height); err != nil {
+			return fmt.Errorf("%s.data: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"kiro/types"
+)
+
+// newValidatorTestRequest 以 JSON 形式的 messages 构造请求
+func newValidatorTestRequest(t *testing.T, messages string) types.AnthropicRequest {
+	t.Helper()
+	req := types.AnthropicRequest{Model: "claude-sonnet-4-5", MaxTokens: 1024}
+	if err := json.Unmarshal([]byte(messages), &req.Messages); err != nil {
+		t.Fatalf("invalid test messages: %v", err)
+	}
+	return req
+}
+
+func TestValidateMessageSequence(t *testing.T) {
+	const toolUseA = `{"type":"tool_use","id":"toolu_a","name":"read","input":{}}`
+	const resultA = `{"type":"tool_result","tool_use_id":"toolu_a","content":"ok"}`
+
+	cases := []struct {
+		name     string
+		messages string
+		wantErr  string // 为空表示应通过校验
+	}{
+		{"simple exchange", `[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"more"}]`, ""},
+		{"consecutive user messages form one turn", `[{"role":"user","content":"a"},{"role":"user","content":"b"}]`, ""},
+		{"no messages", `[]`, "messages: at least one message is required"},
+		{"unknown role", `[{"role":"system","content":"hi"}]`, `messages.0.role: must be "user" or "assistant"`},
+		{"missing content", `[{"role":"user"}]`, "messages.0.content: Field required"},
+
+		// tool_use / tool_result 的位置与配对
+		{"paired tool call", `[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `]},{"role":"user","content":[` + resultA + `]}]`, ""},
+		{"tool_use in user message", `[{"role":"user","content":[` + toolUseA + `]}]`, "messages.0.content.0: tool_use blocks are only allowed in assistant messages"},
+		{"tool_result in assistant message", `[{"role":"user","content":"go"},{"role":"assistant","content":[` + resultA + `]}]`, "messages.1.content.0: tool_result blocks are only allowed in user messages"},
+		{"orphan tool_result", `[{"role":"user","content":[` + resultA + `]}]`, "messages.0.content.0: unexpected tool_use_id found in tool_result blocks: toolu_a"},
+		{"tool_result repeated in a later turn",
+			`[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `]},{"role":"user","content":[` + resultA + `]},` +
+				`{"role":"assistant","content":"done"},{"role":"user","content":[` + resultA + `]}]`,
+			"messages.4.content.0.tool_use_id: multiple tool_result blocks found for tool_use_id"},
+		{"duplicate tool_use id",
+			`[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `,` + toolUseA + `]}]`,
+			`messages.1.content.1.id: tool_use ids must be unique, "toolu_a" is used more than once`},
+		{"duplicate tool_result",
+			`[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `]},{"role":"user","content":[` + resultA + `,` + resultA + `]}]`,
+			"messages.2.content.1.tool_use_id: multiple tool_result blocks found"},
+		{"tool_use without result before next assistant",
+			`[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `]},{"role":"user","content":"skip"},{"role":"assistant","content":"ok"}]`,
+			"messages.1.content.0: tool_use ids were found without tool_result blocks immediately after: toolu_a"},
+		{"tool_use without result at the end",
+			`[{"role":"user","content":"go"},{"role":"assistant","content":[` + toolUseA + `]},{"role":"user","content":"skip"}]`,
+			"tool_use ids were found without tool_result blocks immediately after: toolu_a"},
+		{"tool_use without id", `[{"role":"user","content":"go"},{"role":"assistant","content":[{"type":"tool_use","name":"read","input":{}}]}]`, "messages.1.content.0.id: Field required"},
+		{"tool_result without tool_use_id", `[{"role":"user","content":[{"type":"tool_result","content":"ok"}]}]`, "messages.0.content.0.tool_use_id: Field required"},
+
+		// 空内容与最后一条 assistant 的结尾空白
+		{"empty final assistant prefill", `[{"role":"user","content":"hi"},{"role":"assistant","content":""}]`, ""},
+		{"final assistant prefill", `[{"role":"user","content":"hi"},{"role":"assistant","content":"Sure,"}]`, ""},
+		{"final assistant trailing space", `[{"role":"user","content":"hi"},{"role":"assistant","content":"Sure, "}]`, "messages.1.content: final assistant content cannot end with trailing whitespace"},
+		{"final assistant trailing newline in block", `[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"text","text":"Sure\n"}]}]`, "messages.1.content: final assistant content cannot end with trailing whitespace"},
+		{"whitespace-only final assistant", `[{"role":"user","content":"hi"},{"role":"assistant","content":"  "}]`, "messages.1.content: all messages must have non-empty content"},
+		{"empty intermediate assistant", `[{"role":"user","content":"hi"},{"role":"assistant","content":""},{"role":"user","content":"again"}]`, "messages.1.content: all messages must have non-empty content"},
+		{"empty block list", `[{"role":"user","content":[]}]`, "messages.0.content: all messages must have non-empty content"},
+		{"whitespace-only text block", `[{"role":"user","content":[{"type":"text","text":" \n"}]}]`, "messages.0.content.0.text: text content blocks must contain non-whitespace text"},
+		{"block without type", `[{"role":"user","content":[{"text":"hi"}]}]`, "messages.0.content.0.type: Field required"},
+
+		// URL 与 Files API 数据源只校验形式，下载与归属检查在校验之后进行
+		{"image url source", `[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]}]`, ""},
+		{"image non-http url", `[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"file:///etc/passwd"}}]}]`, "messages.0.content.0.source.url: expected an http(s) URL"},
+		{"image file without id", `[{"role":"user","content":[{"type":"image","source":{"type":"file"}}]}]`, "messages.0.content.0.source.file_id: Field required"},
+		{"document ftp url", `[{"role":"user","content":[{"type":"document","source":{"type":"url","url":"ftp://example.com/a.pdf"}}]}]`, "messages.0.content.0.source.url: expected an http(s) URL"},
+		{"unsupported image source", `[{"role":"user","content":[{"type":"image","source":{"type":"s3"}}]}]`, `messages.0.content.0.source.type: unsupported image source type "s3"`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateMessagesRequest(newValidatorTestRequest(t, tc.messages))
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected request to pass validation, got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error containing %q, got nil", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
+)
+
+// validateSamplingParams 校验采样参数的取值范围与模型约束
+// 上游支持 temperature、top_p；top_k 无法转发也无法模拟，显式设置时拒绝；
+// stop_sequences 由代理在响应侧匹配
+func validateSamplingParams(req types.AnthropicRequest) error {
+	if t := req.Temperature; t != nil && (*t < 0 || *t > 1) {
+		return fmt.Errorf("temperature: must be between 0 and 1, got %g", *t)
+	}
+	if p := req.TopP; p != nil && (*p < 0 || *p > 1) {
+		return fmt.Errorf("top_p: must be between 0 and 1, got %g", *p)
+	}
+	if k := req.TopK; k != nil && *k < 0 {
+		return fmt.Errorf("top_k: must be greater than or equal to 0, got %d", *k)
+	}
+
+	// 显式启用 thinking 时的约束（与 Anthropic API 一致）
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		if t := req.Temperature; t != nil && *t != 1 {
+			return fmt.Errorf("temperature: may only be set to 1 when thinking is enabled")
+		}
+		if p := req.TopP; p != nil && *p < 0.95 {
+			return fmt.Errorf("top_p: must be between 0.95 and 1 when thinking is enabled")
+		}
+		if k := req.TopK; k != nil && *k > 0 {
+			return fmt.Errorf("top_k: cannot be set when thinking is enabled")
+		}
+	}
+
+	if k := req.TopK; k != nil && *k > 0 {
+		return fmt.Errorf("top_k: is not supported by this endpoint; use temperature or top_p instead")
+	}
+
+	if req.Temperature != nil && req.TopP != nil && config.ExclusiveSamplingModels[config.ModelMap[req.Model]] {
+		return fmt.Errorf("temperature and top_p cannot both be specified for model %s; use only one", req.Model)
+	}
+
+	if len(req.StopSequences) > config.MaxStopSequences {
+		return fmt.Errorf("stop_sequences: at most %d stop sequences are allowed, got %d",
+			config.MaxStopSequences, len(req.StopSequences))
+	}
+	for i, seq := range req.StopSequences {
+		if strings.TrimSpace(seq) == "" {
+			return fmt.Errorf("stop_sequences.%d: each stop sequence must contain non-whitespace characters", i)
+		}
+	}
+	return nil
+}
+
+// stopSequenceMatcher 在流式文本中匹配 stop_sequences
+// 设计原则：
+// - 文本末尾可能是某个 stop sequence 的开头时暂缓输出，跨增量的匹配也不会漏掉
+// - 命中后只输出 stop sequence 之前的文本，stop sequence 本身不输出（与 Anthropic API 一致）
+// - 多个 stop sequence 同时命中时取位置最靠前的
+type stopSequenceMatcher struct {
+	sequences []string
+	held      string // 暂缓输出的文本（某个 stop sequence 的前缀）
+	matched   string // 命中的 stop sequence
+}
+
+// newStopSequenceMatcher 创建匹配器，没有 stop_sequences 时返回 nil
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	if len(sequences) == 0 {
+		return nil
+	}
+	return &stopSequenceMatcher{sequences: sequences}
+}
+
+// Feed 输入一段文本，返回可以立即输出的部分
+// 命中 stop sequence 后返回其之前的文本，后续输入全部忽略
+func (m *stopSequenceMatcher) Feed(text string) string {
+	if m == nil {
+		return text
+	}
+	if m.matched != "" {
+		return ""
+	}
+
+	combined := m.held + text
+	m.held = ""
+	if index, seq := findStopSequence(combined, m.sequences); index >= 0 {
+		m.matched = seq
+		return combined[:index]
+	}
+
+	keep := 0
+	for _, seq := range m.sequences {
+		for n := min(len(seq)-1, len(combined)); n > keep; n-- {
+			if strings.HasSuffix(combined, seq[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	m.held = combined[len(combined)-keep:]
+	return combined[:len(combined)-keep]
+}
+
+// Flush 返回暂缓输出的文本（文本块结束时调用）
+func (m *stopSequenceMatcher) Flush() string {
+	if m == nil {
+		return ""
+	}
+	held := m.held
+	m.held = ""
+	return held
+}
+
+// Matched 返回命中的 stop sequence（未命中时为空）
+func (m *stopSequenceMatcher) Matched() string {
+	if m == nil {
+		return ""
+	}
+	return m.matched
+}
+
+// cutAtStopSequence 在最先出现的 stop sequence 处截断完整文本（非流式响应使用）
+// 返回截断后的文本与命中的序列（未命中时原样返回）
+func cutAtStopSequence(text string, sequences []string) (string, string) {
+	if index, seq := findStopSequence(text, sequences); index >= 0 {
+		return text[:index], seq
+	}
+	return text, ""
+}
+
+// stopSequenceValue 响应中的 stop_sequence 字段（未命中时为 null）
+func stopSequenceValue(seq string) any {
+	if seq == "" {
+		return nil
+	}
+	return seq
+}
+
+// findStopSequence 查找最先出现的 stop sequence，返回位置与命中的序列（未命中返回 -1）
+func findStopSequence(text string, sequences []string) (int, string) {
+	index, matched := -1, ""
+	for _, seq := range sequences {
+		if i := strings.Index(text, seq); i >= 0 && (index < 0 || i < index) {
+			index, matched = i, seq
+		}
+	}
+	return index, matched
+}
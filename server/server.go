@@ -1,9 +1,10 @@
 package server
 
 import (
+	"maps"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
 	"time"
 
 	"kiro/cache"
@@ -22,6 +23,17 @@ func StartServer(port string) {
 	// 初始化 Prompt Cache（每5分钟清理过期条目）
 	cache.InitGlobalCache(5 * time.Minute)
 
+	// 加载熔断器、响应流看门狗、并发限制、自动续写、上下文窗口、工具裁剪、虚拟模型预设与提示注入规则配置
+	initCircuitBreakers()
+	initStreamWatchdog()
+	initConcurrencyLimiters()
+	initContinuation()
+	initContextWindow()
+	initToolPruning()
+	initModelPresets()
+	initPromptRules()
+	initUpstreamMetadata()
+
 	// 设置 gin 模式
 	ginMode := os.Getenv("GIN_MODE")
 	if ginMode == "" {
@@ -42,6 +54,10 @@ func StartServer(port string) {
 		c.Redirect(http.StatusMovedPermanently, "https://www.bilibili.com/video/BV1cp4y1Q7yn")
 	})
 
+	// 管理端点（使用独立的 ADMIN_API_KEY 认证）
+	admin := r.Group("/admin", AdminAuthMiddleware())
+	admin.GET("/status", handleAdminStatus)
+
 	r.Use(AuthMiddleware()) // 应用到所有 API 端点
 
 	// GET /v1/models 端点
@@ -60,6 +76,23 @@ func StartServer(port string) {
 			}
 			models = append(models, model)
 		}
+		// 虚拟模型预设（按名称排序，保证列表顺序稳定）
+		for _, name := range slices.Sorted(maps.Keys(modelPresets)) {
+			preset := modelPresets[name]
+			displayName := preset.Description
+			if displayName == "" {
+				displayName = name
+			}
+			models = append(models, types.Model{
+				ID:          name,
+				Object:      "model",
+				Created:     1234567890,
+				OwnedBy:     "anthropic",
+				DisplayName: displayName,
+				Type:        "text",
+				MaxTokens:   200000,
+			})
+		}
 
 		response := types.ModelsResponse{
 			Object: "list",
@@ -74,7 +107,7 @@ func StartServer(port string) {
 		// 从上下文获取 access token
 		accessToken, exists := c.Get("accessToken")
 		if !exists {
-			respondError(c, http.StatusUnauthorized, "%s", "未找到访问令牌")
+			respondStatusError(c, http.StatusUnauthorized, "%s", "Missing access token")
 			return
 		}
 
@@ -86,7 +119,7 @@ func StartServer(port string) {
 		body, err := c.GetRawData()
 		if err != nil {
 			utils.Error("读取请求体失败: %v", err)
-			respondError(c, http.StatusBadRequest, "读取请求体失败: %v", err)
+			respondStatusError(c, http.StatusBadRequest, "Failed to read request body: %v", err)
 			return
 		}
 
@@ -94,7 +127,7 @@ func StartServer(port string) {
 		var rawReq map[string]any
 		if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
 			utils.Error("解析请求体失败: %v", err)
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			respondStatusError(c, http.StatusBadRequest, "Invalid JSON body: %v", err)
 			return
 		}
 
@@ -128,39 +161,60 @@ func StartServer(port string) {
 		normalizedBody, err := utils.SafeMarshal(rawReq)
 		if err != nil {
 			utils.Error("重新序列化请求失败: %v", err)
-			respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
+			respondStatusError(c, http.StatusBadRequest, "Invalid request body: %v", err)
 			return
 		}
 
 		var anthropicReq types.AnthropicRequest
 		if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
 			utils.Error("解析标准化请求体失败: %v", err)
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			respondStatusError(c, http.StatusBadRequest, "Invalid JSON body: %v", err)
 			return
 		}
 
-		// 验证请求的有效性
-		if len(anthropicReq.Messages) == 0 {
-			utils.Error("请求中没有消息")
-			respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
+		// 虚拟模型预设：解析为基础模型并应用预设参数
+		anthropicReq = applyModelPreset(c, anthropicReq)
+
+		// 在提示注入与上下文压缩改写请求之前确定会话ID，本次请求后续的上游调用沿用该ID
+		utils.GenerateStableConversationID(c, &anthropicReq)
+
+		// 按规则注入提示（如分块写入协议）
+		anthropicReq = applyPromptRules(c, anthropicReq)
+
+		// 按 Anthropic API 的规则校验请求，无效请求不发往上游，也不会触发 URL 下载与文件读取
+		if err := validateMessagesRequest(anthropicReq); err != nil {
+			utils.Info("请求校验失败: %v, request_id=%s", err, GetRequestID(c))
+			respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 			return
 		}
 
-		// 验证最后一条消息有有效内容
-		lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
-		content, err := utils.GetMessageContent(lastMsg.Content)
+		// 下载 URL 图片与文档来源，替换为内联数据
+		resolved, err := resolveURLSources(c.Request.Context(), anthropicReq.Messages)
 		if err != nil {
-			utils.Error("获取消息内容失败: %v", err)
-			respondError(c, http.StatusBadRequest, "获取消息内容失败: %v", err)
+			utils.Info("URL 来源下载失败: %v, request_id=%s", err, GetRequestID(c))
+			respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 			return
 		}
+		anthropicReq.Messages = resolved
 
-		trimmedContent := strings.TrimSpace(content)
-		if trimmedContent == "" || trimmedContent == "answer for user question" {
-			respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
+		// Files API 文件必须属于当前 API Key
+		if err := checkFileSources(fileOwner(c), anthropicReq.Messages); err != nil {
+			utils.Info("文件来源校验失败: %v, request_id=%s", err, GetRequestID(c))
+			respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 			return
 		}
 
+		// 启用 citations 的文档切分为可引用的分块
+		anthropicReq, err = applyCitations(c, anthropicReq)
+		if err != nil {
+			utils.Info("文档引用处理失败: %v, request_id=%s", err, GetRequestID(c))
+			respondAnthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// 估算大小超出模型预算时压缩对话历史
+		anthropicReq = manageContextWindow(c, anthropicReq, tokenInfo)
+
 		if anthropicReq.Stream {
 			handleStreamRequest(c, anthropicReq, tokenInfo)
 			return
@@ -172,8 +226,11 @@ func StartServer(port string) {
 	// Token计数端点
 	r.POST("/v1/messages/count_tokens", handleCountTokens)
 
+	// Files API：上传一次，之后按 file_id 引用
+	registerFileRoutes(r)
+
 	r.NoRoute(func(c *gin.Context) {
-		respondError(c, http.StatusNotFound, "%s", "404 未找到")
+		respondStatusError(c, http.StatusNotFound, "%s", "Not found")
 	})
 
 	// 创建自定义HTTP服务器以支持长时间请求
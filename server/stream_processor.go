@@ -3,9 +3,11 @@ package server
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 
 	"kiro/cache"
+	"kiro/converter"
 	"kiro/parser"
 	"kiro/types"
 	"kiro/utils"
@@ -37,8 +39,9 @@ type StreamProcessorContext struct {
 	thinkingEnabled      bool // 是否启用 thinking 模式
 	thinkingBlockStarted bool // thinking 块是否已开始
 	thinkingBlockIndex   int  // thinking 块的索引
-	textBlockIndex       int  // 文本块的索引（thinking 模式下用于发送普通文本）
+	textBlockIndex       int  // 文本块的索引（thinking 与引用模式下由代理分配）
 	textBlockStarted     bool // 文本块是否已开始
+	textBlockCited       bool // 当前文本块是否带引用
 
 	// 统计信息
 	totalOutputTokens    int // 累计发送给客户端的输出 token 数
@@ -48,10 +51,28 @@ type StreamProcessorContext struct {
 
 	// 工具调用跟踪
 	toolUseIdByBlockIndex map[int]string
-	completedToolUseIds   map[string]bool // 已完成的工具ID集合（用于stop_reason判断）
+	completedToolUseIds   map[string]bool           // 已完成的工具ID集合（用于stop_reason判断）
+	toolNames             *converter.ToolNameMapper // 上游工具别名 -> 原始名称
 
 	// JSON字节累加器（修复分段整除精度损失）
 	jsonBytesByBlockIndex map[int]int // 每个工具块累积的JSON字节数
+
+	// 自动续写（上游生成中断时拼接续写响应）
+	continuation *continuationState
+
+	// assistant prefill：去除上游在回复开头重复的 prefill 文本
+	prefillStripper *prefillEchoStripper
+
+	// stop_sequences：代理侧匹配，命中后结束消息
+	stopSequences *stopSequenceMatcher
+
+	// citations：文档分块表（未启用时为 nil），<cite> 标记提取器与重新分配的工具块索引
+	citations         *converter.CitationIndex
+	citationExtractor *citationExtractor
+	citationToolIndex map[int]int
+
+	// 上游的代码引用、网页链接与后续提示（汇总后在结束前发送）
+	upstreamMetadata *types.UpstreamMetadata
 }
 
 // NewStreamProcessorContext 创建流处理上下文
@@ -66,6 +87,7 @@ func NewStreamProcessorContext(
 ) *StreamProcessorContext {
 	// 检查是否启用了 thinking 模式
 	thinkingEnabled := req.Thinking != nil && req.Thinking.Type == "enabled"
+	prefill := converter.AssistantPrefill(req.Messages)
 
 	return &StreamProcessorContext{
 		c:                     c,
@@ -87,7 +109,14 @@ func NewStreamProcessorContext(
 		textBlockStarted:      false,
 		toolUseIdByBlockIndex: make(map[int]string),
 		completedToolUseIds:   make(map[string]bool),
+		toolNames:             converter.NewToolNameMapper(req.Tools, req.Messages),
 		jsonBytesByBlockIndex: make(map[int]int), // *** 初始化JSON字节累加器 ***
+		continuation:          newContinuationState(prefill),
+		prefillStripper:       newPrefillEchoStripper(prefill),
+		stopSequences:         newStopSequenceMatcher(req.StopSequences),
+		citations:             citationIndex(c),
+		citationExtractor:     &citationExtractor{},
+		citationToolIndex:     make(map[int]int),
 	}
 }
 
@@ -148,7 +177,7 @@ func initializeSSEResponse(c *gin.Context) error {
 // sendInitialEvents 发送初始事件
 func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(string, int, string, *cache.CacheResult) []map[string]any) error {
 	// 直接使用上下文中的 inputTokens（已经通过 TokenEstimator 精确计算）
-	initialEvents := eventCreator(ctx.messageID, ctx.inputTokens, ctx.req.Model, ctx.cacheResult)
+	initialEvents := eventCreator(ctx.messageID, ctx.inputTokens, responseModel(ctx.c, ctx.req.Model), ctx.cacheResult)
 
 	// 注意：初始事件现在只包含 message_start 和 ping
 	// content_block_start 会在收到实际内容时由 sse_state_manager 自动生成
@@ -164,6 +193,47 @@ func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(string, i
 	return nil
 }
 
+// stripPrefillEcho 处理原始响应开头的文本增量，去除重复的 prefill
+// 返回 true 表示该事件已被吸收，不需要继续处理
+func (esp *EventStreamProcessor) stripPrefillEcho(dataMap map[string]any) bool {
+	stripper := esp.ctx.prefillStripper
+	if stripper.Done() || esp.ctx.continuation.segment > 0 {
+		return false
+	}
+	delta, _ := dataMap["delta"].(map[string]any)
+	if deltaType, _ := delta["type"].(string); deltaType != "text_delta" {
+		return false
+	}
+	text, _ := delta["text"].(string)
+	text = stripper.Feed(text)
+	if text == "" {
+		return true
+	}
+	delta["text"] = text
+	return false
+}
+
+// handlePrunedToolStart 模型请求了被裁剪的工具时，关闭裁剪并以完整工具集续写
+// 无法续写时中断流并返回错误；返回 handled=true 表示该事件不再转发
+func (esp *EventStreamProcessor) handlePrunedToolStart(dataMap map[string]any) (handled bool, err error) {
+	cb, _ := dataMap["content_block"].(map[string]any)
+	if cbType, _ := cb["type"].(string); cbType != "tool_use" {
+		return false, nil
+	}
+	name := esp.ctx.toolNames.Original(getStringField(cb, "name"))
+	if !isPrunedTool(esp.ctx.c, name) {
+		return false, nil
+	}
+
+	disableToolPruning(esp.ctx.c)
+	if esp.ctx.canContinue() {
+		esp.ctx.continuation.prunedTool = name
+		esp.ctx.markInterrupted(continueReasonPrunedTool)
+		return true, nil
+	}
+	return true, esp.abortStream("api_error", prunedToolError(name))
+}
+
 // processToolUseStart 处理工具使用开始事件
 func (ctx *StreamProcessorContext) processToolUseStart(dataMap map[string]any) {
 	cb, ok := dataMap["content_block"].(map[string]any)
@@ -188,8 +258,14 @@ func (ctx *StreamProcessorContext) processToolUseStart(dataMap map[string]any) {
 		return
 	}
 
+	// 上游使用的是别名，还原为客户端定义的原始名称
+	if name := getStringField(cb, "name"); name != "" {
+		cb["name"] = ctx.toolNames.Original(name)
+	}
+
 	// 记录索引到tool_use_id的映射
 	ctx.toolUseIdByBlockIndex[idx] = id
+	ctx.continuation.toolNames[idx] = getStringField(cb, "name")
 
 	utils.Log("转发tool_use开始",
 		utils.LogString("tool_use_id", id),
@@ -235,6 +311,10 @@ func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 
 // sendFinalEvents 发送结束事件
 func (ctx *StreamProcessorContext) sendFinalEvents() error {
+	// 输出引用提取器与 stop_sequences 暂缓的文本
+	ctx.flushCitations()
+	ctx.flushStopSequenceHold(-1)
+
 	// 关闭所有未关闭的content_block
 	activeBlocks := ctx.sseStateManager.GetActiveBlocks()
 	for index, block := range activeBlocks {
@@ -286,16 +366,23 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 		}
 	}
 
-	// 确定stop_reason
+	// 确定stop_reason（命中 stop_sequences 时优先）
 	stopReason := ctx.stopReasonManager.DetermineStopReason()
+	stopSequence := ctx.stopSequences.Matched()
+	if stopSequence != "" {
+		stopReason = "stop_sequence"
+	}
 
 	utils.Log("创建结束事件",
 		utils.LogString("stop_reason", stopReason),
 		utils.LogString("stop_reason_description", GetStopReasonDescription(stopReason)),
 		utils.LogInt("output_tokens", outputTokens))
 
+	// 上游的引用元数据（需启用 UPSTREAM_METADATA_EVENTS）
+	ctx.sendUpstreamMetadata()
+
 	// 创建并发送结束事件
-	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, stopReason, ctx.cacheResult)
+	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, stopReason, stopSequence, ctx.cacheResult)
 	for _, event := range finalEvents {
 		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
 			utils.Log("结束事件发送违规", utils.LogErr(err))
@@ -343,6 +430,11 @@ func NewEventStreamProcessor(ctx *StreamProcessorContext) *EventStreamProcessor
 func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 	buf := make([]byte, 1024)
 
+	// 看门狗：首事件、事件间隔、总时长超限时关闭上游响应体以中断阻塞读取
+	closer, _ := reader.(io.Closer)
+	watchdog := NewStreamWatchdog(closer, streamWatchdogConfig)
+	defer watchdog.Stop()
+
 	for {
 		n, err := reader.Read(buf)
 		esp.ctx.totalReadBytes += n
@@ -362,6 +454,9 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 			}
 
 			esp.ctx.totalProcessedEvents += len(events)
+			if len(events) > 0 {
+				watchdog.Touch()
+			}
 
 			// 处理每个事件
 			for _, event := range events {
@@ -374,14 +469,36 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 			if len(events) > 0 {
 				esp.ctx.c.Writer.Flush()
 			}
+
+			// 命中 stop_sequences：消息已结束，不再读取上游响应
+			if esp.ctx.stopSequences.Matched() != "" {
+				return nil
+			}
 		}
 
 		if err != nil {
+			if timeoutErr := watchdog.Err(); timeoutErr != nil {
+				// 已有输出后停顿过久，视为生成中断，优先续写
+				if timeoutErr.Reason == watchdogReasonIdle && esp.ctx.canContinue() && esp.ctx.hasPartialOutput() {
+					esp.ctx.continuation.pendingTimeout = timeoutErr
+					esp.ctx.markInterrupted(continueReasonIdle)
+					break
+				}
+				return esp.abortOnWatchdog(timeoutErr)
+			}
 			if err == io.EOF {
 				utils.Log("响应流结束",
 					addReqFields(esp.ctx.c,
 						utils.LogInt("total_read_bytes", esp.ctx.totalReadBytes),
 					)...)
+				// 工具参数未结束就收到 EOF，说明上游截断了生成
+				// 文本输出后没有收到生成结束标记就 EOF，仅在 AUTO_CONTINUE_ON_MISSING_COMPLETION 开启时视为中断
+				if len(esp.ctx.toolUseIdByBlockIndex) > 0 && esp.ctx.canContinue() {
+					esp.ctx.markInterrupted(continueReasonUnterminated)
+				} else if continuationConfig.ContinueWithoutCompletion && !esp.ctx.continuation.completed &&
+					esp.ctx.canContinue() && esp.ctx.hasPartialOutput() {
+					esp.ctx.markInterrupted(continueReasonInterrupted)
+				}
 			} else {
 				utils.Log("读取响应流时发生错误",
 					addReqFields(esp.ctx.c,
@@ -389,13 +506,74 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 						utils.LogInt("total_read_bytes", esp.ctx.totalReadBytes),
 						utils.LogString("direction", "upstream_response"),
 					)...)
+				if esp.ctx.canContinue() && esp.ctx.hasPartialOutput() {
+					esp.ctx.markInterrupted(continueReasonInterrupted)
+				}
 			}
 			break
 		}
 	}
 
-	// 直传模式：无需冲刷剩余文本
-	return nil
+	// 续写段：输出仍在重叠缓冲中的文本
+	return esp.flushContinuationOverlap()
+}
+
+// ContinueOrFinish 处理本段响应的中断：可续写时返回续写响应，否则按中断原因收尾
+// 返回 (nil, nil) 表示无需续写，继续发送结束事件
+func (esp *EventStreamProcessor) ContinueOrFinish() (*http.Response, error) {
+	cs := esp.ctx.continuation
+	if cs.interruptReason == "" {
+		return nil, nil
+	}
+
+	resp, err := esp.ctx.requestContinuation()
+	if err == nil {
+		return resp, nil
+	}
+
+	utils.Error("续写请求失败: reason=%s, request_id=%s: %v", cs.interruptReason, GetRequestID(esp.ctx.c), err)
+	reason := cs.interruptReason
+	cs.interruptReason = ""
+	switch reason {
+	case continueReasonContentLength:
+		esp.sendMaxTokensStop()
+	case continueReasonIdle:
+		return nil, esp.abortOnWatchdog(cs.pendingTimeout)
+	case continueReasonPrunedTool:
+		return nil, esp.abortStream("api_error", prunedToolError(cs.prunedTool))
+	}
+	return nil, nil
+}
+
+// abortOnWatchdog 看门狗触发后中断流：关闭未关闭的内容块并发送 error 事件
+func (esp *EventStreamProcessor) abortOnWatchdog(timeoutErr *StreamTimeoutError) error {
+	esp.ctx.c.Set("stream_abort_reason", timeoutErr.Reason)
+	utils.Error("上游响应流被看门狗中断: reason=%s, request_id=%s, read_bytes=%d, events=%d",
+		timeoutErr.Reason, GetRequestID(esp.ctx.c), esp.ctx.totalReadBytes, esp.ctx.totalProcessedEvents)
+
+	esp.abortStream("timeout_error", timeoutErr.Error())
+	return timeoutErr
+}
+
+// abortStream 中断流：关闭未关闭的内容块并发送 error 事件，返回对应错误
+func (esp *EventStreamProcessor) abortStream(errorType, message string) error {
+	activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
+	for index, block := range activeBlocks {
+		if block.Started && !block.Stopped {
+			stopEvent := map[string]any{
+				"type":  "content_block_stop",
+				"index": index,
+			}
+			_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
+		}
+	}
+
+	if err := esp.ctx.sender.SendEvent(esp.ctx.c, types.NewErrorEvent(errorType, message)); err != nil {
+		utils.Log("发送错误事件失败", utils.LogErr(err))
+	}
+	esp.ctx.c.Writer.Flush()
+
+	return fmt.Errorf("%s", message)
 }
 
 // processEvent 处理单个事件
@@ -406,11 +584,43 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 		return nil
 	}
 
+	// 上游的引用元数据不直接转发，汇总后在结束前发送
+	if dataMap["type"] == "upstream_metadata" {
+		esp.ctx.recordUpstreamMetadata(dataMap)
+		return nil
+	}
+
+	// 上游的生成结束标记：本段响应正常结束
+	if dataMap["type"] == "upstream_completion" {
+		esp.ctx.continuation.completed = true
+		return nil
+	}
+
+	// 本段已中断（等待续写）或已命中 stop_sequences，忽略后续事件
+	if esp.ctx.continuation.interruptReason != "" || esp.ctx.stopSequences.Matched() != "" {
+		return nil
+	}
+
+	// 引用模式：工具块开始前结束当前文本块，并重新分配工具块索引
+	if esp.ctx.citations != nil {
+		esp.ctx.remapCitationToolIndex(dataMap)
+	}
+
+	// 续写段：重映射索引并拼接
+	if esp.ctx.continuation.segment > 0 {
+		if skip, err := esp.stitchContinuationEvent(dataMap); err != nil || skip {
+			return err
+		}
+	}
+
 	eventType, _ := dataMap["type"].(string)
 
 	// 处理不同类型的事件
 	switch eventType {
 	case "content_block_start":
+		if handled, err := esp.handlePrunedToolStart(dataMap); handled {
+			return err
+		}
 		esp.ctx.processToolUseStart(dataMap)
 		// 如果启用 thinking 模式，转换 thinking 块格式
 		if esp.ctx.thinkingEnabled {
@@ -423,6 +633,10 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 		}
 
 	case "content_block_delta":
+		// assistant prefill：丢弃上游重复输出的 prefill 文本
+		if esp.stripPrefillEcho(dataMap) {
+			return nil
+		}
 		// 如果启用 thinking 模式，转换 thinking_delta 格式
 		if esp.ctx.thinkingEnabled {
 			if delta, ok := dataMap["delta"].(map[string]any); ok {
@@ -440,9 +654,26 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 			} else if handled {
 				return nil // thinking 已处理，不需要继续（Flush 已移至批量处理）
 			}
+		} else if esp.ctx.citations != nil && esp.handleCitationDelta(dataMap) {
+			// 引用模式：文本按 <cite> 标记拆分为文本块
+			return nil
+		}
+		// stop_sequences：命中前的文本正常输出，可能是其前缀的部分暂缓
+		if esp.applyStopSequences(dataMap) {
+			return nil
 		}
 
 	case "content_block_stop":
+		if esp.ctx.citations != nil && !esp.ctx.thinkingEnabled {
+			// 引用模式：上游文本块结束时输出暂存的文本并关闭代理分配的文本块，原事件不转发
+			if _, isTool := esp.ctx.toolUseIdByBlockIndex[extractIndex(dataMap)]; !isTool {
+				esp.ctx.flushCitations()
+				return nil
+			}
+		} else if !esp.ctx.thinkingEnabled {
+			// thinking 模式下暂缓的文本在 flushThinkingExtractor 中输出
+			esp.ctx.flushStopSequenceHold(extractIndex(dataMap))
+		}
 		esp.ctx.processToolUseStop(dataMap)
 		// 如果启用了 thinking 模式，在块结束时刷新提取器
 		if esp.ctx.thinkingEnabled {
@@ -483,6 +714,7 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 				// 文本内容增量
 				if text, ok := delta["text"].(string); ok {
 					esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(text)
+					esp.ctx.recordText(text)
 				}
 
 			case "input_json_delta":
@@ -492,6 +724,7 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 				if partialJSON, ok := delta["partial_json"].(string); ok {
 					index := extractIndex(dataMap)
 					esp.ctx.jsonBytesByBlockIndex[index] += len(partialJSON)
+					esp.ctx.recordToolInput(index, partialJSON)
 				}
 			}
 		}
@@ -620,43 +853,9 @@ func (esp *EventStreamProcessor) handleThinkingDelta(dataMap map[string]any) (bo
 
 	// 处理普通文本内容
 	if result.TextDelta != "" {
-		// 如果文本块未开启，先开启一个新的文本块
-		if !esp.ctx.textBlockStarted {
-			esp.ctx.textBlockIndex = esp.ctx.sseStateManager.AllocateBlockIndex()
-			esp.ctx.textBlockStarted = true
-
-			// 发送 content_block_start 事件
-			startEvent := map[string]any{
-				"type":  "content_block_start",
-				"index": esp.ctx.textBlockIndex,
-				"content_block": map[string]any{
-					"type": "text",
-					"text": "",
-				},
-			}
-
-			if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, startEvent); err != nil {
-				utils.Log("发送 text block start 失败", utils.LogErr(err))
-				return true, err
-			}
-		}
-
-		// 发送文本 delta 事件
-		textDeltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.textBlockIndex,
-			"delta": map[string]any{
-				"type": "text_delta",
-				"text": result.TextDelta,
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, textDeltaEvent); err != nil {
-			utils.Log("发送文本 delta 失败", utils.LogErr(err))
+		if err := esp.emitThinkingModeText(esp.ctx.stopSequences.Feed(result.TextDelta)); err != nil {
+			return true, err
 		}
-
-		// 累计 token
-		esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(result.TextDelta)
 	}
 
 	// 如果有任何内容被处理，则认为事件已处理
@@ -702,61 +901,160 @@ func (esp *EventStreamProcessor) flushThinkingExtractor() error {
 		esp.ctx.thinkingBlockStarted = false
 	}
 
-	// 处理剩余的普通文本（如果有的话）
+	// 处理剩余的普通文本（如果有的话），以及 stop_sequences 暂缓的文本
 	if result.TextDelta != "" {
-		// 如果文本块未开启，先开启一个新的文本块
-		if !esp.ctx.textBlockStarted {
-			esp.ctx.textBlockIndex = esp.ctx.sseStateManager.AllocateBlockIndex()
-			esp.ctx.textBlockStarted = true
-
-			// 发送 content_block_start 事件
-			startEvent := map[string]any{
-				"type":  "content_block_start",
-				"index": esp.ctx.textBlockIndex,
-				"content_block": map[string]any{
-					"type": "text",
-					"text": "",
-				},
-			}
-
-			if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, startEvent); err != nil {
-				utils.Log("flush 时发送 text block start 失败", utils.LogErr(err))
-			}
-		}
-
-		textDeltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.textBlockIndex,
-			"delta": map[string]any{
-				"type": "text_delta",
-				"text": result.TextDelta,
-			},
+		if err := esp.emitThinkingModeText(esp.ctx.stopSequences.Feed(result.TextDelta)); err != nil {
+			utils.Log("发送剩余文本 delta 失败", utils.LogErr(err))
 		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, textDeltaEvent); err != nil {
+	}
+	if held := esp.ctx.stopSequences.Flush(); held != "" {
+		if err := esp.emitThinkingModeText(held); err != nil {
 			utils.Log("发送剩余文本 delta 失败", utils.LogErr(err))
 		}
+	}
+
+	// 输出引用提取器暂存的文本，关闭文本块（如果已开启）
+	esp.ctx.flushCitations()
+	esp.ctx.stopTextBlock()
+
+	return nil
+}
 
-		esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(result.TextDelta)
+// emitThinkingModeText 在 thinking 模式下输出普通文本，文本块未开启时先开启
+func (esp *EventStreamProcessor) emitThinkingModeText(text string) error {
+	if text == "" {
+		return nil
 	}
 
-	// 关闭文本块（如果已开启）
-	if esp.ctx.textBlockStarted {
-		stopEvent := map[string]any{
-			"type":  "content_block_stop",
-			"index": esp.ctx.textBlockIndex,
-		}
+	// 引用模式：由引用提取器拆分文本块
+	if esp.ctx.citations != nil {
+		esp.ctx.emitCitationText(text)
+		return nil
+	}
 
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			utils.Log("关闭文本块失败", utils.LogErr(err))
+	// 如果文本块未开启，先开启一个新的文本块
+	if !esp.ctx.textBlockStarted {
+		if err := esp.ctx.startTextBlock(false); err != nil {
+			return err
 		}
+	}
 
-		esp.ctx.textBlockStarted = false
+	// 发送文本 delta 事件
+	esp.ctx.sendTextDelta(esp.ctx.textBlockIndex, text)
+	return nil
+}
+
+// startTextBlock 分配索引并开启一个由代理管理的文本块；cited 为 true 时块带空的 citations 数组
+func (ctx *StreamProcessorContext) startTextBlock(cited bool) error {
+	ctx.textBlockIndex = ctx.sseStateManager.AllocateBlockIndex()
+	ctx.textBlockStarted = true
+	ctx.textBlockCited = cited
+
+	contentBlock := map[string]any{
+		"type": "text",
+		"text": "",
+	}
+	if cited {
+		contentBlock["citations"] = []any{}
+	}
+	startEvent := map[string]any{
+		"type":          "content_block_start",
+		"index":         ctx.textBlockIndex,
+		"content_block": contentBlock,
 	}
 
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, startEvent); err != nil {
+		utils.Log("发送 text block start 失败", utils.LogErr(err))
+		return err
+	}
 	return nil
 }
 
+// stopTextBlock 关闭由代理管理的文本块（如果已开启）
+func (ctx *StreamProcessorContext) stopTextBlock() {
+	if !ctx.textBlockStarted {
+		return
+	}
+	stopEvent := map[string]any{
+		"type":  "content_block_stop",
+		"index": ctx.textBlockIndex,
+	}
+
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, stopEvent); err != nil {
+		utils.Log("关闭文本块失败", utils.LogErr(err))
+	}
+
+	ctx.textBlockStarted = false
+	ctx.textBlockCited = false
+}
+
+// sendTextDelta 发送文本增量并累计 token
+func (ctx *StreamProcessorContext) sendTextDelta(index int, text string) {
+	textDeltaEvent := map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{
+			"type": "text_delta",
+			"text": text,
+		},
+	}
+
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, textDeltaEvent); err != nil {
+		utils.Log("发送文本 delta 失败", utils.LogErr(err))
+	}
+
+	ctx.totalOutputTokens += ctx.tokenEstimator.EstimateTextTokens(text)
+	ctx.recordText(text)
+}
+
+// applyStopSequences 对直传的文本增量匹配 stop_sequences
+// 返回 true 表示该事件已被吸收（文本全部暂缓或命中后为空），不需要继续处理
+func (esp *EventStreamProcessor) applyStopSequences(dataMap map[string]any) bool {
+	matcher := esp.ctx.stopSequences
+	if matcher == nil {
+		return false
+	}
+	delta, _ := dataMap["delta"].(map[string]any)
+	if deltaType, _ := delta["type"].(string); deltaType != "text_delta" {
+		return false
+	}
+	text, _ := delta["text"].(string)
+	text = matcher.Feed(text)
+	if matched := matcher.Matched(); matched != "" {
+		utils.Log("命中stop_sequence，结束消息",
+			addReqFields(esp.ctx.c, utils.LogString("stop_sequence", matched))...)
+	}
+	if text == "" {
+		return true
+	}
+	delta["text"] = text
+	return false
+}
+
+// flushStopSequenceHold 文本块结束前输出 stop_sequences 暂缓的文本
+// index 为即将结束的块（-1 表示任意仍在输出的文本块）；该块不是文本块时保留暂缓内容
+func (ctx *StreamProcessorContext) flushStopSequenceHold(index int) {
+	if ctx.stopSequences == nil {
+		return
+	}
+
+	target := -1
+	for blockIndex, block := range ctx.sseStateManager.GetActiveBlocks() {
+		if block.Type != "text" || !block.Started || block.Stopped {
+			continue
+		}
+		if index < 0 && blockIndex > target || blockIndex == index {
+			target = blockIndex
+		}
+	}
+	if target < 0 {
+		return
+	}
+	if held := ctx.stopSequences.Flush(); held != "" {
+		ctx.sendTextDelta(target, held)
+	}
+}
+
 // handleExceptionEvent 处理上游异常事件，检查是否需要映射为max_tokens
 // 返回true表示已处理并转换，不需要转发原始exception事件
 func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bool {
@@ -767,64 +1065,75 @@ func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bo
 	if exceptionType == "ContentLengthExceededException" ||
 		strings.Contains(exceptionType, "CONTENT_LENGTH_EXCEEDS") {
 
+		// 优先自动续写，续写次数用尽时才映射为 max_tokens
+		if esp.ctx.canContinue() {
+			esp.ctx.markInterrupted(continueReasonContentLength)
+			return true
+		}
+
 		utils.Log("检测到内容长度超限异常，映射为max_tokens stop_reason",
 			addReqFields(esp.ctx.c,
 				utils.LogString("exception_type", exceptionType),
 				utils.LogString("claude_stop_reason", "max_tokens"))...)
 
-		// 关闭所有活跃的content_block
-		activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
-		for index, block := range activeBlocks {
-			if block.Started && !block.Stopped {
-				stopEvent := map[string]any{
-					"type":  "content_block_stop",
-					"index": index,
-				}
-				_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
-			}
-		}
+		return esp.sendMaxTokensStop()
+	}
 
-		// 计算实际 input_tokens（扣除 cache_read）
-		actualInputTokens := esp.ctx.inputTokens
-		if esp.ctx.cacheResult != nil && esp.ctx.cacheResult.CacheReadTokens > 0 {
-			actualInputTokens = esp.ctx.inputTokens - esp.ctx.cacheResult.CacheReadTokens
-		}
+	// 其他类型的异常，正常转发
+	return false
+}
 
-		// 构造符合Claude规范的max_tokens响应
-		maxTokensEvent := map[string]any{
-			"type": "message_delta",
-			"delta": map[string]any{
-				"stop_reason":   "max_tokens",
-				"stop_sequence": nil,
-			},
-			"usage": map[string]any{
-				"input_tokens":  actualInputTokens,
-				"output_tokens": esp.ctx.totalOutputTokens,
-			},
+// sendMaxTokensStop 关闭所有内容块并以 max_tokens 结束消息
+func (esp *EventStreamProcessor) sendMaxTokensStop() bool {
+	// 关闭所有活跃的content_block
+	activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
+	for index, block := range activeBlocks {
+		if block.Started && !block.Stopped {
+			stopEvent := map[string]any{
+				"type":  "content_block_stop",
+				"index": index,
+			}
+			_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
 		}
+	}
 
-		// 发送max_tokens事件
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, maxTokensEvent); err != nil {
-			utils.Log("发送max_tokens响应失败", utils.LogErr(err))
-			return false
-		}
+	// 计算实际 input_tokens（扣除 cache_read）
+	actualInputTokens := esp.ctx.inputTokens
+	if esp.ctx.cacheResult != nil && esp.ctx.cacheResult.CacheReadTokens > 0 {
+		actualInputTokens = esp.ctx.inputTokens - esp.ctx.cacheResult.CacheReadTokens
+	}
 
-		// 发送message_stop事件
-		stopEvent := map[string]any{
-			"type": "message_stop",
-		}
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			utils.Log("发送message_stop失败", utils.LogErr(err))
-			return false
-		}
+	// 构造符合Claude规范的max_tokens响应
+	maxTokensEvent := map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   "max_tokens",
+			"stop_sequence": nil,
+		},
+		"usage": map[string]any{
+			"input_tokens":  actualInputTokens,
+			"output_tokens": esp.ctx.totalOutputTokens,
+		},
+	}
 
-		esp.ctx.c.Writer.Flush()
+	// 发送max_tokens事件
+	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, maxTokensEvent); err != nil {
+		utils.Log("发送max_tokens响应失败", utils.LogErr(err))
+		return false
+	}
 
-		return true // 已转换并发送，不转发原始exception
+	// 发送message_stop事件
+	stopEvent := map[string]any{
+		"type": "message_stop",
+	}
+	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
+		utils.Log("发送message_stop失败", utils.LogErr(err))
+		return false
 	}
 
-	// 其他类型的异常，正常转发
-	return false
+	esp.ctx.c.Writer.Flush()
+
+	return true // 已转换并发送，不转发原始exception
 }
 
 // 直传模式：无flush逻辑
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"kiro/config"
+)
+
+// 看门狗触发原因
+const (
+	watchdogReasonFirstEvent  = "first_event_timeout"
+	watchdogReasonIdle        = "idle_timeout"
+	watchdogReasonMaxDuration = "max_duration_exceeded"
+)
+
+// StreamTimeoutError 上游响应流被看门狗中断
+type StreamTimeoutError struct {
+	Reason string
+	Limit  time.Duration
+}
+
+func (e *StreamTimeoutError) Error() string {
+	switch e.Reason {
+	case watchdogReasonFirstEvent:
+		return fmt.Sprintf("Upstream did not send any event within %s", e.Limit)
+	case watchdogReasonIdle:
+		return fmt.Sprintf("Upstream stream stalled for more than %s", e.Limit)
+	default:
+		return fmt.Sprintf("Upstream stream exceeded the maximum duration of %s", e.Limit)
+	}
+}
+
+var (
+	// streamWatchdogConfig 当前生效的看门狗配置
+	streamWatchdogConfig = config.LoadStreamWatchdogConfig()
+
+	// watchdogTrips 各原因的触发次数（用于状态端点）
+	watchdogTrips      = map[string]int64{}
+	watchdogTripsMutex sync.Mutex
+)
+
+// initStreamWatchdog 按当前环境变量重新加载看门狗配置（.env 加载后调用）
+func initStreamWatchdog() {
+	streamWatchdogConfig = config.LoadStreamWatchdogConfig()
+}
+
+// snapshotWatchdogTrips 导出看门狗触发统计
+func snapshotWatchdogTrips() map[string]int64 {
+	watchdogTripsMutex.Lock()
+	defer watchdogTripsMutex.Unlock()
+
+	trips := make(map[string]int64, len(watchdogTrips))
+	for reason, count := range watchdogTrips {
+		trips[reason] = count
+	}
+	return trips
+}
+
+// StreamWatchdog 上游响应流看门狗
+// 设计原则：
+// - 单个定时器覆盖首事件、事件间隔、总时长三种限制，取最近的截止时间
+// - 触发时关闭上游响应体，使阻塞中的 Read 立即返回
+type StreamWatchdog struct {
+	mu      sync.Mutex
+	cfg     *config.StreamWatchdogConfig
+	body    io.Closer
+	timer   *time.Timer
+	seq     uint64 // 定时器序号，丢弃已过期定时器的回调
+	started time.Time
+	active  bool // 是否已收到首个事件
+	stopped bool
+	err     *StreamTimeoutError
+}
+
+// NewStreamWatchdog 创建看门狗并立即开始计时（从收到上游响应头开始）
+func NewStreamWatchdog(body io.Closer, cfg *config.StreamWatchdogConfig) *StreamWatchdog {
+	w := &StreamWatchdog{
+		cfg:     cfg,
+		body:    body,
+		started: time.Now(),
+	}
+	w.mu.Lock()
+	w.schedule()
+	w.mu.Unlock()
+	return w
+}
+
+// Touch 记录一次上游活动（收到事件），重置间隔计时
+func (w *StreamWatchdog) Touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.err != nil {
+		return
+	}
+	w.active = true
+	w.schedule()
+}
+
+// Stop 停止看门狗（流正常结束或已中断时调用）
+func (w *StreamWatchdog) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Err 返回触发原因，未触发时返回 nil
+func (w *StreamWatchdog) Err() *StreamTimeoutError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// schedule 计算下一个截止时间并重置定时器（调用方需持有锁）
+func (w *StreamWatchdog) schedule() {
+	now := time.Now()
+	var deadline time.Time
+	var reason string
+	var limit time.Duration
+
+	// 首事件 / 事件间隔
+	if !w.active && w.cfg.FirstEventTimeout > 0 {
+		deadline, reason, limit = w.started.Add(w.cfg.FirstEventTimeout), watchdogReasonFirstEvent, w.cfg.FirstEventTimeout
+	} else if w.active && w.cfg.IdleTimeout > 0 {
+		deadline, reason, limit = now.Add(w.cfg.IdleTimeout), watchdogReasonIdle, w.cfg.IdleTimeout
+	}
+
+	// 总时长
+	if w.cfg.MaxDuration > 0 {
+		total := w.started.Add(w.cfg.MaxDuration)
+		if deadline.IsZero() || total.Before(deadline) {
+			deadline, reason, limit = total, watchdogReasonMaxDuration, w.cfg.MaxDuration
+		}
+	}
+
+	w.seq++
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if deadline.IsZero() {
+		return
+	}
+
+	seq := w.seq
+	w.timer = time.AfterFunc(deadline.Sub(now), func() {
+		w.trip(seq, reason, limit)
+	})
+}
+
+// trip 看门狗触发：记录原因并关闭上游响应体
+func (w *StreamWatchdog) trip(seq uint64, reason string, limit time.Duration) {
+	w.mu.Lock()
+	if w.stopped || w.err != nil || seq != w.seq {
+		w.mu.Unlock()
+		return
+	}
+	timeoutErr := &StreamTimeoutError{Reason: reason, Limit: limit}
+	w.err = timeoutErr
+	w.mu.Unlock()
+
+	watchdogTripsMutex.Lock()
+	watchdogTrips[reason]++
+	watchdogTripsMutex.Unlock()
+
+	if w.body != nil {
+		if reporter, ok := w.body.(streamFailureReporter); ok {
+			reporter.reportStreamFailure(timeoutErr.Error())
+		}
+		_ = w.body.Close()
+	}
+}
+
+// streamFailureReporter 可接收流中断原因的响应体（如熔断器记录包装）
+type streamFailureReporter interface {
+	reportStreamFailure(reason string)
+}
+
+// watchdogReader 按读取到的字节记录活动（用于非流式整体读取响应体）
+type watchdogReader struct {
+	r  io.Reader
+	wd *StreamWatchdog
+}
+
+func (wr *watchdogReader) Read(p []byte) (int, error) {
+	n, err := wr.r.Read(p)
+	if n > 0 {
+		wr.wd.Touch()
+	}
+	return n, err
+}
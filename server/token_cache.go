@@ -25,6 +25,7 @@ type TokenCache struct {
 	RefreshToken string
 	LastRefresh  time.Time
 	TokenType    types.TokenType
+	AccountID    string
 	// AmazonQ 专用字段
 	ClientID     string
 	ClientSecret string
@@ -47,6 +48,14 @@ func sha256Hash(text string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+/**
+ * AccountID 由客户端 API Key 计算上游账号ID（SHA256 前 16 位）
+ * 用于按账号配置代理等场景，避免在配置文件中出现明文 token
+ */
+func AccountID(token string) string {
+	return sha256Hash(token)[:16]
+}
+
 /**
  * ParseToken 解析 token 格式，判断是 Kiro 还是 AmazonQ
  * AmazonQ 格式: clientId:clientSecret:refreshToken
@@ -63,7 +72,7 @@ func ParseToken(token string) (tokenType types.TokenType, clientID, clientSecret
 /**
  * RefreshAmazonQToken 刷新 AmazonQ token
  */
-func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, error) {
+func RefreshAmazonQToken(accountID, clientID, clientSecret, refreshToken string) (string, error) {
 	refreshReq := types.AmazonQRefreshRequest{
 		GrantType:    "refresh_token",
 		ClientID:     clientID,
@@ -86,7 +95,7 @@ func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, e
 	}
 	req.Header.Set("amz-sdk-invocation-id", utils.GenerateUUID())
 
-	client := utils.SharedHTTPClient
+	client := utils.HTTPClientForAccount(accountID)
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("请求失败: %v", err)
@@ -114,7 +123,7 @@ func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, e
 /**
  * RefreshKiroToken 刷新 Kiro token
  */
-func RefreshKiroToken(refreshToken string) (string, error) {
+func RefreshKiroToken(accountID, refreshToken string) (string, error) {
 	refreshReq := types.RefreshRequest{
 		RefreshToken: refreshToken,
 	}
@@ -131,7 +140,7 @@ func RefreshKiroToken(refreshToken string) (string, error) {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := utils.SharedHTTPClient
+	client := utils.HTTPClientForAccount(accountID)
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("请求失败: %v", err)
@@ -184,15 +193,16 @@ func GetOrRefreshToken(token string) (string, error) {
 
 		// 解析 token 类型
 		tokenType, clientID, clientSecret, refreshToken := ParseToken(token)
+		accountID := AccountID(token)
 
 		var accessToken string
 		var refreshErr error
 
 		switch tokenType {
 		case types.TokenTypeAmazonQ:
-			accessToken, refreshErr = RefreshAmazonQToken(clientID, clientSecret, refreshToken)
+			accessToken, refreshErr = RefreshAmazonQToken(accountID, clientID, clientSecret, refreshToken)
 		default:
-			accessToken, refreshErr = RefreshKiroToken(refreshToken)
+			accessToken, refreshErr = RefreshKiroToken(accountID, refreshToken)
 		}
 
 		// 获取类型名称用于日志
@@ -202,11 +212,11 @@ func GetOrRefreshToken(token string) (string, error) {
 		}
 
 		if refreshErr != nil {
-			utils.Error("AT 刷新失败 [%s]: %v", typeName, refreshErr)
+			utils.Error("AT 刷新失败 [%s] account=%s: %v", typeName, accountID, refreshErr)
 			return "", refreshErr
 		}
 
-		utils.Info("AT 刷新成功 [%s]", typeName)
+		utils.Info("AT 刷新成功 [%s] account=%s", typeName, accountID)
 
 		// 缓存
 		tokenMutex.Lock()
@@ -215,6 +225,7 @@ func GetOrRefreshToken(token string) (string, error) {
 			RefreshToken: refreshToken,
 			LastRefresh:  time.Now(),
 			TokenType:    tokenType,
+			AccountID:    accountID,
 			ClientID:     clientID,
 			ClientSecret: clientSecret,
 		}
@@ -268,13 +279,13 @@ func RefreshAllTokens() {
 
 		switch cache.TokenType {
 		case types.TokenTypeAmazonQ:
-			newToken, err = RefreshAmazonQToken(cache.ClientID, cache.ClientSecret, cache.RefreshToken)
+			newToken, err = RefreshAmazonQToken(cache.AccountID, cache.ClientID, cache.ClientSecret, cache.RefreshToken)
 		default:
-			newToken, err = RefreshKiroToken(cache.RefreshToken)
+			newToken, err = RefreshKiroToken(cache.AccountID, cache.RefreshToken)
 		}
 
 		if err != nil {
-			utils.Error("刷新 token 失败: %v", err)
+			utils.Error("刷新 token 失败 account=%s: %v", cache.AccountID, err)
 			tokenMutex.Lock()
 			delete(tokenMap, hash)
 			tokenMutex.Unlock()
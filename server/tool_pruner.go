@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// toolSelectionKey 本次请求的工具裁剪结果（续写请求复用同一结果）
+	toolSelectionKey = "tool_selection"
+	// toolPruningDisabledKey 模型请求了被裁剪的工具后，重试时关闭裁剪
+	toolPruningDisabledKey = "tool_pruning_disabled"
+
+	// toolPruneQueryMaxChars 参与相关性计算的对话文本上限（取最近的部分）
+	toolPruneQueryMaxChars = 20000
+	// toolNameTermWeight 查询词命中工具名时的权重（相对描述）
+	toolNameTermWeight = 3.0
+)
+
+// toolPruneStopwords 相关性计算忽略的常见词
+var toolPruneStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "this": true, "that": true, "from": true,
+	"are": true, "was": true, "you": true, "your": true, "can": true, "will": true, "use": true,
+	"not": true, "but": true, "have": true, "has": true, "all": true, "any": true, "into": true,
+	"of": true, "to": true, "in": true, "on": true, "is": true, "it": true, "be": true, "or": true,
+	"an": true, "as": true, "at": true, "by": true, "if": true, "do": true, "we": true, "me": true,
+}
+
+// toolPruningConfig 当前生效的工具裁剪配置
+var toolPruningConfig = config.LoadToolPruningConfig()
+
+// initToolPruning 按当前环境变量重新加载工具裁剪配置（.env 加载后调用）
+func initToolPruning() {
+	toolPruningConfig = config.LoadToolPruningConfig()
+	if toolPruningConfig.TopN > 0 {
+		utils.Info("工具裁剪已启用: top_n=%d, context_messages=%d",
+			toolPruningConfig.TopN, toolPruningConfig.ContextMessages)
+	}
+}
+
+// toolSelection 工具裁剪结果
+type toolSelection struct {
+	kept   []types.AnthropicTool
+	pruned map[string]bool // 被裁剪的工具名（原始名称）
+}
+
+// applyToolPruning 工具数超过 TopN 时只保留最相关的工具，返回发送给上游的请求
+// 历史中调用过的工具与 tool_choice 指定的工具始终保留
+func applyToolPruning(c *gin.Context, req types.AnthropicRequest) types.AnthropicRequest {
+	cfg := toolPruningConfig
+	if cfg.TopN <= 0 || len(req.Tools) <= cfg.TopN || c.GetBool(toolPruningDisabledKey) {
+		return req
+	}
+
+	selection, ok := c.Get(toolSelectionKey)
+	if !ok {
+		selection = selectRelevantTools(req, cfg)
+		c.Set(toolSelectionKey, selection)
+		s := selection.(*toolSelection)
+		utils.Info("工具已按相关性裁剪: kept=%d, pruned=%d, request_id=%s",
+			len(s.kept), len(s.pruned), GetRequestID(c))
+	}
+
+	out := req
+	out.Tools = selection.(*toolSelection).kept
+	return out
+}
+
+// isPrunedTool 模型请求的工具是否在本次请求中被裁剪掉
+func isPrunedTool(c *gin.Context, name string) bool {
+	if c.GetBool(toolPruningDisabledKey) {
+		return false
+	}
+	selection, ok := c.Get(toolSelectionKey)
+	return ok && selection.(*toolSelection).pruned[name]
+}
+
+// disableToolPruning 关闭本次请求后续上游调用的工具裁剪（发送完整工具集）
+func disableToolPruning(c *gin.Context) {
+	c.Set(toolPruningDisabledKey, true)
+}
+
+// prunedToolError 模型请求了被裁剪的工具且无法重试时的错误信息
+func prunedToolError(name string) string {
+	return fmt.Sprintf("The model requested the tool %q, which was not sent upstream because of tool pruning. "+
+		"Retry the request, or raise TOOL_PRUNE_TOP_N on the proxy.", name)
+}
+
+// selectRelevantTools 按与最近对话的词法相关性（TF-IDF）为工具排序，保留前 TopN 个
+// 保留的工具按原始顺序输出，避免顺序变化影响上游缓存
+func selectRelevantTools(req types.AnthropicRequest, cfg *config.ToolPruningConfig) *toolSelection {
+	// 必须保留：历史中调用过的工具、tool_choice 指定的工具
+	required := make(map[string]bool)
+	for _, msg := range req.Messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			if m, ok := block.(map[string]any); ok && m["type"] == "tool_use" {
+				if name, ok := m["name"].(string); ok {
+					required[name] = true
+				}
+			}
+		}
+	}
+	if name := toolChoiceName(req.ToolChoice); name != "" {
+		required[name] = true
+	}
+
+	// 查询：最近若干条消息的文本
+	start := max(len(req.Messages)-cfg.ContextMessages, 0)
+	var query strings.Builder
+	for _, msg := range req.Messages[start:] {
+		if text, err := utils.GetMessageContent(msg.Content); err == nil {
+			query.WriteString(text)
+			query.WriteString("\n")
+		}
+	}
+	queryText := query.String()
+	if len(queryText) > toolPruneQueryMaxChars {
+		queryText = queryText[len(queryText)-toolPruneQueryMaxChars:]
+	}
+	queryTerms := make(map[string]int)
+	for _, term := range relevanceTerms(queryText) {
+		queryTerms[term]++
+	}
+
+	// 工具文档词项与文档频率
+	type toolDoc struct {
+		index int
+		name  map[string]bool
+		desc  map[string]int
+		score float64
+	}
+	docs := make([]*toolDoc, len(req.Tools))
+	df := make(map[string]int)
+	for i, tool := range req.Tools {
+		doc := &toolDoc{index: i, name: make(map[string]bool), desc: make(map[string]int)}
+		for _, term := range relevanceTerms(tool.Name) {
+			doc.name[term] = true
+		}
+		for _, term := range relevanceTerms(tool.Description) {
+			doc.desc[term]++
+		}
+		seen := make(map[string]bool, len(doc.name)+len(doc.desc))
+		for term := range doc.name {
+			seen[term] = true
+		}
+		for term := range doc.desc {
+			seen[term] = true
+		}
+		for term := range seen {
+			df[term]++
+		}
+		docs[i] = doc
+	}
+
+	n := float64(len(req.Tools))
+	for _, doc := range docs {
+		for term, qtf := range queryTerms {
+			if df[term] == 0 {
+				continue
+			}
+			weight := 0.0
+			if doc.name[term] {
+				weight += toolNameTermWeight
+			}
+			if tf := doc.desc[term]; tf > 0 {
+				weight += 1 + math.Log(float64(tf))
+			}
+			if weight == 0 {
+				continue
+			}
+			idf := math.Log(1 + n/float64(df[term]))
+			doc.score += weight * idf * (1 + math.Log(float64(qtf)))
+		}
+	}
+
+	// 排序：必须保留的在前，其余按得分降序（同分保持原顺序）
+	ranked := append([]*toolDoc(nil), docs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, rj := required[req.Tools[ranked[i].index].Name], required[req.Tools[ranked[j].index].Name]
+		if ri != rj {
+			return ri
+		}
+		return ranked[i].score > ranked[j].score
+	})
+
+	keep := make(map[int]bool, cfg.TopN)
+	for i, doc := range ranked {
+		if i >= cfg.TopN && !required[req.Tools[doc.index].Name] {
+			break
+		}
+		keep[doc.index] = true
+	}
+
+	selection := &toolSelection{pruned: make(map[string]bool)}
+	for i, tool := range req.Tools {
+		if keep[i] {
+			selection.kept = append(selection.kept, tool)
+		} else {
+			selection.pruned[tool.Name] = true
+		}
+	}
+	return selection
+}
+
+// toolChoiceName 提取 tool_choice 指定的工具名（type=tool 时）
+func toolChoiceName(toolChoice any) string {
+	switch tc := toolChoice.(type) {
+	case map[string]any:
+		if tc["type"] == "tool" {
+			name, _ := tc["name"].(string)
+			return name
+		}
+	case *types.ToolChoice:
+		if tc != nil && tc.Type == "tool" {
+			return tc.Name
+		}
+	case types.ToolChoice:
+		if tc.Type == "tool" {
+			return tc.Name
+		}
+	}
+	return ""
+}
+
+// relevanceTerms 将文本切分为小写词项，拆分 snake_case、kebab-case 与 camelCase
+func relevanceTerms(text string) []string {
+	var terms []string
+	var current []rune
+	flush := func() {
+		if len(current) >= 2 {
+			term := strings.ToLower(string(current))
+			if !toolPruneStopwords[term] {
+				terms = append(terms, term)
+			}
+		}
+		current = current[:0]
+	}
+
+	runes := []rune(text)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		// camelCase 边界：小写后接大写
+		if unicode.IsUpper(r) && i > 0 && unicode.IsLower(runes[i-1]) {
+			flush()
+		}
+		current = append(current, r)
+	}
+	flush()
+	return terms
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// upstreamMetadataEvents 流式响应是否发送 upstream_metadata 事件
+var upstreamMetadataEvents = config.LoadUpstreamMetadataEvents()
+
+// initUpstreamMetadata 按当前环境变量重新加载配置（.env 加载后调用）
+func initUpstreamMetadata() {
+	upstreamMetadataEvents = config.LoadUpstreamMetadataEvents()
+}
+
+// recordUpstreamMetadata 汇总上游的代码引用、网页链接与后续提示（续写的多段响应合并到一起）
+func (ctx *StreamProcessorContext) recordUpstreamMetadata(dataMap map[string]any) {
+	metadata, ok := dataMap["metadata"].(*types.UpstreamMetadata)
+	if !ok {
+		return
+	}
+	if ctx.upstreamMetadata == nil {
+		ctx.upstreamMetadata = &types.UpstreamMetadata{}
+	}
+	ctx.upstreamMetadata.Merge(metadata)
+}
+
+// sendUpstreamMetadata 在 message_delta 之前发送汇总的 upstream_metadata 事件（需启用 UPSTREAM_METADATA_EVENTS）
+func (ctx *StreamProcessorContext) sendUpstreamMetadata() {
+	if ctx.upstreamMetadata.IsEmpty() {
+		return
+	}
+	utils.Log("上游返回引用元数据",
+		addReqFields(ctx.c,
+			utils.LogInt("code_references", len(ctx.upstreamMetadata.CodeReferences)),
+			utils.LogInt("web_links", len(ctx.upstreamMetadata.WebLinks)),
+			utils.LogInt("followup_prompts", len(ctx.upstreamMetadata.FollowupPrompts)),
+		)...)
+	if !upstreamMetadataEvents {
+		return
+	}
+	event := map[string]any{
+		"type":     "upstream_metadata",
+		"metadata": ctx.upstreamMetadata,
+	}
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+		utils.Log("发送 upstream_metadata 事件失败", utils.LogErr(err))
+	}
+}
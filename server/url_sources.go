@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// resolveURLSources 下载消息中的 URL 图片与文档，替换为内联数据源
+// 设计原则：
+// - 在请求校验之后执行，结构无效的请求不会触发下载；下载的图片按内联图片的规则校验，
+//   token 估算与格式转换只看到 base64/text 数据源
+// - 覆盖 {"type":"url"} 图片与文档来源、非 data: 的 image_url，以及 tool_result 中的图片
+// - 下载失败按无效请求返回，错误路径指向具体的内容块
+// - 单个请求的 URL 数量与抓取总时长有上限（URL_FETCH_MAX_PER_REQUEST、URL_FETCH_REQUEST_TIMEOUT）
+// - 返回新的消息切片，不修改原请求
+func resolveURLSources(ctx context.Context, messages []types.AnthropicRequestMessage) ([]types.AnthropicRequestMessage, error) {
+	maxSources, timeout := utils.URLFetchRequestLimits()
+	count := 0
+	for _, msg := range messages {
+		if blocks, ok := msg.Content.([]any); ok {
+			count += countBlockURLs(blocks)
+		}
+	}
+	if count == 0 {
+		return messages, nil
+	}
+	if count > maxSources {
+		return nil, fmt.Errorf("messages: too many URL sources in one request (%d, maximum %d)", count, maxSources)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out []types.AnthropicRequestMessage
+	for i, msg := range messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		resolved, changed, err := resolveBlockURLs(ctx, fmt.Sprintf("messages.%d.content", i), blocks)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(messages)
+		}
+		out[i].Content = resolved
+	}
+	if out == nil {
+		return messages, nil
+	}
+	return out, nil
+}
+
+// countBlockURLs 统计内容块数组中需要下载的 URL 来源数量（与 resolveBlockURL 的范围一致）
+func countBlockURLs(blocks []any) int {
+	count := 0
+	for _, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch block["type"] {
+		case "image", "document":
+			if source, _ := block["source"].(map[string]any); source["type"] == "url" {
+				count++
+			}
+		case "image_url":
+			imageURL, _ := block["image_url"].(map[string]any)
+			if rawURL, _ := imageURL["url"].(string); rawURL != "" && !strings.HasPrefix(rawURL, "data:") {
+				count++
+			}
+		case "tool_result":
+			if content, ok := block["content"].([]any); ok {
+				count += countBlockURLs(content)
+			}
+		}
+	}
+	return count
+}
+
+// resolveBlockURLs 处理内容块数组，有替换时返回新的数组
+func resolveBlockURLs(ctx context.Context, path string, blocks []any) ([]any, bool, error) {
+	var out []any
+	for j, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		blockPath := fmt.Sprintf("%s.%d", path, j)
+		replaced, err := resolveBlockURL(ctx, blockPath, block)
+		if err != nil {
+			return nil, false, err
+		}
+		if replaced == nil {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(blocks)
+		}
+		out[j] = replaced
+	}
+	return out, out != nil, nil
+}
+
+// resolveBlockURL 处理单个内容块，需要替换时返回新的块，否则返回 nil
+func resolveBlockURL(ctx context.Context, path string, block map[string]any) (map[string]any, error) {
+	switch block["type"] {
+	case "image":
+		source, _ := block["source"].(map[string]any)
+		if source["type"] != "url" {
+			return nil, nil
+		}
+		newSource, err := fetchImageSource(ctx, path+".source.url", source["url"])
+		if err != nil {
+			return nil, err
+		}
+		replaced := maps.Clone(block)
+		replaced["source"] = newSource
+		return replaced, nil
+
+	case "image_url":
+		imageURL, _ := block["image_url"].(map[string]any)
+		rawURL, _ := imageURL["url"].(string)
+		if rawURL == "" || strings.HasPrefix(rawURL, "data:") {
+			return nil, nil
+		}
+		newSource, err := fetchImageSource(ctx, path+".image_url.url", rawURL)
+		if err != nil {
+			return nil, err
+		}
+		replaced := map[string]any{"type": "image", "source": newSource}
+		if cacheControl, ok := block["cache_control"]; ok {
+			replaced["cache_control"] = cacheControl
+		}
+		return replaced, nil
+
+	case "document":
+		source, _ := block["source"].(map[string]any)
+		if source["type"] != "url" {
+			return nil, nil
+		}
+		newSource, err := fetchDocumentSource(ctx, path+".source.url", source["url"])
+		if err != nil {
+			return nil, err
+		}
+		replaced := maps.Clone(block)
+		replaced["source"] = newSource
+		return replaced, nil
+
+	case "tool_result":
+		content, ok := block["content"].([]any)
+		if !ok {
+			return nil, nil
+		}
+		resolved, changed, err := resolveBlockURLs(ctx, path+".content", content)
+		if err != nil || !changed {
+			return nil, err
+		}
+		replaced := maps.Clone(block)
+		replaced["content"] = resolved
+		return replaced, nil
+	}
+	return nil, nil
+}
+
+// fetchImageSource 下载图片并返回 base64 数据源
+func fetchImageSource(ctx context.Context, path string, rawURL any) (map[string]any, error) {
+	fetched, err := fetchSourceURL(ctx, path, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !utils.IsSupportedImageFormat(fetched.MediaType) {
+		return nil, fmt.Errorf("%s: URL did not return a supported image (got %s)", path, fetched.MediaType)
+	}
+	data := base64.StdEncoding.EncodeToString(fetched.Data)
+	if err := validateImageData(path, fetched.MediaType, data); err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"type":       "base64",
+		"media_type": fetched.MediaType,
+		"data":       data,
+	}, nil
+}
+
+// fetchDocumentSource 下载文档：PDF 转为 base64 数据源，文本转为 text 数据源
+func fetchDocumentSource(ctx context.Context, path string, rawURL any) (map[string]any, error) {
+	fetched, err := fetchSourceURL(ctx, path, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fetched.MediaType == "application/pdf":
+		return map[string]any{
+			"type":       "base64",
+			"media_type": "application/pdf",
+			"data":       base64.StdEncoding.EncodeToString(fetched.Data),
+		}, nil
+	case utils.IsTextMediaType(fetched.MediaType):
+		text, err := utils.DecodeDocumentText(fetched.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: URL returned text that is not valid UTF-8", path)
+		}
+		return map[string]any{"type": "text", "media_type": "text/plain", "data": text}, nil
+	default:
+		return nil, fmt.Errorf("%s: URL did not return a PDF or text document (got %s)", path, fetched.MediaType)
+	}
+}
+
+// fetchSourceURL 下载 URL，错误信息带上内容块路径
+func fetchSourceURL(ctx context.Context, path string, rawURL any) (*utils.FetchedContent, error) {
+	urlStr, _ := rawURL.(string)
+	if urlStr == "" {
+		return nil, fmt.Errorf("%s: Field required", path)
+	}
+	fetched, err := utils.FetchURL(ctx, urlStr)
+	if err != nil {
+		if ctx.Err() != nil {
+			_, timeout := utils.URLFetchRequestLimits()
+			return nil, fmt.Errorf("%s: URL sources of this request were not fetched within %s", path, timeout)
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return fetched, nil
+}
@@ -17,16 +17,19 @@ type ToolChoice struct {
 
 // AnthropicRequest 表示 Anthropic API 的请求结构
 type AnthropicRequest struct {
-	Model       string                    `json:"model"`
-	MaxTokens   int                       `json:"max_tokens"`
-	Messages    []AnthropicRequestMessage `json:"messages"`
-	System      SystemMessages            `json:"system,omitempty"`
-	Tools       []AnthropicTool           `json:"tools,omitempty"`
-	ToolChoice  any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
-	Stream      bool                      `json:"stream"`
-	Temperature *float64                  `json:"temperature,omitempty"`
-	Metadata    map[string]any            `json:"metadata,omitempty"`
-	Thinking    *ThinkingConfig           `json:"thinking,omitempty"` // Thinking 模式配置
+	Model         string                    `json:"model"`
+	MaxTokens     int                       `json:"max_tokens"`
+	Messages      []AnthropicRequestMessage `json:"messages"`
+	System        SystemMessages            `json:"system,omitempty"`
+	Tools         []AnthropicTool           `json:"tools,omitempty"`
+	ToolChoice    any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
+	Stream        bool                      `json:"stream"`
+	Temperature   *float64                  `json:"temperature,omitempty"`
+	TopP          *float64                  `json:"top_p,omitempty"`
+	TopK          *int                      `json:"top_k,omitempty"`
+	StopSequences []string                  `json:"stop_sequences,omitempty"`
+	Metadata      map[string]any            `json:"metadata,omitempty"`
+	Thinking      *ThinkingConfig           `json:"thinking,omitempty"` // Thinking 模式配置
 }
 
 // ThinkingConfig 表示 Thinking 模式配置
@@ -102,18 +105,29 @@ type ContentBlock struct {
 	Type         string        `json:"type"`
 	Text         *string       `json:"text,omitempty"`
 	ToolUseId    *string       `json:"tool_use_id,omitempty"`
-	Content      any           `json:"content,omitempty"`  // tool_result的内容，可以是string、[]any或map[string]any
-	Name         *string       `json:"name,omitempty"`     // tool_use的名称
-	Input        *any          `json:"input,omitempty"`    // tool_use的输入参数
-	ID           *string       `json:"id,omitempty"`       // tool_use的唯一标识符
-	IsError      *bool         `json:"is_error,omitempty"` // tool_result是否表示错误
-	Source       *ImageSource  `json:"source,omitempty"`   // 图片数据源
+	Content      any           `json:"content,omitempty"`   // tool_result的内容，可以是string、[]any或map[string]any
+	Name         *string       `json:"name,omitempty"`      // tool_use的名称
+	Input        *any          `json:"input,omitempty"`     // tool_use的输入参数
+	ID           *string       `json:"id,omitempty"`        // tool_use的唯一标识符
+	IsError      *bool         `json:"is_error,omitempty"`  // tool_result是否表示错误
+	Source       *ImageSource  `json:"source,omitempty"`    // 图片或文档数据源
+	Title        *string       `json:"title,omitempty"`     // document的标题
+	Context      *string       `json:"context,omitempty"`   // document的补充说明
+	Citations    *Citations    `json:"citations,omitempty"` // document的引用设置
 	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
-// ImageSource 表示图片数据源的结构
+// Citations 文档的引用设置
+type Citations struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ImageSource 表示图片或文档数据源的结构
 type ImageSource struct {
-	Type      string `json:"type"`       // "base64"
-	MediaType string `json:"media_type"` // "image/jpeg", "image/png", "image/gif", "image/webp"
-	Data      string `json:"data"`       // base64编码的图片数据
+	Type      string `json:"type"`              // "base64"、"url"、"file"，文档另有 "text"、"content"
+	MediaType string `json:"media_type"`        // "image/jpeg"、"image/png"、"application/pdf"、"text/plain" 等
+	Data      string `json:"data"`              // base64编码的数据（文档 text 类型为原文）
+	URL       string `json:"url,omitempty"`     // url 类型的地址
+	FileID    string `json:"file_id,omitempty"` // file 类型引用的 Files API 文件
+	Content   any    `json:"content,omitempty"` // 文档 content 类型的内容块
 }
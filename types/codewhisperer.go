@@ -30,9 +30,11 @@ type CodeWhispererRequest struct {
 }
 
 // InferenceConfig 推理配置参数
+// 采样参数使用指针，显式设置的 0 也会发送
 type InferenceConfig struct {
-	MaxTokens   int     `json:"maxTokens,omitempty"`
-	Temperature float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"topP,omitempty"`
 }
 
 // CodeWhispererImage 表示 CodeWhisperer API 的图片结构
@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+// FileObject 符合 Anthropic Files API 规范的文件元数据
+// 参考: https://docs.anthropic.com/en/api/files-metadata
+type FileObject struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"` // 固定为 "file"
+	Filename     string    `json:"filename"`
+	MimeType     string    `json:"mime_type"`
+	SizeBytes    int64     `json:"size_bytes"`
+	CreatedAt    time.Time `json:"created_at"`
+	Downloadable bool      `json:"downloadable"`
+}
+
+// FileListResponse 文件列表响应
+type FileListResponse struct {
+	Data    []FileObject `json:"data"`
+	FirstID *string      `json:"first_id"`
+	LastID  *string      `json:"last_id"`
+	HasMore bool         `json:"has_more"`
+}
+
+// FileDeletedResponse 删除文件响应
+type FileDeletedResponse struct {
+	ID   string `json:"id"`
+	Type string `json:"type"` // 固定为 "file_deleted"
+}
@@ -65,6 +65,13 @@ type SSETextContentBlock struct {
 	Text string `json:"text"`
 }
 
+// SSECitedTextContentBlock 带引用的文本内容块（citations 字段始终显示，由后续 citations_delta 填充）
+type SSECitedTextContentBlock struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Citations []any  `json:"citations"`
+}
+
 // SSEThinkingContentBlock thinking 内容块（需要包含空 thinking 字段）
 type SSEThinkingContentBlock struct {
 	Type      string `json:"type"`
@@ -84,6 +91,12 @@ type SignatureDeltaBlock struct {
 	Signature string `json:"signature"`
 }
 
+// CitationsDeltaBlock citations 增量块
+type CitationsDeltaBlock struct {
+	Type     string `json:"type"`
+	Citation any    `json:"citation"`
+}
+
 // ContentBlockDeltaEvent content_block_delta 事件
 // 字段顺序: type, index, delta (与官方 Claude API 一致)
 type ContentBlockDeltaEvent struct {
@@ -290,12 +303,13 @@ func NewContentBlockStopEvent(index int) *ContentBlockStopEvent {
 	}
 }
 
-// NewMessageDeltaEvent 创建 message_delta 事件
-func NewMessageDeltaEvent(stopReason string, usage *UsageInfo) *MessageDeltaEvent {
+// NewMessageDeltaEvent 创建 message_delta 事件（stopSequence 为 nil 时输出 null）
+func NewMessageDeltaEvent(stopReason string, stopSequence *string, usage *UsageInfo) *MessageDeltaEvent {
 	return &MessageDeltaEvent{
 		Type: "message_delta",
 		Delta: &MessageDeltaInfo{
-			StopReason: stopReason,
+			StopReason:   stopReason,
+			StopSequence: stopSequence,
 		},
 		Usage: usage,
 	}
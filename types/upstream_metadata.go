@@ -0,0 +1,132 @@
+package types
+
+// UpstreamMetadata 上游响应附带的代码引用、网页链接与后续提示
+// 非流式响应以扩展字段 upstream_metadata 返回；流式响应在启用后以 upstream_metadata 事件发送
+type UpstreamMetadata struct {
+	CodeReferences  []MetadataCodeReference  `json:"code_references,omitempty"`
+	WebLinks        []MetadataWebLink        `json:"web_links,omitempty"`
+	FollowupPrompts []MetadataFollowupPrompt `json:"followup_prompts,omitempty"`
+}
+
+// MetadataCodeReference 生成代码的许可证引用
+type MetadataCodeReference struct {
+	LicenseName string       `json:"license_name,omitempty"`
+	Repository  string       `json:"repository,omitempty"`
+	URL         string       `json:"url,omitempty"`
+	Information string       `json:"information,omitempty"`
+	Span        *ContentSpan `json:"span,omitempty"` // 被引用代码在上游回复中的区间
+}
+
+// MetadataWebLink 补充网页链接
+type MetadataWebLink struct {
+	URL     string `json:"url"`
+	Title   string `json:"title,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// MetadataFollowupPrompt 建议的后续提问
+type MetadataFollowupPrompt struct {
+	Content    string `json:"content"`
+	UserIntent string `json:"user_intent,omitempty"`
+}
+
+// NewUpstreamMetadata 提取助手响应事件中的引用、链接与后续提示，没有时返回 nil
+func NewUpstreamMetadata(event *AssistantResponseEvent) *UpstreamMetadata {
+	m := &UpstreamMetadata{}
+	for _, refs := range [][]Reference{event.References, event.CodeReference} {
+		for _, ref := range refs {
+			m.addCodeReference(MetadataCodeReference{
+				LicenseName: derefString(ref.LicenseName),
+				Repository:  derefString(ref.Repository),
+				URL:         derefString(ref.URL),
+				Information: derefString(ref.Information),
+				Span:        ref.RecommendationContentSpan,
+			})
+		}
+	}
+	for _, link := range event.SupplementaryWebLinks {
+		m.addWebLink(MetadataWebLink{URL: link.URL, Title: derefString(link.Title), Snippet: derefString(link.Snippet)})
+	}
+	if prompt := event.FollowupPrompt; prompt != nil && prompt.Content != "" {
+		followup := MetadataFollowupPrompt{Content: prompt.Content}
+		if prompt.UserIntent != nil {
+			followup.UserIntent = string(*prompt.UserIntent)
+		}
+		m.addFollowupPrompt(followup)
+	}
+	if m.IsEmpty() {
+		return nil
+	}
+	return m
+}
+
+// Merge 合并另一份元数据，重复的条目只保留一次
+func (m *UpstreamMetadata) Merge(other *UpstreamMetadata) {
+	if other == nil {
+		return
+	}
+	for _, ref := range other.CodeReferences {
+		m.addCodeReference(ref)
+	}
+	for _, link := range other.WebLinks {
+		m.addWebLink(link)
+	}
+	for _, prompt := range other.FollowupPrompts {
+		m.addFollowupPrompt(prompt)
+	}
+}
+
+// IsEmpty 是否没有任何条目
+func (m *UpstreamMetadata) IsEmpty() bool {
+	return m == nil || len(m.CodeReferences) == 0 && len(m.WebLinks) == 0 && len(m.FollowupPrompts) == 0
+}
+
+func (m *UpstreamMetadata) addCodeReference(ref MetadataCodeReference) {
+	if ref.LicenseName == "" && ref.Repository == "" && ref.URL == "" {
+		return
+	}
+	for _, existing := range m.CodeReferences {
+		if existing.LicenseName == ref.LicenseName && existing.Repository == ref.Repository &&
+			existing.URL == ref.URL && sameSpan(existing.Span, ref.Span) {
+			return
+		}
+	}
+	m.CodeReferences = append(m.CodeReferences, ref)
+}
+
+func (m *UpstreamMetadata) addWebLink(link MetadataWebLink) {
+	if link.URL == "" {
+		return
+	}
+	for _, existing := range m.WebLinks {
+		if existing.URL == link.URL {
+			return
+		}
+	}
+	m.WebLinks = append(m.WebLinks, link)
+}
+
+func (m *UpstreamMetadata) addFollowupPrompt(prompt MetadataFollowupPrompt) {
+	for _, existing := range m.FollowupPrompts {
+		if existing.Content == prompt.Content {
+			return
+		}
+	}
+	m.FollowupPrompts = append(m.FollowupPrompts, prompt)
+}
+
+// sameSpan 比较两个区间是否相同（都为空视为相同）
+func sameSpan(a, b *ContentSpan) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// derefString 安全取字符串指针的值
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -2,9 +2,13 @@ package utils
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"kiro/config"
@@ -12,38 +16,108 @@ import (
 
 var (
 	// SharedHTTPClient 共享的HTTP客户端实例，优化了连接池和性能配置
+	// 使用全局出站代理（未配置时直连）
 	SharedHTTPClient *http.Client
+
+	// networkConfig 当前生效的出站网络配置
+	networkConfig = &config.NetworkConfig{AccountProxies: map[string]string{}}
+	// proxyClients 按代理URL复用的客户端（同一代理共享连接池）
+	proxyClients = map[string]*http.Client{}
+	// tlsClientConfig 所有客户端共用的TLS配置
+	tlsClientConfig *tls.Config
+	clientsMutex    sync.RWMutex
 )
 
 func init() {
-	// 检查TLS配置并记录日志
-	skipTLS := shouldSkipTLSVerify()
-	if skipTLS {
+	if err := InitHTTPClients(); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("[WARNING] 出站网络配置无效，回退为直连: %v\n", err))
+		clientsMutex.Lock()
+		networkConfig = &config.NetworkConfig{AccountProxies: map[string]string{}}
+		tlsClientConfig = newTLSConfig(nil, false)
+		SharedHTTPClient = newHTTPClient(nil)
+		proxyClients = map[string]*http.Client{}
+		clientsMutex.Unlock()
+	}
+}
+
+// InitHTTPClients 按环境变量（重新）构建出站HTTP客户端
+// 在 .env 加载完成后调用，使代理与证书配置生效
+func InitHTTPClients() error {
+	cfg, err := config.LoadNetworkConfig()
+	if err != nil {
+		return err
+	}
+
+	var rootCAs *x509.CertPool
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return fmt.Errorf("读取 TLS_CA_BUNDLE 失败: %v", err)
+		}
+		rootCAs, err = x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("TLS_CA_BUNDLE 中没有有效的 PEM 证书: %s", cfg.CABundle)
+		}
+	}
+
+	if cfg.InsecureSkipVerify {
 		os.Stderr.WriteString("[WARNING] TLS证书验证已禁用 - 仅适用于开发/调试环境\n")
 	}
 
-	// 创建统一的HTTP客户端
-	SharedHTTPClient = &http.Client{
+	var globalProxy *url.URL
+	if cfg.ProxyURL != "" {
+		globalProxy, _ = config.ParseProxyURL(cfg.ProxyURL)
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	networkConfig = cfg
+	tlsClientConfig = newTLSConfig(rootCAs, cfg.InsecureSkipVerify)
+	proxyClients = map[string]*http.Client{}
+	SharedHTTPClient = newHTTPClient(globalProxy)
+	return nil
+}
+
+// newTLSConfig 创建TLS配置
+func newTLSConfig(rootCAs *x509.CertPool, insecure bool) *tls.Config {
+	return &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: insecure,
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_128_GCM_SHA256,
+		},
+	}
+}
+
+// newHTTPClient 创建HTTP客户端，proxyURL 为 nil 时直连
+// http/https 代理走 CONNECT 隧道，socks5/socks5h 由标准库拨号（均支持 URL 内认证）
+func newHTTPClient(proxyURL *url.URL) *http.Client {
+	var proxy func(*http.Request) (*url.URL, error)
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
 		Transport: &http.Transport{
+			Proxy: proxy,
+
 			// 连接建立配置
 			DialContext: (&net.Dialer{
 				Timeout:   15 * time.Second,
 				KeepAlive: config.HTTPClientKeepAlive,
-				DualStack: true,
 			}).DialContext,
 
 			// TLS配置
 			TLSHandshakeTimeout: config.HTTPClientTLSHandshakeTimeout,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTLS,
-				MinVersion:         tls.VersionTLS12,
-				MaxVersion:         tls.VersionTLS13,
-				CipherSuites: []uint16{
-					tls.TLS_AES_256_GCM_SHA384,
-					tls.TLS_CHACHA20_POLY1305_SHA256,
-					tls.TLS_AES_128_GCM_SHA256,
-				},
-			},
+			TLSClientConfig:     tlsClientConfig.Clone(),
 
 			// HTTP配置
 			ForceAttemptHTTP2:  false,
@@ -52,12 +126,43 @@ func init() {
 	}
 }
 
-// shouldSkipTLSVerify 根据GIN_MODE决定是否跳过TLS证书验证
-func shouldSkipTLSVerify() bool {
-	return os.Getenv("GIN_MODE") == "debug"
+// HTTPClientForAccount 获取指定上游账号使用的HTTP客户端
+// 账号未单独配置代理时返回全局客户端；配置为 "direct" 时强制直连
+func HTTPClientForAccount(accountID string) *http.Client {
+	clientsMutex.RLock()
+	proxy, ok := networkConfig.AccountProxies[accountID]
+	if !ok || accountID == "" {
+		defer clientsMutex.RUnlock()
+		return SharedHTTPClient
+	}
+	if client, exists := proxyClients[proxy]; exists {
+		clientsMutex.RUnlock()
+		return client
+	}
+	clientsMutex.RUnlock()
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if client, exists := proxyClients[proxy]; exists {
+		return client
+	}
+
+	var proxyURL *url.URL
+	if proxy != config.ProxyDirect {
+		// 配置加载时已校验
+		proxyURL, _ = config.ParseProxyURL(proxy)
+	}
+	client := newHTTPClient(proxyURL)
+	proxyClients[proxy] = client
+	return client
 }
 
 // DoRequest 执行HTTP请求
 func DoRequest(req *http.Request) (*http.Response, error) {
 	return SharedHTTPClient.Do(req)
 }
+
+// DoRequestForAccount 使用账号对应的出站客户端执行HTTP请求
+func DoRequestForAccount(req *http.Request, accountID string) (*http.Response, error) {
+	return HTTPClientForAccount(accountID).Do(req)
+}
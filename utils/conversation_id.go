@@ -2,78 +2,125 @@ package utils
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
-	"sync"
-	"time"
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
 
 	"github.com/gin-gonic/gin"
 )
 
+// conversationIDContextKey 本次请求已解析的会话ID（上下文压缩、续写等改写请求后保持不变）
+const conversationIDContextKey = "conversation_id"
+
 // ConversationIDManager 会话ID管理器 (SOLID-SRP: 单一职责)
-type ConversationIDManager struct {
-	mu    sync.RWMutex      // 保护cache的并发访问
-	cache map[string]string // 简单的内存缓存，生产环境可以使用Redis
-}
+// 设计原则：
+// - 会话标识来自请求内容：metadata.user_id、API Key 与对话开头的指纹，与客户端 IP、时间无关
+// - 同一对话的后续请求只在末尾追加消息，开头不变，因此ID在整个对话中保持稳定
+// - ID 可由请求确定性地重新计算，无需缓存
+type ConversationIDManager struct{}
 
 // NewConversationIDManager 创建新的会话ID管理器
 func NewConversationIDManager() *ConversationIDManager {
-	return &ConversationIDManager{
-		cache: make(map[string]string),
-	}
+	return &ConversationIDManager{}
 }
 
-// GenerateConversationID 基于客户端信息生成稳定的会话ID
-// 遵循KISS原则：使用客户端特征生成稳定的标识符
-func (c *ConversationIDManager) GenerateConversationID(ctx *gin.Context) string {
-	// 从请求头中获取客户端标识信息
-	clientIP := ctx.ClientIP()
-	userAgent := ctx.GetHeader("User-Agent")
-
+// GenerateConversationID 基于请求内容生成稳定的会话ID
+// 优先级：X-Conversation-ID 请求头 > 本次请求已解析的ID > metadata.user_id + API Key + 对话开头指纹
+func (c *ConversationIDManager) GenerateConversationID(ctx *gin.Context, req *types.AnthropicRequest) string {
 	// 检查是否有自定义的会话ID头（优先级最高）
 	if customConvID := ctx.GetHeader("X-Conversation-ID"); customConvID != "" {
 		return customConvID
 	}
-
-	// 为避免过于细粒度的会话分割，使用时间窗口来保持会话持久性
-	// 每小时内的同一客户端使用相同的conversationId
-	timeWindow := time.Now().Format("2006010215") // 精确到小时
-
-	// 构建客户端特征字符串
-	clientSignature := fmt.Sprintf("%s|%s|%s", clientIP, userAgent, timeWindow)
-
-	// 检查缓存 (使用读锁)
-	c.mu.RLock()
-	if cachedID, exists := c.cache[clientSignature]; exists {
-		c.mu.RUnlock()
-		return cachedID
+	if id := ctx.GetString(conversationIDContextKey); id != "" {
+		return id
 	}
-	c.mu.RUnlock()
 
-	// 生成基于特征的MD5哈希
-	hash := md5.Sum([]byte(clientSignature))
-	conversationID := fmt.Sprintf("conv-%x", hash[:8]) // 使用前8字节，保持简洁
+	hash := md5.Sum([]byte(buildConversationSignature(ctx, req)))
+	id := fmt.Sprintf("conv-%x", hash[:8]) // 使用前8字节，保持简洁
+	ctx.Set(conversationIDContextKey, id)
+	return id
+}
 
-	// 缓存结果 (使用写锁，YAGNI: 简单内存缓存，未来可扩展为持久化)
-	c.mu.Lock()
-	c.cache[clientSignature] = conversationID
-	c.mu.Unlock()
+// buildConversationSignature 构建会话特征签名 (SOLID-SRP: 单一职责)
+// 由 metadata.user_id、API Key 与对话开头（system 的稳定前缀 + 首轮用户输入）组成
+func buildConversationSignature(ctx *gin.Context, req *types.AnthropicRequest) string {
+	userID := ""
+	if req != nil {
+		userID, _ = req.Metadata["user_id"].(string)
+	}
+	apiKey := ctx.GetHeader("x-api-key")
+	if apiKey == "" {
+		apiKey = strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	}
+	apiKeyHash := md5.Sum([]byte(apiKey))
 
-	return conversationID
+	return fmt.Sprintf("%s|%x|%s", userID, apiKeyHash, conversationFingerprint(req))
 }
 
-// GetOrCreateConversationID 获取或创建会话ID
-func (c *ConversationIDManager) GetOrCreateConversationID(ctx *gin.Context) string {
-	return c.GenerateConversationID(ctx)
+// conversationFingerprint 对话开头的指纹
+// 取首轮用户输入（第一条 assistant 消息之前的全部消息）：后续轮次只在末尾追加，开头在整个对话中保持不变。
+// system 只取前 ConversationSystemPrefixBytes 字节：客户端常在 system 末尾嵌入日期、git 状态、工作目录等动态信息，
+// 整段哈希会让同一对话中途换ID。只哈希角色、块类型与文本/数据源，忽略 cache_control
+func conversationFingerprint(req *types.AnthropicRequest) string {
+	if req == nil {
+		return ""
+	}
+	h := md5.New()
+	var system strings.Builder
+	for _, sys := range req.System {
+		system.WriteString(sys.Text)
+		system.WriteString("\n")
+	}
+	systemText := system.String()
+	if len(systemText) > config.ConversationSystemPrefixBytes {
+		systemText = systemText[:config.ConversationSystemPrefixBytes]
+	}
+	h.Write([]byte(systemText + "|"))
+	for _, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			break
+		}
+		h.Write([]byte("|" + msg.Role + "|"))
+		if content, err := json.Marshal(fingerprintContent(msg.Content)); err == nil {
+			h.Write(content)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-// InvalidateOldSessions 清理过期的会话缓存
-// SOLID-SRP: 单独的清理职责，避免内存泄漏
-func (c *ConversationIDManager) InvalidateOldSessions() {
-	// 简单实现：清空所有缓存，依赖时间窗口重新生成
-	// 生产环境可以实现基于TTL的精确清理
-	c.mu.Lock()
-	c.cache = make(map[string]string)
-	c.mu.Unlock()
+// fingerprintContent 规范化消息内容用于计算指纹
+// 字符串内容等同于单个文本块，内容块（包括嵌套的 tool_result 内容）去掉 cache_control
+func fingerprintContent(content any) any {
+	switch v := content.(type) {
+	case string:
+		return []any{map[string]any{"type": "text", "text": v}}
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			block, ok := item.(map[string]any)
+			if !ok {
+				out[i] = item
+				continue
+			}
+			normalized := make(map[string]any, len(block))
+			for key, value := range block {
+				if key == "cache_control" {
+					continue
+				}
+				if key == "content" {
+					value = fingerprintContent(value)
+				}
+				normalized[key] = value
+			}
+			out[i] = normalized
+		}
+		return out
+	default:
+		return content
+	}
 }
 
 // 全局实例 - 单例模式 (SOLID-DIP: 提供抽象访问)
@@ -81,13 +128,13 @@ var globalConversationIDManager = NewConversationIDManager()
 
 // GenerateStableConversationID 生成稳定的会话ID的全局函数
 // 为了向后兼容和简化调用，提供全局访问函数
-func GenerateStableConversationID(ctx *gin.Context) string {
-	return globalConversationIDManager.GetOrCreateConversationID(ctx)
+func GenerateStableConversationID(ctx *gin.Context, req *types.AnthropicRequest) string {
+	return globalConversationIDManager.GenerateConversationID(ctx, req)
 }
 
 // GenerateStableAgentContinuationID 生成稳定的代理延续GUID
-// 基于客户端特征生成确定性的标准GUID格式，遵循SOLID-SRP原则
-func GenerateStableAgentContinuationID(ctx *gin.Context) string {
+// 与会话ID使用相同的请求特征（metadata.user_id、API Key、对话开头指纹），与客户端 IP、时间无关
+func GenerateStableAgentContinuationID(ctx *gin.Context, req *types.AnthropicRequest) string {
 	// 向后兼容：如果没有提供context，使用随机UUID
 	if ctx == nil {
 		return GenerateUUID()
@@ -98,23 +145,8 @@ func GenerateStableAgentContinuationID(ctx *gin.Context) string {
 		return customAgentID
 	}
 
-	// 提取客户端特征信息
-	clientSignature := buildAgentClientSignature(ctx)
-
 	// 生成确定性GUID
-	return generateDeterministicGUID(clientSignature, "agent")
-}
-
-// buildAgentClientSignature 构建代理客户端特征签名 (SOLID-SRP: 单一职责)
-func buildAgentClientSignature(ctx *gin.Context) string {
-	clientIP := ctx.ClientIP()
-	userAgent := ctx.GetHeader("User-Agent")
-
-	// 统一使用1小时时间窗口，与ConversationId保持一致
-	// 确保在同一会话内AgentContinuationId保持稳定
-	timeWindow := time.Now().Format("2006010215") // 精确到小时
-
-	return fmt.Sprintf("agent|%s|%s|%s", clientIP, userAgent, timeWindow)
+	return generateDeterministicGUID(buildConversationSignature(ctx, req), "agent")
 }
 
 // generateDeterministicGUID 基于输入字符串生成确定性GUID (SOLID-SRP: 单一职责)
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newConversationTestContext 创建带请求头的测试上下文
+func newConversationTestContext(headers map[string]string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	return c
+}
+
+// newConversationTestRequest 构造包含 system 与若干轮消息的请求
+func newConversationTestRequest(userID string, messages ...string) *types.AnthropicRequest {
+	req := &types.AnthropicRequest{
+		Model:  "claude-sonnet-4-5",
+		System: types.SystemMessages{{Type: "text", Text: "You are a helpful assistant."}},
+	}
+	if userID != "" {
+		req.Metadata = map[string]any{"user_id": userID}
+	}
+	for i, text := range messages {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		req.Messages = append(req.Messages, types.AnthropicRequestMessage{Role: role, Content: text})
+	}
+	return req
+}
+
+func TestConversationIDStableAcrossTurns(t *testing.T) {
+	m := NewConversationIDManager()
+	headers := map[string]string{"x-api-key": "key-a", "User-Agent": "client/1.0"}
+
+	first := m.GenerateConversationID(newConversationTestContext(headers), newConversationTestRequest("user-1", "hello"))
+	// 对话追加了新的轮次
+	second := m.GenerateConversationID(newConversationTestContext(headers),
+		newConversationTestRequest("user-1", "hello", "Hi! How can I help?", "tell me a joke"))
+
+	if first != second {
+		t.Fatalf("conversation id changed across turns: %s != %s", first, second)
+	}
+}
+
+func TestConversationIDIgnoresDynamicSystemSuffix(t *testing.T) {
+	m := NewConversationIDManager()
+	headers := map[string]string{"x-api-key": "key-a"}
+	prefix := strings.Repeat("You are a coding assistant. ", 40)
+
+	first := newConversationTestRequest("user-1", "hello")
+	first.System = types.SystemMessages{{Type: "text", Text: prefix + "Today's date is 2025-01-01. cwd: /repo"}}
+	later := newConversationTestRequest("user-1", "hello", "Hi! How can I help?", "tell me a joke")
+	later.System = types.SystemMessages{{Type: "text", Text: prefix + "Today's date is 2025-01-02. cwd: /repo/sub"}}
+
+	a := m.GenerateConversationID(newConversationTestContext(headers), first)
+	b := m.GenerateConversationID(newConversationTestContext(headers), later)
+	if a != b {
+		t.Fatalf("dynamic system prompt suffix changed the conversation id: %s != %s", a, b)
+	}
+}
+
+func TestAgentContinuationIDUsesRequestIdentity(t *testing.T) {
+	// 同一 NAT 出口：IP 与 User-Agent 完全相同
+	headers := map[string]string{"User-Agent": "client/1.0", "X-Forwarded-For": "203.0.113.7"}
+	withKey := func(key string) map[string]string {
+		h := map[string]string{"x-api-key": key}
+		for k, v := range headers {
+			h[k] = v
+		}
+		return h
+	}
+
+	a := GenerateStableAgentContinuationID(newConversationTestContext(withKey("key-a")), newConversationTestRequest("user-1", "hello"))
+	b := GenerateStableAgentContinuationID(newConversationTestContext(withKey("key-b")), newConversationTestRequest("user-1", "hello"))
+	again := GenerateStableAgentContinuationID(newConversationTestContext(withKey("key-a")),
+		newConversationTestRequest("user-1", "hello", "Hi! How can I help?", "tell me a joke"))
+
+	if a == b {
+		t.Fatalf("different API keys behind one NAT share an agent continuation id: %s", a)
+	}
+	if a != again {
+		t.Fatalf("agent continuation id changed across turns: %s != %s", a, again)
+	}
+}
+
+func TestConversationIDDistinguishesClients(t *testing.T) {
+	m := NewConversationIDManager()
+	// 同一 NAT 出口：IP 与 User-Agent 完全相同
+	headers := map[string]string{"x-api-key": "key-a", "User-Agent": "client/1.0", "X-Forwarded-For": "203.0.113.7"}
+
+	base := m.GenerateConversationID(newConversationTestContext(headers), newConversationTestRequest("user-1", "hello"))
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		req     *types.AnthropicRequest
+	}{
+		{"different user_id", headers, newConversationTestRequest("user-2", "hello")},
+		{"different api key", map[string]string{"x-api-key": "key-b", "User-Agent": "client/1.0"}, newConversationTestRequest("user-1", "hello")},
+		{"different first turn", headers, newConversationTestRequest("user-1", "write a poem")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if id := m.GenerateConversationID(newConversationTestContext(tc.headers), tc.req); id == base {
+				t.Fatalf("expected a different conversation id, got %s", id)
+			}
+		})
+	}
+}
+
+func TestConversationIDBearerMatchesAPIKey(t *testing.T) {
+	m := NewConversationIDManager()
+	req := newConversationTestRequest("", "hello")
+
+	viaHeader := m.GenerateConversationID(newConversationTestContext(map[string]string{"x-api-key": "key-a"}), req)
+	viaBearer := m.GenerateConversationID(newConversationTestContext(map[string]string{"Authorization": "Bearer key-a"}), req)
+
+	if viaHeader != viaBearer {
+		t.Fatalf("same API key produced different ids: %s != %s", viaHeader, viaBearer)
+	}
+}
+
+func TestConversationIDIgnoresCacheControl(t *testing.T) {
+	m := NewConversationIDManager()
+	headers := map[string]string{"x-api-key": "key-a"}
+
+	// 第 1 轮：system 与第一条消息都带缓存断点
+	first := newConversationTestRequest("user-1")
+	first.System[0].CacheControl = &types.CacheControl{Type: "ephemeral"}
+	first.Messages = []types.AnthropicRequestMessage{{Role: "user", Content: []any{
+		map[string]any{"type": "text", "text": "hello", "cache_control": map[string]any{"type": "ephemeral"}},
+	}}}
+
+	// 后续轮次：断点移到最新消息，第一条消息改为纯字符串
+	later := newConversationTestRequest("user-1", "hello", "Hi! How can I help?")
+	later.Messages = append(later.Messages, types.AnthropicRequestMessage{Role: "user", Content: []any{
+		map[string]any{"type": "text", "text": "tell me a joke", "cache_control": map[string]any{"type": "ephemeral"}},
+	}})
+
+	a := m.GenerateConversationID(newConversationTestContext(headers), first)
+	b := m.GenerateConversationID(newConversationTestContext(headers), later)
+	if a != b {
+		t.Fatalf("moving cache breakpoints changed the conversation id: %s != %s", a, b)
+	}
+}
+
+func TestConversationIDHeaderTakesPriority(t *testing.T) {
+	m := NewConversationIDManager()
+	c := newConversationTestContext(map[string]string{"x-api-key": "key-a", "X-Conversation-ID": "custom-conv"})
+
+	if id := m.GenerateConversationID(c, newConversationTestRequest("user-1", "hello")); id != "custom-conv" {
+		t.Fatalf("expected X-Conversation-ID to take priority, got %s", id)
+	}
+}
+
+func TestConversationIDReusedWithinRequest(t *testing.T) {
+	m := NewConversationIDManager()
+	c := newConversationTestContext(map[string]string{"x-api-key": "key-a"})
+
+	first := m.GenerateConversationID(c, newConversationTestRequest("user-1", "hello", "hi", "more"))
+	// 上下文压缩改写了对话开头，同一请求内仍使用已解析的ID
+	second := m.GenerateConversationID(c, newConversationTestRequest("user-1", "[summary of earlier turns]", "ok", "more"))
+
+	if first != second {
+		t.Fatalf("conversation id changed within one request: %s != %s", first, second)
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// MaxDocumentPages 单个 PDF 文档最多提取的页数（与 Anthropic API 的限制一致）
+const MaxDocumentPages = 100
+
+// ExtractPDFPages 按页提取 PDF 的文本层
+// 上游不接受 PDF 附件，文档以文本形式进入对话；扫描件等没有文本层的页面返回空字符串
+func ExtractPDFPages(data []byte) (pages []string, err error) {
+	// 解析器遇到损坏的文件可能 panic，统一转为错误
+	defer func() {
+		if r := recover(); r != nil {
+			pages, err = nil, fmt.Errorf("解析 PDF 失败: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("解析 PDF 失败: %v", err)
+	}
+	count := reader.NumPage()
+	if count > MaxDocumentPages {
+		return nil, fmt.Errorf("PDF 共 %d 页，超过 %d 页的限制", count, MaxDocumentPages)
+	}
+
+	pages = make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		text, err := reader.Page(i).GetPlainText(nil)
+		if err != nil {
+			return nil, fmt.Errorf("提取 PDF 第 %d 页文本失败: %v", i, err)
+		}
+		pages = append(pages, strings.TrimSpace(text))
+	}
+	return pages, nil
+}
+
+// IsTextMediaType 判断是否为可直接作为文档文本的类型
+func IsTextMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// DecodeDocumentText 将文本文档内容转为字符串（要求是有效的 UTF-8）
+func DecodeDocumentText(data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("文本文档不是有效的 UTF-8")
+	}
+	return string(data), nil
+}
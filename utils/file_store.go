@@ -0,0 +1,390 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+)
+
+// 错误信息会原样返回给客户端，因此使用英文
+
+var (
+	// ErrFileNotFound 文件不存在或不属于当前 API Key
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFilesDisabled 未配置存储目录
+	ErrFilesDisabled = errors.New("the Files API is disabled on this server")
+)
+
+// FileLimitError 超出单文件大小或 API Key 配额
+type FileLimitError struct {
+	Message string
+}
+
+func (e *FileLimitError) Error() string {
+	return e.Message
+}
+
+// StoredFile 已上传文件的元数据（与数据文件一同保存为 <id>.json）
+type StoredFile struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"` // API Key 的 sha256，不保存原始 Key
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	SizeBytes int64     `json:"size_bytes"`
+	SHA256    string    `json:"sha256"`
+	Width     int       `json:"width,omitempty"` // 图片尺寸（用于 token 估算）
+	Height    int       `json:"height,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FileStore 本地磁盘文件存储
+// 设计原则：
+// - 每个文件保存为 <id>（数据）与 <id>.json（元数据），启动时扫描目录重建索引
+// - 文件归属上传时的 API Key（只保存哈希），其他 Key 访问时与不存在一样返回 not found
+// - 上传时边写边计算大小与哈希，超过单文件上限立即中止；配额在写入完成后、登记之前检查
+// - 类型以内容嗅探为准，图片记录尺寸，token 估算不需要再读文件
+type FileStore struct {
+	cfg   *config.FilesConfig
+	mu    sync.RWMutex
+	files map[string]*StoredFile
+}
+
+// fileStore 全局文件存储
+var fileStore = &FileStore{cfg: &config.FilesConfig{}, files: map[string]*StoredFile{}}
+
+// InitFileStore 按环境变量加载 Files API 配置并重建索引（.env 加载后调用）
+func InitFileStore() error {
+	store, err := NewFileStore(config.LoadFilesConfig())
+	if err != nil {
+		return err
+	}
+	fileStore = store
+	return nil
+}
+
+// Files 返回全局文件存储
+func Files() *FileStore {
+	return fileStore
+}
+
+// FileOwner 由 API Key 计算文件归属标识
+func FileOwner(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewFileStore 创建文件存储并加载目录中已有的文件
+func NewFileStore(cfg *config.FilesConfig) (*FileStore, error) {
+	store := &FileStore{cfg: cfg, files: map[string]*StoredFile{}}
+	if cfg.Dir == "" {
+		return store, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建文件存储目录失败: %v", err)
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件存储目录失败: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		var meta StoredFile
+		data, err := os.ReadFile(filepath.Join(cfg.Dir, entry.Name()))
+		if err != nil || json.Unmarshal(data, &meta) != nil || !validFileID(meta.ID) {
+			Log("跳过无效的文件元数据", LogString("name", entry.Name()))
+			continue
+		}
+		if _, err := os.Stat(store.dataPath(meta.ID)); err != nil {
+			Log("文件数据缺失，跳过", LogString("file_id", meta.ID))
+			continue
+		}
+		store.files[meta.ID] = &meta
+	}
+	return store, nil
+}
+
+// Enabled 是否启用 Files API
+func (s *FileStore) Enabled() bool {
+	return s.cfg.Dir != ""
+}
+
+// MaxFileBytes 单个文件的最大字节数
+func (s *FileStore) MaxFileBytes() int64 {
+	return s.cfg.MaxFileBytes
+}
+
+// Create 保存上传的文件
+func (s *FileStore) Create(owner, filename, declaredType string, r io.Reader) (*StoredFile, error) {
+	if !s.Enabled() {
+		return nil, ErrFilesDisabled
+	}
+	id, err := newFileID()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(s.cfg.Dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, s.cfg.MaxFileBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	if size > s.cfg.MaxFileBytes {
+		return nil, &FileLimitError{Message: fmt.Sprintf("file exceeds the maximum size of %d bytes", s.cfg.MaxFileBytes)}
+	}
+	if size == 0 {
+		return nil, &FileLimitError{Message: "file is empty"}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+
+	meta := &StoredFile{
+		ID:        id,
+		Owner:     owner,
+		Filename:  sanitizeFilename(filename),
+		SizeBytes: size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := describeStoredFile(tmp.Name(), declaredType, meta); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, used := s.usageLocked(owner)
+	if s.cfg.MaxFiles > 0 && count >= s.cfg.MaxFiles {
+		return nil, &FileLimitError{Message: fmt.Sprintf("file count limit of %d reached, delete unused files first", s.cfg.MaxFiles)}
+	}
+	if s.cfg.QuotaBytes > 0 && used+size > s.cfg.QuotaBytes {
+		return nil, &FileLimitError{Message: fmt.Sprintf("storage quota of %d bytes exceeded (%d bytes in use)", s.cfg.QuotaBytes, used)}
+	}
+	if total := s.totalUsageLocked(); s.cfg.TotalBytes > 0 && total+size > s.cfg.TotalBytes {
+		return nil, &FileLimitError{Message: "server file storage is full, delete unused files first"}
+	}
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), s.dataPath(id)); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	committed = true
+	if err := os.WriteFile(s.metaPath(id), metaData, 0o600); err != nil {
+		os.Remove(s.dataPath(id))
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	s.files[id] = meta
+	return meta, nil
+}
+
+// Get 返回属于 owner 的文件元数据
+func (s *FileStore) Get(owner, id string) (*StoredFile, error) {
+	meta, ok := s.Lookup(id)
+	if !ok || meta.Owner != owner {
+		return nil, ErrFileNotFound
+	}
+	return meta, nil
+}
+
+// Lookup 按 ID 查找文件（不检查归属，用于已通过校验的请求）
+func (s *FileStore) Lookup(id string) (*StoredFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	meta, ok := s.files[id]
+	return meta, ok
+}
+
+// List 按创建时间倒序列出 owner 的文件，afterID/beforeID 为分页游标
+func (s *FileStore) List(owner string, limit int, afterID, beforeID string) ([]*StoredFile, bool) {
+	s.mu.RLock()
+	var owned []*StoredFile
+	for _, meta := range s.files {
+		if meta.Owner == owner {
+			owned = append(owned, meta)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(owned, func(a, b *StoredFile) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+
+	start, end := 0, len(owned)
+	if afterID != "" {
+		if i := slices.IndexFunc(owned, func(f *StoredFile) bool { return f.ID == afterID }); i >= 0 {
+			start = i + 1
+		}
+	}
+	if beforeID != "" {
+		if i := slices.IndexFunc(owned, func(f *StoredFile) bool { return f.ID == beforeID }); i >= 0 {
+			end = i
+			start = max(0, end-limit)
+		}
+	}
+	if start > end {
+		start = end
+	}
+	page := owned[start:end]
+	hasMore := false
+	if len(page) > limit {
+		page, hasMore = page[:limit], true
+	} else if beforeID != "" {
+		hasMore = start > 0
+	}
+	return page, hasMore
+}
+
+// Open 打开文件数据
+func (s *FileStore) Open(id string) (*os.File, error) {
+	if _, ok := s.Lookup(id); !ok {
+		return nil, ErrFileNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// ReadFile 读取文件全部数据
+func (s *FileStore) ReadFile(id string) ([]byte, *StoredFile, error) {
+	meta, ok := s.Lookup(id)
+	if !ok {
+		return nil, nil, ErrFileNotFound
+	}
+	data, err := os.ReadFile(s.dataPath(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file %s: %v", id, err)
+	}
+	return data, meta, nil
+}
+
+// Delete 删除属于 owner 的文件
+func (s *FileStore) Delete(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, ok := s.files[id]
+	if !ok || meta.Owner != owner {
+		return ErrFileNotFound
+	}
+	delete(s.files, id)
+	os.Remove(s.metaPath(id))
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file %s: %v", id, err)
+	}
+	return nil
+}
+
+// usageLocked 统计 owner 的文件数与总字节数（调用方持有锁）
+func (s *FileStore) usageLocked(owner string) (int, int64) {
+	count, used := 0, int64(0)
+	for _, meta := range s.files {
+		if meta.Owner == owner {
+			count++
+			used += meta.SizeBytes
+		}
+	}
+	return count, used
+}
+
+// totalUsageLocked 统计所有 API Key 已占用的字节数（调用方持有锁）
+func (s *FileStore) totalUsageLocked() int64 {
+	var total int64
+	for _, meta := range s.files {
+		total += meta.SizeBytes
+	}
+	return total
+}
+
+func (s *FileStore) dataPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id)
+}
+
+func (s *FileStore) metaPath(id string) string {
+	return filepath.Join(s.cfg.Dir, id+".json")
+}
+
+// describeStoredFile 嗅探文件类型，图片记录尺寸
+func describeStoredFile(path, declaredType string, meta *StoredFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to store file: %v", err)
+	}
+	defer f.Close()
+
+	head, _ := bufio.NewReader(f).Peek(512)
+	meta.MimeType = SniffContentType(head, declaredType)
+	if !IsSupportedImageFormat(meta.MimeType) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to store file: %v", err)
+	}
+	if width, height, err := GetImageDimensions(data); err == nil {
+		meta.Width, meta.Height = width, height
+	}
+	return nil
+}
+
+// newFileID 生成文件ID（file_ + 24 位十六进制）
+func newFileID() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate file id: %v", err)
+	}
+	return "file_" + hex.EncodeToString(buf), nil
+}
+
+// validFileID 校验文件ID格式，防止路径穿越
+func validFileID(id string) bool {
+	rest, ok := strings.CutPrefix(id, "file_")
+	if !ok || len(rest) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(rest)
+	return err == nil
+}
+
+// sanitizeFilename 去掉路径部分与控制字符，只保留文件名
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" || name == "" {
+		return "upload"
+	}
+	return name
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"image"
 	"regexp"
 	"strings"
 
@@ -18,6 +20,8 @@ var SupportedImageFormats = map[string]string{
 	".gif":  "image/gif",
 	".webp": "image/webp",
 	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
 }
 
 // MaxImageSize 最大图片大小 (20MB)
@@ -60,6 +64,12 @@ func DetectImageFormat(data []byte) (string, error) {
 		return "image/bmp", nil
 	}
 
+	// 检测 TIFF（little-endian "II*\0" 或 big-endian "MM\0*"）
+	if (data[0] == 0x49 && data[1] == 0x49 && data[2] == 0x2A && data[3] == 0x00) ||
+		(data[0] == 0x4D && data[1] == 0x4D && data[2] == 0x00 && data[3] == 0x2A) {
+		return "image/tiff", nil
+	}
+
 	return "", fmt.Errorf("不支持的图片格式")
 }
 
@@ -81,30 +91,42 @@ func GetImageFormatFromMediaType(mediaType string) string {
 		return "webp"
 	case "image/bmp":
 		return "bmp"
+	case "image/tiff":
+		return "tiff"
 	default:
 		return ""
 	}
 }
 
 // CreateCodeWhispererImage 创建 CodeWhisperer 格式的图片对象
-func CreateCodeWhispererImage(imageSource *types.ImageSource) *types.CodeWhispererImage {
+// 图片经过预处理：超限时缩放、压缩，上游不支持的格式转码（见 PrepareImage）
+func CreateCodeWhispererImage(imageSource *types.ImageSource) (*types.CodeWhispererImage, error) {
 	if imageSource == nil {
-		return nil
+		return nil, fmt.Errorf("图片数据为空")
 	}
 
-	format := GetImageFormatFromMediaType(imageSource.MediaType)
-	if format == "" {
-		return nil
+	data, err := base64.StdEncoding.DecodeString(imageSource.Data)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 base64 编码: %v", err)
+	}
+	prepared, err := PrepareImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := imageSource.Data
+	if prepared.MediaType != imageSource.MediaType || len(prepared.Data) != len(data) {
+		encoded = base64.StdEncoding.EncodeToString(prepared.Data)
 	}
 
 	return &types.CodeWhispererImage{
-		Format: format,
+		Format: upstreamImageFormats[prepared.MediaType],
 		Source: struct {
 			Bytes string `json:"bytes"`
 		}{
-			Bytes: imageSource.Data,
+			Bytes: encoded,
 		},
-	}
+	}, nil
 }
 
 // ValidateImageContent 验证图片内容的完整性
@@ -188,7 +210,7 @@ func ParseDataURL(dataURL string) (mediaType, base64Data string, err error) {
 }
 
 // GetImageDimensions 从图片二进制数据解析宽高
-// 支持 PNG, JPEG, GIF, WebP, BMP 格式
+// 支持 PNG, JPEG, GIF, WebP, BMP, TIFF 格式
 func GetImageDimensions(data []byte) (width, height int, err error) {
 	if len(data) < 12 {
 		return 0, 0, fmt.Errorf("图片数据太小")
@@ -211,6 +233,13 @@ func GetImageDimensions(data []byte) (width, height int, err error) {
 		return getWebPDimensions(data)
 	case "image/bmp":
 		return getBMPDimensions(data)
+	case "image/tiff":
+		// TIFF 的尺寸位于 IFD 中，位置不固定，交给解码器解析
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return 0, 0, fmt.Errorf("TIFF 数据不完整: %v", err)
+		}
+		return cfg.Width, cfg.Height, nil
 	default:
 		return 0, 0, fmt.Errorf("不支持的图片格式: %s", mediaType)
 	}
@@ -356,7 +385,7 @@ func getBMPDimensions(data []byte) (width, height int, err error) {
 }
 
 // EstimateImageTokens 根据图片分辨率计算 token 数量
-// 遵循 Anthropic 官方计算规则:
+// 先按图片预处理的长边限制得到实际发送的尺寸，再遵循 Anthropic 官方计算规则:
 // 1. 长边最大 1568px，超过则等比缩放
 // 2. tokens = (width * height) / 750
 // 3. 最小 85 tokens
@@ -364,6 +393,7 @@ func EstimateImageTokens(width, height int) int {
 	if width <= 0 || height <= 0 {
 		return 1500 // 无法获取尺寸时使用默认值
 	}
+	width, height = FinalImageDimensions(width, height)
 
 	// 应用缩放规则：长边最大 1568px
 	maxDim := 1568
@@ -409,6 +439,28 @@ func EstimateImageTokensFromBytes(data []byte) int {
 	return EstimateImageTokens(width, height)
 }
 
+// ParseImageSource 解析原始 map 格式的图片或文档数据源
+func ParseImageSource(source map[string]any) *types.ImageSource {
+	parsed := &types.ImageSource{}
+	if sourceType, ok := source["type"].(string); ok {
+		parsed.Type = sourceType
+	}
+	if mediaType, ok := source["media_type"].(string); ok {
+		parsed.MediaType = mediaType
+	}
+	if data, ok := source["data"].(string); ok {
+		parsed.Data = data
+	}
+	if url, ok := source["url"].(string); ok {
+		parsed.URL = url
+	}
+	if fileID, ok := source["file_id"].(string); ok {
+		parsed.FileID = fileID
+	}
+	parsed.Content = source["content"]
+	return parsed
+}
+
 // ConvertImageURLToImageSource 将 image_url 格式转换为 Anthropic 的 ImageSource 格式
 func ConvertImageURLToImageSource(imageURL map[string]any) (*types.ImageSource, error) {
 	urlValue, exists := imageURL["url"]
@@ -451,8 +503,11 @@ func EstimateDocumentTokensFromBase64(base64Data string) int {
 
 	// base64 编码后大小约为原始大小的 4/3
 	// 原始大小 ≈ base64长度 * 3 / 4
-	originalSize := len(base64Data) * 3 / 4
+	return EstimateDocumentTokensFromSize(len(base64Data) * 3 / 4)
+}
 
+// EstimateDocumentTokensFromSize 按 PDF 原始字节数估算 token 数量（估算规则同上）
+func EstimateDocumentTokensFromSize(originalSize int) int {
 	// 估算页数: 假设每页约 100KB
 	pageCount := originalSize / (100 * 1024)
 	if pageCount < 1 {
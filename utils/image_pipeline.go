@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // 注册 GIF 解码器
+	"image/jpeg"
+	"image/png"
+	"sync"
+
+	"kiro/config"
+
+	_ "golang.org/x/image/bmp" // 注册 BMP 解码器
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff" // 注册 TIFF 解码器
+	_ "golang.org/x/image/webp" // 注册 WebP 解码器
+)
+
+// upstreamImageFormats 上游接受的图片格式（media type → CodeWhisperer format）
+var upstreamImageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// maxImageShrinkAttempts 为满足大小限制最多重新编码的次数
+const maxImageShrinkAttempts = 6
+
+// imagePipelineConfig 当前生效的图片预处理配置
+var imagePipelineConfig = config.LoadImagePipelineConfig()
+
+// InitImagePipeline 按环境变量重新加载图片预处理配置（.env 加载后调用）
+func InitImagePipeline() {
+	imagePipelineConfig = config.LoadImagePipelineConfig()
+	preparedImages.reset()
+}
+
+// PreparedImage 预处理后可直接发往上游的图片
+type PreparedImage struct {
+	MediaType string
+	Data      []byte
+	Width     int
+	Height    int
+}
+
+// PrepareImage 按预处理配置转换图片
+// 设计原则：
+// - 像素数超过 IMAGE_MAX_PIXELS 时在解码前拒绝
+// - 上游支持的格式且尺寸、大小都在限制内时原样返回，不做任何解码
+// - 长边超限时等比缩小；BMP、TIFF 等上游不支持的格式转为 PNG
+// - 有损来源（不透明的 JPEG/WebP）编码为 JPEG，其余优先 PNG 保持文字清晰；超过大小限制时改用 JPEG 并逐步缩小
+// - 动图只保留第一帧（仅在需要处理时）
+// - 历史消息中的图片每轮都会重新发送，转换结果按内容缓存
+func PrepareImage(data []byte) (*PreparedImage, error) {
+	cfg := imagePipelineConfig
+	mediaType, err := DetectImageFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	width, height, err := GetImageDimensions(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckImagePixels(width, height); err != nil {
+		return nil, err
+	}
+
+	_, supported := upstreamImageFormats[mediaType]
+	oversized := cfg.MaxLongEdge > 0 && max(width, height) > cfg.MaxLongEdge
+	tooLarge := cfg.MaxBytes > 0 && len(data) > cfg.MaxBytes
+	if supported && !oversized && !tooLarge {
+		return &PreparedImage{MediaType: mediaType, Data: data, Width: width, Height: height}, nil
+	}
+
+	key := sha256.Sum256(data)
+	if prepared, ok := preparedImages.get(key); ok {
+		return prepared, nil
+	}
+	prepared, err := transformImage(data, mediaType, oversized, cfg)
+	if err != nil {
+		return nil, err
+	}
+	preparedImages.put(key, prepared)
+	return prepared, nil
+}
+
+// CheckImagePixels 检查图片头部声明的像素数是否超过 IMAGE_MAX_PIXELS
+// 解码器按声明的尺寸分配内存，必须在解码前拒绝（很小的 PNG/TIFF 头部即可声明 60000×60000）
+func CheckImagePixels(width, height int) error {
+	maxPixels := imagePipelineConfig.MaxPixels
+	if maxPixels == 0 || width <= 0 || height <= 0 {
+		return nil
+	}
+	if width > maxPixels/height {
+		return fmt.Errorf("image dimensions %dx%d exceed the maximum of %d pixels", width, height, maxPixels)
+	}
+	return nil
+}
+
+// transformImage 解码并缩放、转码图片，直到满足大小限制
+func transformImage(data []byte, mediaType string, oversized bool, cfg *config.ImagePipelineConfig) (*PreparedImage, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("解码图片失败: %v", err)
+	}
+	if oversized {
+		img = resizeImage(img, cfg.MaxLongEdge)
+	}
+
+	useJPEG := (mediaType == "image/jpeg" || mediaType == "image/webp") && isOpaque(img)
+	for attempt := 0; ; attempt++ {
+		encoded, outType, err := encodeImage(img, useJPEG, cfg.JPEGQuality)
+		if err != nil {
+			return nil, fmt.Errorf("编码图片失败: %v", err)
+		}
+		bounds := img.Bounds()
+		if cfg.MaxBytes == 0 || len(encoded) <= cfg.MaxBytes {
+			Log("图片已预处理",
+				LogString("from", mediaType),
+				LogString("to", outType),
+				LogInt("original_bytes", len(data)),
+				LogInt("final_bytes", len(encoded)),
+				LogInt("width", bounds.Dx()),
+				LogInt("height", bounds.Dy()))
+			return &PreparedImage{MediaType: outType, Data: encoded, Width: bounds.Dx(), Height: bounds.Dy()}, nil
+		}
+		if attempt >= maxImageShrinkAttempts {
+			return nil, fmt.Errorf("图片压缩后仍超过 %d 字节", cfg.MaxBytes)
+		}
+		if !useJPEG {
+			useJPEG = true
+			continue
+		}
+		img = resizeImage(img, max(bounds.Dx(), bounds.Dy())*3/4)
+	}
+}
+
+// resizeImage 等比缩小图片，使长边不超过 longEdge
+func resizeImage(img image.Image, longEdge int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if longEdge < 1 || max(width, height) <= longEdge {
+		return img
+	}
+	if width >= height {
+		height = max(height*longEdge/width, 1)
+		width = longEdge
+	} else {
+		width = max(width*longEdge/height, 1)
+		height = longEdge
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// encodeImage 编码为 JPEG 或 PNG，返回数据与 media type
+// JPEG 不支持透明通道，透明区域铺白底
+func encodeImage(img image.Image, useJPEG bool, quality int) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if !useJPEG {
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	}
+	if !isOpaque(img) {
+		flattened := image.NewRGBA(img.Bounds())
+		draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flattened
+	}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	return buf.Bytes(), "image/jpeg", err
+}
+
+// isOpaque 图片是否不含透明像素
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// FinalImageDimensions 返回预处理按长边限制缩放后的尺寸（用于 token 估算）
+func FinalImageDimensions(width, height int) (int, int) {
+	limit := imagePipelineConfig.MaxLongEdge
+	if limit < 1 || max(width, height) <= limit {
+		return width, height
+	}
+	if width >= height {
+		return limit, max(height*limit/width, 1)
+	}
+	return max(width*limit/height, 1), limit
+}
+
+// preparedImageCache 转换结果缓存（按原图内容哈希，超出容量时淘汰最早的条目）
+type preparedImageCache struct {
+	mu      sync.Mutex
+	entries map[[32]byte]*PreparedImage
+	order   [][32]byte
+}
+
+var preparedImages = &preparedImageCache{entries: map[[32]byte]*PreparedImage{}}
+
+func (c *preparedImageCache) get(key [32]byte) (*PreparedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prepared, ok := c.entries[key]
+	return prepared, ok
+}
+
+func (c *preparedImageCache) put(key [32]byte, prepared *PreparedImage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; exists {
+		return
+	}
+	if len(c.order) >= config.ImagePipelineCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = prepared
+	c.order = append(c.order, key)
+}
+
+func (c *preparedImageCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[[32]byte]*PreparedImage{}
+	c.order = nil
+}
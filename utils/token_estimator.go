@@ -193,6 +193,10 @@ func (e *TokenEstimator) estimateContentBlock(block any) int {
 	case "image":
 		// 尝试从 source 获取 base64 数据计算精确 token
 		if source, ok := blockMap["source"].(map[string]any); ok {
+			if source["type"] == "file" {
+				fileID, _ := source["file_id"].(string)
+				return e.EstimateFileTokens(fileID, 1500)
+			}
 			if data, ok := source["data"].(string); ok && data != "" {
 				return EstimateImageTokensFromBase64(data)
 			}
@@ -202,7 +206,15 @@ func (e *TokenEstimator) estimateContentBlock(block any) int {
 	case "document":
 		// 尝试从 source 获取 base64 数据估算 token
 		if source, ok := blockMap["source"].(map[string]any); ok {
+			if source["type"] == "file" {
+				fileID, _ := source["file_id"].(string)
+				return e.EstimateFileTokens(fileID, 500)
+			}
 			if data, ok := source["data"].(string); ok && data != "" {
+				// 文本文档直接按文本计数
+				if source["type"] == "text" {
+					return e.EstimateTextTokens(data)
+				}
 				return EstimateDocumentTokensFromBase64(data)
 			}
 		}
@@ -247,6 +259,9 @@ func (e *TokenEstimator) estimateTypedContentBlock(block types.ContentBlock) int
 
 	case "image":
 		// 尝试从 Source 获取 base64 数据计算精确 token
+		if block.Source != nil && block.Source.Type == "file" {
+			return e.EstimateFileTokens(block.Source.FileID, 1500)
+		}
 		if block.Source != nil && block.Source.Data != "" {
 			return EstimateImageTokensFromBase64(block.Source.Data)
 		}
@@ -284,6 +299,34 @@ func (e *TokenEstimator) estimateTypedContentBlock(block types.ContentBlock) int
 	}
 }
 
+// EstimateContentBlockTokens 计算单个内容块的 token 数量（map 或 types.ContentBlock）
+func (e *TokenEstimator) EstimateContentBlockTokens(block any) int {
+	if typed, ok := block.(types.ContentBlock); ok {
+		return e.estimateTypedContentBlock(typed)
+	}
+	return e.estimateContentBlock(block)
+}
+
+// EstimateFileTokens 估算 Files API 文件来源的 token 数量，与内联同样内容时的估算一致
+// 图片按上传时记录的尺寸计算，PDF 按大小估算，文本文件按内容计数；文件不存在时返回 fallback
+func (e *TokenEstimator) EstimateFileTokens(fileID string, fallback int) int {
+	meta, ok := Files().Lookup(fileID)
+	if !ok {
+		return fallback
+	}
+	switch {
+	case meta.Width > 0 && meta.Height > 0:
+		return EstimateImageTokens(meta.Width, meta.Height)
+	case meta.MimeType == "application/pdf":
+		return EstimateDocumentTokensFromSize(int(meta.SizeBytes))
+	case IsTextMediaType(meta.MimeType):
+		if data, _, err := Files().ReadFile(fileID); err == nil {
+			return e.EstimateTextTokens(string(data))
+		}
+	}
+	return fallback
+}
+
 // IsValidClaudeModel 验证是否为有效的 Claude 模型
 func IsValidClaudeModel(model string) bool {
 	if model == "" {
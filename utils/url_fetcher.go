@@ -0,0 +1,389 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"kiro/config"
+)
+
+// 错误信息会原样返回给客户端，因此使用英文
+
+// FetchedContent URL 抓取结果
+type FetchedContent struct {
+	// MediaType 按内容嗅探得到的类型（图片、application/pdf 或 text/*）
+	MediaType string
+	Data      []byte
+}
+
+// blockedPrefixes SSRF 防护默认拦截的非公网网段（IsPrivate/IsLoopback 等之外的部分）
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // 本网络
+	netip.MustParsePrefix("100.64.0.0/10"),  // 运营商级 NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF 协议分配
+	netip.MustParsePrefix("198.18.0.0/15"),  // 基准测试
+	netip.MustParsePrefix("240.0.0.0/4"),    // 保留地址
+	netip.MustParsePrefix("64:ff9b::/96"),   // 知名 NAT64 前缀，可映射到任意 IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"), // 本地 NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // 文档示例
+	netip.MustParsePrefix("fec0::/10"),      // 已废弃的站点本地地址
+	netip.MustParsePrefix("100::/64"),       // 丢弃前缀
+	netip.MustParsePrefix("2001:2::/48"),    // 基准测试
+	netip.MustParsePrefix("2002::/16"),      // 6to4，可映射到任意 IPv4
+	netip.MustParsePrefix("2001::/32"),      // Teredo，可映射到任意 IPv4
+}
+
+// allowPrivateKey 上下文标记：目标主机在白名单中，允许连接内网地址
+type allowPrivateKey struct{}
+
+// URLFetcher URL 来源抓取器
+// 设计原则：
+// - 只允许 http/https，重定向手动跟随并逐跳检查，次数有限
+// - SSRF 防护在拨号时检查实际连接的 IP，DNS 重绑定也无法绕过；白名单中的主机名或网段可以放行
+// - 响应体按上限读取，类型以内容嗅探为准，不信任 Content-Type
+// - 结果按 URL 缓存，过了新鲜期后带 ETag 重新验证，历史消息中的 URL 不会每轮重复下载
+// - 直连目标地址，不经过出站代理（代理会替我们解析域名，拨号检查将失效）
+type URLFetcher struct {
+	cfg    *config.URLFetchConfig
+	client *http.Client
+	cache  *fetchCache
+}
+
+// NewURLFetcher 创建 URL 抓取器
+func NewURLFetcher(cfg *config.URLFetchConfig) *URLFetcher {
+	f := &URLFetcher{cfg: cfg, cache: newFetchCache(cfg.CacheBytes)}
+	dialer := &net.Dialer{
+		Timeout:        10 * time.Second,
+		KeepAlive:      config.HTTPClientKeepAlive,
+		ControlContext: f.checkDialAddress,
+	}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: config.HTTPClientTLSHandshakeTimeout,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// 重定向由 Fetch 手动跟随，以便逐跳检查白名单
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return f
+}
+
+// urlFetcher 全局 URL 抓取器
+var urlFetcher = newDefaultURLFetcher()
+
+// InitURLFetcher 按环境变量重新加载 URL 抓取配置（.env 加载后调用）
+func InitURLFetcher() error {
+	cfg, err := config.LoadURLFetchConfig()
+	urlFetcher = NewURLFetcher(cfg)
+	return err
+}
+
+func newDefaultURLFetcher() *URLFetcher {
+	cfg, _ := config.LoadURLFetchConfig()
+	return NewURLFetcher(cfg)
+}
+
+// URLFetchRequestLimits 单个请求的 URL 来源数量上限与抓取总时限
+func URLFetchRequestLimits() (int, time.Duration) {
+	return urlFetcher.cfg.MaxPerRequest, urlFetcher.cfg.RequestTimeout
+}
+
+// FetchURL 使用全局抓取器下载 URL 内容
+func FetchURL(ctx context.Context, rawURL string) (*FetchedContent, error) {
+	return urlFetcher.Fetch(ctx, rawURL)
+}
+
+// Fetch 下载 URL 内容（命中缓存时不发请求或只做条件请求）
+func (f *URLFetcher) Fetch(ctx context.Context, rawURL string) (*FetchedContent, error) {
+	if !f.cfg.Enabled {
+		return nil, fmt.Errorf("URL sources are disabled on this server")
+	}
+	target, err := parseFetchURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := f.cache.get(target.String())
+	if cached != nil && time.Since(cached.validatedAt) < config.URLFetchCacheFreshness {
+		return cached.content, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+
+	etag := ""
+	if cached != nil {
+		etag = cached.etag
+	}
+	resp, err := f.get(ctx, target, etag)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out fetching %s after %s", target.Redacted(), f.cfg.Timeout)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f.cache.touch(target.String())
+		return cached.content, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned HTTP %d", target.Redacted(), resp.StatusCode)
+	}
+	if resp.ContentLength > int64(f.cfg.MaxBytes) {
+		return nil, fmt.Errorf("content at %s exceeds the maximum size of %d bytes", target.Redacted(), f.cfg.MaxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(f.cfg.MaxBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", target.Redacted(), err)
+	}
+	if len(data) > f.cfg.MaxBytes {
+		return nil, fmt.Errorf("content at %s exceeds the maximum size of %d bytes", target.Redacted(), f.cfg.MaxBytes)
+	}
+
+	content := &FetchedContent{
+		MediaType: SniffContentType(data, resp.Header.Get("Content-Type")),
+		Data:      data,
+	}
+	f.cache.put(target.String(), resp.Header.Get("ETag"), content)
+
+	Log("URL 来源已下载",
+		LogString("url", target.Redacted()),
+		LogString("media_type", content.MediaType),
+		LogInt("bytes", len(data)))
+	return content, nil
+}
+
+// get 发送请求并手动跟随重定向，每一跳单独判断目标是否在白名单中
+func (f *URLFetcher) get(ctx context.Context, target *url.URL, etag string) (*http.Response, error) {
+	for redirects := 0; ; redirects++ {
+		hopCtx := ctx
+		if f.hostAllowed(target.Hostname()) {
+			hopCtx = context.WithValue(ctx, allowPrivateKey{}, true)
+		}
+		req, err := http.NewRequestWithContext(hopCtx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL: %v", err)
+		}
+		req.Header.Set("Accept", "image/*, application/pdf, text/*;q=0.9, */*;q=0.5")
+		req.Header.Set("User-Agent", "kiro2api-fetcher/1.0")
+		if etag != "" && redirects == 0 {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		resp, err := f.client.Do(req)
+		if err != nil {
+			var blocked *blockedAddressError
+			if errors.As(err, &blocked) {
+				return nil, fmt.Errorf("refusing to fetch %s: %v", target.Redacted(), blocked)
+			}
+			return nil, fmt.Errorf("fetching %s failed: %v", target.Redacted(), unwrapURLError(err))
+		}
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || resp.StatusCode == http.StatusNotModified {
+			return resp, nil
+		}
+
+		location := resp.Header.Get("Location")
+		resp.Body.Close()
+		if location == "" {
+			return nil, fmt.Errorf("fetching %s returned HTTP %d without a Location header", target.Redacted(), resp.StatusCode)
+		}
+		if redirects >= config.URLFetchMaxRedirects {
+			return nil, fmt.Errorf("fetching %s: too many redirects", target.Redacted())
+		}
+		next, err := target.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: invalid redirect location", target.Redacted())
+		}
+		if target, err = parseFetchURL(next.String()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseFetchURL 校验 URL：只允许带主机名的 http/https
+func parseFetchURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q, only http and https are allowed", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("URL must include a host")
+	}
+	u.Fragment = ""
+	return u, nil
+}
+
+// hostAllowed 主机名是否在白名单中
+func (f *URLFetcher) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return slices.ContainsFunc(f.cfg.AllowHosts, func(pattern string) bool {
+		ok, err := path.Match(pattern, host)
+		return (err == nil && ok) || pattern == host
+	})
+}
+
+// blockedAddressError 拨号目标被 SSRF 防护拦截
+type blockedAddressError struct {
+	addr netip.Addr
+}
+
+func (e *blockedAddressError) Error() string {
+	return fmt.Sprintf("address %s is not publicly routable", e.addr)
+}
+
+// checkDialAddress 拨号前检查实际连接的 IP（已完成 DNS 解析）
+func (f *URLFetcher) checkDialAddress(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+	if IsPublicAddr(addr) {
+		return nil
+	}
+	if allowed, _ := ctx.Value(allowPrivateKey{}).(bool); allowed {
+		return nil
+	}
+	if slices.ContainsFunc(f.cfg.AllowPrefixes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return nil
+	}
+	return &blockedAddressError{addr: addr}
+}
+
+// IsPublicAddr 判断地址是否为公网可路由地址（回环、私有、链路本地、组播等均视为非公网）
+func IsPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapURLError 去掉 *url.Error 中重复的方法与 URL 前缀
+func unwrapURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// SniffContentType 按内容判断类型：图片与 PDF 看文件头，其余按 http.DetectContentType
+// 声明为 text/* 且内容确实是文本时沿用声明的子类型（如 text/markdown、text/csv）
+func SniffContentType(data []byte, declared string) string {
+	if mediaType, err := DetectImageFormat(data); err == nil {
+		return mediaType
+	}
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "application/pdf"
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	declaredType, _, _ := mime.ParseMediaType(declared)
+	if strings.HasPrefix(sniffed, "text/") && strings.HasPrefix(declaredType, "text/") {
+		return declaredType
+	}
+	return sniffed
+}
+
+// fetchCacheEntry 缓存的抓取结果
+type fetchCacheEntry struct {
+	etag        string
+	content     *FetchedContent
+	validatedAt time.Time
+}
+
+// fetchCache 按 URL 缓存抓取结果，总大小超出上限时淘汰最早的条目
+type fetchCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	entries  map[string]*fetchCacheEntry
+	order    []string
+}
+
+func newFetchCache(maxBytes int) *fetchCache {
+	return &fetchCache{maxBytes: maxBytes, entries: map[string]*fetchCacheEntry{}}
+}
+
+func (c *fetchCache) get(key string) *fetchCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		copied := *entry
+		return &copied
+	}
+	return nil
+}
+
+// touch 条件请求返回 304 后刷新验证时间
+func (c *fetchCache) touch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.validatedAt = time.Now()
+	}
+}
+
+func (c *fetchCache) put(key, etag string, content *FetchedContent) {
+	if len(content.Data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	for c.size+len(content.Data) > c.maxBytes && len(c.order) > 0 {
+		c.removeLocked(c.order[0])
+	}
+	c.entries[key] = &fetchCacheEntry{etag: etag, content: content, validatedAt: time.Now()}
+	c.order = append(c.order, key)
+	c.size += len(content.Data)
+}
+
+func (c *fetchCache) removeLocked(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	delete(c.entries, key)
+	c.size -= len(entry.content.Data)
+	if i := slices.Index(c.order, key); i >= 0 {
+		c.order = slices.Delete(c.order, i, i+1)
+	}
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro/config"
+)
+
+// newTestURLFetcher 创建测试用抓取器（不缓存）
+func newTestURLFetcher(allowHosts []string, allowPrefixes ...string) *URLFetcher {
+	cfg := &config.URLFetchConfig{
+		Enabled:    true,
+		Timeout:    5 * time.Second,
+		MaxBytes:   1 << 20,
+		AllowHosts: allowHosts,
+	}
+	for _, p := range allowPrefixes {
+		cfg.AllowPrefixes = append(cfg.AllowPrefixes, netip.MustParsePrefix(p))
+	}
+	return NewURLFetcher(cfg)
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	cases := []struct {
+		addr   string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+
+		{"127.0.0.1", false},           // 回环
+		{"::1", false},                 // 回环
+		{"10.0.0.1", false},            // 私有
+		{"172.16.5.4", false},          // 私有
+		{"192.168.1.1", false},         // 私有
+		{"fd00::1", false},             // 唯一本地地址
+		{"169.254.169.254", false},     // 链路本地（云厂商元数据）
+		{"fe80::1", false},             // 链路本地
+		{"0.0.0.0", false},             // 未指定
+		{"0.1.2.3", false},             // 本网络
+		{"100.64.0.1", false},          // 运营商级 NAT
+		{"198.18.0.1", false},          // 基准测试
+		{"240.0.0.1", false},           // 保留地址
+		{"224.0.0.1", false},           // 组播
+		{"ff02::1", false},             // 组播
+		{"::ffff:127.0.0.1", false},    // IPv4 映射的回环
+		{"::ffff:10.0.0.1", false},     // IPv4 映射的私有地址
+		{"64:ff9b::7f00:1", false},     // NAT64 映射的 127.0.0.1
+		{"64:ff9b::a9fe:a9fe", false},  // NAT64 映射的 169.254.169.254
+		{"64:ff9b:1::a00:1", false},    // 本地 NAT64
+		{"2002:7f00:1::1", false},      // 6to4 映射的 127.0.0.1
+		{"2002:a9fe:a9fe::1", false},   // 6to4 映射的 169.254.169.254
+		{"2001:0:4136:e378::1", false}, // Teredo
+		{"2001:db8::1", false},         // 文档示例
+		{"fec0::1", false},             // 站点本地
+	}
+	for _, tc := range cases {
+		t.Run(tc.addr, func(t *testing.T) {
+			if got := IsPublicAddr(netip.MustParseAddr(tc.addr)); got != tc.public {
+				t.Fatalf("IsPublicAddr(%s) = %v, want %v", tc.addr, got, tc.public)
+			}
+		})
+	}
+}
+
+func TestCheckDialAddress(t *testing.T) {
+	f := newTestURLFetcher(nil, "10.1.0.0/16", "192.168.7.7/32")
+	allowedCtx := context.WithValue(context.Background(), allowPrivateKey{}, true)
+
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		address string
+		blocked bool
+	}{
+		{"public address", context.Background(), "8.8.8.8:443", false},
+		{"loopback", context.Background(), "127.0.0.1:80", true},
+		{"metadata endpoint", context.Background(), "169.254.169.254:80", true},
+		{"ipv6 loopback", context.Background(), "[::1]:80", true},
+		{"ipv4-mapped private", context.Background(), "[::ffff:10.2.0.1]:80", true},
+		{"nat64 loopback", context.Background(), "[64:ff9b::7f00:1]:80", true},
+		{"6to4 loopback", context.Background(), "[2002:7f00:1::1]:80", true},
+		{"teredo", context.Background(), "[2001:0:4136:e378::1]:80", true},
+		{"allowlisted prefix", context.Background(), "10.1.2.3:80", false},
+		{"allowlisted prefix via ipv4-mapped", context.Background(), "[::ffff:10.1.2.3]:80", false},
+		{"allowlisted single address", context.Background(), "192.168.7.7:80", false},
+		{"outside allowlisted prefix", context.Background(), "10.2.0.1:80", true},
+		{"allowlisted host bypass", allowedCtx, "127.0.0.1:80", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := f.checkDialAddress(tc.ctx, "tcp", tc.address, nil)
+			var blocked *blockedAddressError
+			if tc.blocked != errors.As(err, &blocked) {
+				t.Fatalf("checkDialAddress(%s) = %v, want blocked=%v", tc.address, err, tc.blocked)
+			}
+			if !tc.blocked && err != nil {
+				t.Fatalf("checkDialAddress(%s) unexpected error: %v", tc.address, err)
+			}
+		})
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	f := newTestURLFetcher([]string{"internal.example.com", "*.svc.local"})
+
+	cases := []struct {
+		host    string
+		allowed bool
+	}{
+		{"internal.example.com", true},
+		{"INTERNAL.example.com.", true},
+		{"api.svc.local", true},
+		{"svc.local", false},
+		{"example.com", false},
+		{"internal.example.com.evil.test", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.host, func(t *testing.T) {
+			if got := f.hostAllowed(tc.host); got != tc.allowed {
+				t.Fatalf("hostAllowed(%q) = %v, want %v", tc.host, got, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestFetchChecksEveryRedirectHop(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("hello"))
+		case "/to-ok":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		case "/to-ip":
+			// 从白名单主机跳转到未列入白名单的回环地址
+			u, _ := url.Parse(srv.URL)
+			http.Redirect(w, r, "http://127.0.0.1:"+u.Port()+"/ok", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	byName := "http://localhost:" + u.Port()
+	byIP := "http://127.0.0.1:" + u.Port()
+	f := newTestURLFetcher([]string{"localhost"})
+
+	t.Run("non-allowlisted loopback is refused", func(t *testing.T) {
+		_, err := f.Fetch(context.Background(), byIP+"/ok")
+		if err == nil || !strings.Contains(err.Error(), "not publicly routable") {
+			t.Fatalf("expected SSRF refusal, got %v", err)
+		}
+	})
+
+	t.Run("allowlisted host is fetched", func(t *testing.T) {
+		content, err := f.Fetch(context.Background(), byName+"/ok")
+		if err != nil {
+			t.Fatalf("expected allowlisted host to be fetched, got %v", err)
+		}
+		if string(content.Data) != "hello" {
+			t.Fatalf("unexpected body %q", content.Data)
+		}
+	})
+
+	t.Run("redirect within allowlisted host", func(t *testing.T) {
+		if _, err := f.Fetch(context.Background(), byName+"/to-ok"); err != nil {
+			t.Fatalf("expected redirect within allowlisted host to succeed, got %v", err)
+		}
+	})
+
+	t.Run("redirect to non-allowlisted address is refused", func(t *testing.T) {
+		_, err := f.Fetch(context.Background(), byName+"/to-ip")
+		if err == nil || !strings.Contains(err.Error(), "not publicly routable") {
+			t.Fatalf("expected redirect hop to be refused, got %v", err)
+		}
+	})
+
+	t.Run("redirect loop is bounded", func(t *testing.T) {
+		_, err := f.Fetch(context.Background(), byName+"/loop")
+		if err == nil || !strings.Contains(err.Error(), "too many redirects") {
+			t.Fatalf("expected too many redirects, got %v", err)
+		}
+	})
+
+	t.Run("non-http scheme is rejected", func(t *testing.T) {
+		_, err := f.Fetch(context.Background(), "file:///etc/passwd")
+		if err == nil || !strings.Contains(err.Error(), "only http and https are allowed") {
+			t.Fatalf("expected scheme rejection, got %v", err)
+		}
+	})
+}